@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// assignment is the state of a node which is assigned to a client or
+// reserved for a bot
+type assignment struct {
+	// Client is the IP address of the client the node is assigned to
+	Client string `json:"client,omitempty"`
+
+	// Session is the token the client reconnects with to be reattached to
+	// the node
+	Session string `json:"session,omitempty"`
+
+	// Nick is the nickname the client set with demo_setNick
+	Nick string `json:"nick,omitempty"`
+
+	// Bot is the kind of the bot the node is reserved for
+	Bot string `json:"bot,omitempty"`
+
+	// Expires is when the node is freed if the client is not connected to
+	// it, and is zero for bots
+	Expires time.Time `json:"expires"`
+}
+
+// expired returns whether the assignment of a client which is not connected
+// has expired
+func (a *assignment) expired(now time.Time) bool {
+	return !a.Expires.IsZero() && now.After(a.Expires)
+}
+
+// assignmentStore stores the assignments of a conn manager's nodes, keyed by
+// node ID
+type assignmentStore interface {
+	// Get returns the node's assignment, or nil if it is not assigned
+	Get(id discover.NodeID) (*assignment, error)
+	Put(id discover.NodeID, a *assignment) error
+	Delete(id discover.NodeID) error
+	List() (map[discover.NodeID]*assignment, error)
+	Close() error
+}
+
+// newAssignmentStore returns an assignment store in a LevelDB directory at
+// path, or an in-memory store if path is empty
+func newAssignmentStore(path string) (assignmentStore, error) {
+	if path == "" {
+		return newMemAssignmentStore(), nil
+	}
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening assignment store %s: %s", path, err)
+	}
+	return &levelDBAssignmentStore{db: db}, nil
+}
+
+// newSessionToken returns a random session token
+func newSessionToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// memAssignmentStore stores assignments in memory, so they are lost when the
+// demo restarts
+type memAssignmentStore struct {
+	mtx         sync.Mutex
+	assignments map[discover.NodeID]*assignment
+}
+
+func newMemAssignmentStore() *memAssignmentStore {
+	return &memAssignmentStore{assignments: make(map[discover.NodeID]*assignment)}
+}
+
+func (s *memAssignmentStore) Get(id discover.NodeID) (*assignment, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	a, ok := s.assignments[id]
+	if !ok {
+		return nil, nil
+	}
+	v := *a
+	return &v, nil
+}
+
+func (s *memAssignmentStore) Put(id discover.NodeID, a *assignment) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	v := *a
+	s.assignments[id] = &v
+	return nil
+}
+
+func (s *memAssignmentStore) Delete(id discover.NodeID) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.assignments, id)
+	return nil
+}
+
+func (s *memAssignmentStore) List() (map[discover.NodeID]*assignment, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	assignments := make(map[discover.NodeID]*assignment, len(s.assignments))
+	for id, a := range s.assignments {
+		v := *a
+		assignments[id] = &v
+	}
+	return assignments, nil
+}
+
+func (s *memAssignmentStore) Close() error {
+	return nil
+}
+
+// levelDBAssignmentStore stores assignments in a LevelDB database as
+// node ID => JSON encoded assignment
+type levelDBAssignmentStore struct {
+	db *leveldb.DB
+}
+
+func (s *levelDBAssignmentStore) Get(id discover.NodeID) (*assignment, error) {
+	data, err := s.db.Get(id[:], nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	a := &assignment{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("error decoding assignment of node %s: %s", id.TerminalString(), err)
+	}
+	return a, nil
+}
+
+func (s *levelDBAssignmentStore) Put(id discover.NodeID, a *assignment) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(id[:], data, nil)
+}
+
+func (s *levelDBAssignmentStore) Delete(id discover.NodeID) error {
+	return s.db.Delete(id[:], nil)
+}
+
+func (s *levelDBAssignmentStore) List() (map[discover.NodeID]*assignment, error) {
+	assignments := make(map[discover.NodeID]*assignment)
+	it := s.db.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		var id discover.NodeID
+		if len(it.Key()) != len(id) {
+			continue
+		}
+		copy(id[:], it.Key())
+		a := &assignment{}
+		if err := json.Unmarshal(it.Value(), a); err != nil {
+			return nil, fmt.Errorf("error decoding assignment of node %s: %s", id.TerminalString(), err)
+		}
+		assignments[id] = a
+	}
+	return assignments, it.Error()
+}
+
+func (s *levelDBAssignmentStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// TestAssignmentStore tests storing assignments in memory and in LevelDB,
+// with the LevelDB assignments persisting when the store is reopened
+func TestAssignmentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-assignments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "assignments")
+
+	alice := discover.NodeID{1}
+	bob := discover.NodeID{2}
+	test := func(store assignmentStore) {
+		if a, err := store.Get(alice); err != nil || a != nil {
+			t.Fatalf("expected no assignment, got %v, %v", a, err)
+		}
+		expected := &assignment{Client: "127.0.0.1", Session: "abc", Nick: "alice"}
+		if err := store.Put(alice, expected); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Put(bob, &assignment{Bot: "echo"}); err != nil {
+			t.Fatal(err)
+		}
+		if a, err := store.Get(alice); err != nil || !reflect.DeepEqual(a, expected) {
+			t.Fatalf("expected %+v, got %+v, %v", expected, a, err)
+		}
+		if err := store.Delete(bob); err != nil {
+			t.Fatal(err)
+		}
+		all, err := store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 || !reflect.DeepEqual(all[alice], expected) {
+			t.Fatalf("unexpected assignments %v", all)
+		}
+	}
+	test(newMemAssignmentStore())
+
+	store, err := newAssignmentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test(store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = newAssignmentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if a, err := store.Get(alice); err != nil || a == nil || a.Nick != "alice" {
+		t.Fatalf("expected the assignment to persist, got %+v, %v", a, err)
+	}
+}
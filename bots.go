@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+// botRetryInterval is how long a bot waits before trying to attach to a node
+// again when there are no free nodes or its node goes down
+const botRetryInterval = 5 * time.Second
+
+// botDuplicateWindow is how long bots ignore repeats of a message from the
+// same peer, as pss can deliver a message more than once and raw pss messages
+// have no ID to tell duplicates apart
+const botDuplicateWindow = 2 * time.Second
+
+// bot is an autonomous agent attached to a free simulation node, which
+// responds to the pss messages sent to the node
+//
+// Bots are only called from a single goroutine so need no locking.
+type bot interface {
+	// Handle handles a text message received from the peer with the given
+	// hex encoded public key, returning the replies to send
+	Handle(from, text string) []botReply
+}
+
+// botReply is a text message sent by a bot to the peer with the given hex
+// encoded public key
+type botReply struct {
+	To   string
+	Text string
+}
+
+// botKinds are the kinds of bots, keyed by the name used in --bots
+var botKinds = map[string]func() bot{
+	"echo":      func() bot { return echoBot{} },
+	"ping-pong": func() bot { return pingPongBot{} },
+	"trivia":    func() bot { return newTriviaBot() },
+	"relay":     func() bot { return newRelayBot() },
+}
+
+// botKindNames returns the sorted names of the kinds of bots
+func botKindNames() []string {
+	names := make([]string, 0, len(botKinds))
+	for name := range botKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// echoBot replies to messages with the same message
+type echoBot struct{}
+
+func (echoBot) Handle(from, text string) []botReply {
+	return []botReply{{To: from, Text: text}}
+}
+
+// pingPongBot replies to "ping" with "pong"
+type pingPongBot struct{}
+
+func (pingPongBot) Handle(from, text string) []botReply {
+	if strings.EqualFold(strings.TrimSpace(text), "ping") {
+		return []botReply{{To: from, Text: "pong"}}
+	}
+	return []botReply{{To: from, Text: `say "ping"`}}
+}
+
+// triviaQuestion is a trivia question with its accepted answers in lower case
+type triviaQuestion struct {
+	Question string
+	Answers  []string
+}
+
+var triviaQuestions = []triviaQuestion{
+	{"What does the pss in pss stand for?", []string{"postal service over swarm", "postal service"}},
+	{"How many bytes long is a pss topic?", []string{"4", "four"}},
+	{"Which distance metric does Kademlia use?", []string{"xor"}},
+	{"What is the name of Ethereum's peer-to-peer networking protocol suite?", []string{"devp2p"}},
+	{"What size in bytes are Swarm chunks?", []string{"4096", "4kb", "4k"}},
+	{"Which elliptic curve are pss keys on?", []string{"secp256k1"}},
+	{"What is the Swarm URL scheme for raw content?", []string{"bzzr", "bzzr:/", "bzz-raw"}},
+	{"What message format do Ethereum nodes use on the wire?", []string{"rlp"}},
+}
+
+// triviaPlayer is the state of a peer playing trivia
+type triviaPlayer struct {
+	question int
+	asked    bool
+	score    int
+	answered int
+}
+
+// triviaBot asks each peer which messages it a series of trivia questions,
+// keeping their score
+type triviaBot struct {
+	players map[string]*triviaPlayer
+}
+
+func newTriviaBot() *triviaBot {
+	return &triviaBot{players: make(map[string]*triviaPlayer)}
+}
+
+func (t *triviaBot) Handle(from, text string) []botReply {
+	p, ok := t.players[from]
+	if !ok {
+		p = &triviaPlayer{}
+		t.players[from] = p
+	}
+	var reply string
+	if p.asked {
+		q := triviaQuestions[p.question]
+		p.answered++
+		if q.correct(text) {
+			p.score++
+			reply = "Correct! "
+		} else {
+			reply = fmt.Sprintf("Wrong, the answer was %q. ", q.Answers[0])
+		}
+		reply += fmt.Sprintf("Score: %d/%d. ", p.score, p.answered)
+		p.question = (p.question + 1) % len(triviaQuestions)
+	} else {
+		reply = "Let's play trivia! "
+	}
+	p.asked = true
+	reply += triviaQuestions[p.question].Question
+	return []botReply{{To: from, Text: reply}}
+}
+
+func (q *triviaQuestion) correct(answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	for _, a := range q.Answers {
+		if answer == a {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRelayPeers is the maximum number of peers a relay bot relays messages
+// between, with the least recently active peer being dropped
+const maxRelayPeers = 32
+
+// relayBot relays messages to every other peer which has messaged it, so
+// that visitors can talk to each other without exchanging public keys
+type relayBot struct {
+	// peers are the hex encoded public keys of the peers, least recently
+	// active first
+	peers []string
+}
+
+func newRelayBot() *relayBot {
+	return &relayBot{}
+}
+
+func (r *relayBot) Handle(from, text string) []botReply {
+	joined := true
+	for i, peer := range r.peers {
+		if peer == from {
+			r.peers = append(r.peers[:i], r.peers[i+1:]...)
+			joined = false
+			break
+		}
+	}
+	r.peers = append(r.peers, from)
+	if len(r.peers) > maxRelayPeers {
+		r.peers = r.peers[1:]
+	}
+
+	name := from
+	if len(name) > 10 {
+		name = name[:10]
+	}
+	var replies []botReply
+	if joined {
+		replies = append(replies, botReply{
+			To:   from,
+			Text: fmt.Sprintf("relaying your messages to %d other peers", len(r.peers)-1),
+		})
+	}
+	for _, peer := range r.peers {
+		if peer != from {
+			replies = append(replies, botReply{
+				To:   peer,
+				Text: fmt.Sprintf("%s: %s", name, text),
+			})
+		}
+	}
+	return replies
+}
+
+// botSpec is the number of bots of each kind to run, which is parsed from a
+// comma separated list of KIND[:COUNT] (e.g. "echo:2,trivia")
+type botSpec []botCount
+
+type botCount struct {
+	Kind  string
+	Count int
+}
+
+func (s botSpec) MarshalText() ([]byte, error) {
+	parts := make([]string, len(s))
+	for i, c := range s {
+		parts[i] = fmt.Sprintf("%s:%d", c.Kind, c.Count)
+	}
+	return []byte(strings.Join(parts, ",")), nil
+}
+
+func (s *botSpec) UnmarshalText(text []byte) error {
+	var spec botSpec
+	for _, part := range strings.Split(string(text), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		c := botCount{Kind: part, Count: 1}
+		if i := strings.Index(part, ":"); i != -1 {
+			c.Kind = part[:i]
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid bot count %q, must be a positive integer", part[i+1:])
+			}
+			c.Count = n
+		}
+		if _, ok := botKinds[c.Kind]; !ok {
+			return fmt.Errorf("unknown bot kind %q, must be one of %s", c.Kind, strings.Join(botKindNames(), ", "))
+		}
+		spec = append(spec, c)
+	}
+	*s = spec
+	return nil
+}
+
+// Total returns the total number of bots
+func (s botSpec) Total() int {
+	total := 0
+	for _, c := range s {
+		total += c.Count
+	}
+	return total
+}
+
+// stringList is a list of strings which is encoded as a comma separated
+// string
+type stringList []string
+
+func (l stringList) MarshalText() ([]byte, error) {
+	return []byte(strings.Join(l, ",")), nil
+}
+
+func (l *stringList) UnmarshalText(text []byte) error {
+	var list stringList
+	for _, s := range strings.Split(string(text), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	*l = list
+	return nil
+}
+
+// botManager runs bots on free nodes of the conn manager's network, which
+// are reserved so that they are not assigned to clients
+type botManager struct {
+	conns  *connManager
+	topics []string
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newBotManager(conns *connManager, topics []string) *botManager {
+	return &botManager{
+		conns:  conns,
+		topics: topics,
+		quit:   make(chan struct{}),
+	}
+}
+
+// Start starts the bots in the spec
+func (m *botManager) Start(spec botSpec) {
+	for _, c := range spec {
+		for i := 0; i < c.Count; i++ {
+			m.wg.Add(1)
+			go func(kind string) {
+				defer m.wg.Done()
+				m.run(kind, botKinds[kind]())
+			}(c.Kind)
+		}
+	}
+}
+
+// Stop stops the bots and waits for them to exit
+func (m *botManager) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// run runs the bot until the manager is stopped, attaching it to another
+// free node if its node goes down
+func (m *botManager) run(kind string, b bot) {
+	for {
+		if node := m.conns.Reserve(kind); node != nil {
+			log.Info("attaching bot to node", "bot", kind, "node", node.Config.Name)
+			err := m.runOn(node, b)
+			if err == nil {
+				// the node stays reserved so that the bot is attached
+				// to it again if the demo restarts
+				return
+			}
+			m.conns.Release(node.ID())
+			log.Warn("bot detached from node", "bot", kind, "node", node.Config.Name, "err", err)
+		} else {
+			log.Warn("no free node for bot", "bot", kind)
+		}
+		select {
+		case <-time.After(botRetryInterval):
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// botMsg is a pss message received by a bot on a topic
+type botMsg struct {
+	topic pss.Topic
+	msg   pss.APIMsg
+}
+
+// runOn runs the bot on the node until the manager is stopped, returning an
+// error if the node's RPC client or pss subscriptions fail
+func (m *botManager) runOn(node *simulations.Node, b bot) error {
+	client, err := node.Client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgC := make(chan botMsg)
+	errC := make(chan error, len(m.topics))
+	for _, name := range m.topics {
+		topic := pss.BytesToTopic([]byte(name))
+		ch := make(chan pss.APIMsg)
+		sub, err := client.Subscribe(ctx, "pss", ch, "receive", topic)
+		if err != nil {
+			return fmt.Errorf("error subscribing to %s: %s", name, err)
+		}
+		defer sub.Unsubscribe()
+		go func() {
+			for {
+				select {
+				case msg := <-ch:
+					select {
+					case msgC <- botMsg{topic: topic, msg: msg}:
+					case <-ctx.Done():
+						return
+					}
+				case err := <-sub.Err():
+					errC <- err
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	seen := make(map[string]time.Time)
+	for {
+		select {
+		case msg := <-msgC:
+			// only asymmetric messages identify the sender to reply to
+			if !msg.msg.Asymmetric {
+				continue
+			}
+			now := time.Now()
+			for id, t := range seen {
+				if now.Sub(t) > botDuplicateWindow {
+					delete(seen, id)
+				}
+			}
+			id := msg.msg.Key + "/" + string(msg.msg.Msg)
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = now
+			for _, reply := range b.Handle(msg.msg.Key, string(msg.msg.Msg)) {
+				pubkey := common.FromHex(reply.To)
+				if err := client.Call(nil, "pss_setPeerPublicKey", pubkey, msg.topic, pss.PssAddress{}); err != nil {
+					log.Warn("error setting bot peer public key", "node", node.Config.Name, "to", reply.To, "err", err)
+					continue
+				}
+				if err := client.Call(nil, "pss_sendAsym", reply.To, msg.topic, []byte(reply.Text)); err != nil {
+					log.Warn("error sending bot reply", "node", node.Config.Name, "to", reply.To, "err", err)
+				}
+			}
+		case err := <-errC:
+			if err == nil {
+				err = fmt.Errorf("pss subscription closed")
+			}
+			return err
+		case <-m.quit:
+			return nil
+		}
+	}
+}
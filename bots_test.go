@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+// TestBots tests that bots are attached to free nodes, listed in /list and
+// reply to pss messages from clients
+func TestBots(t *testing.T) {
+	c := newTestConnManager(t, 3, nodeFailureClose)
+	defer c.Close()
+	waitForPeers(t, c.net.GetNodes(), 2, kademliaPeers)
+	bots := newBotManager(c.manager, []string{"pss-demo-bots"})
+	bots.Start(botSpec{{Kind: "echo", Count: 1}, {Kind: "ping-pong", Count: 1}})
+	defer bots.Stop()
+
+	// wait for the bots to be listed
+	var keys map[string]string
+	for start := time.Now(); ; {
+		keys = make(map[string]string)
+		for _, item := range c.list(t) {
+			if item.Bot != "" {
+				if !item.Assigned {
+					t.Fatalf("expected bot node %s to be assigned", item.Name)
+				}
+				keys[item.Bot] = item.Key
+			}
+		}
+		if len(keys) == 2 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for bots, got %v", keys)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// check the client is assigned the remaining node
+	alice := newTestClient(t, c)
+	defer alice.Close()
+	for _, key := range keys {
+		if key == base64.StdEncoding.EncodeToString(alice.pubkey) {
+			t.Fatal("expected client not to be assigned a bot node")
+		}
+	}
+
+	topic := pss.BytesToTopic([]byte("pss-demo-bots"))
+	msgC := make(chan pss.APIMsg)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sub, err := alice.Subscribe(ctx, "pss", msgC, "receive", topic)
+	if err != nil {
+		t.Fatalf("error subscribing to pss messages: %s", err)
+	}
+	defer sub.Unsubscribe()
+
+	for _, test := range []struct {
+		bot, msg, reply string
+	}{
+		{"echo", "hello bot", "hello bot"},
+		{"ping-pong", "ping", "pong"},
+	} {
+		// /list has base64 encoded keys
+		pubkey, err := base64.StdEncoding.DecodeString(keys[test.bot])
+		if err != nil {
+			t.Fatalf("error decoding %s bot key: %s", test.bot, err)
+		}
+		if err := alice.Call(nil, "pss_setPeerPublicKey", pubkey, topic, pss.PssAddress{}); err != nil {
+			t.Fatalf("error setting peer public key: %s", err)
+		}
+
+		// resend the message until the bot replies as messages are
+		// dropped if sent before the nodes complete their handshakes
+		send := func() {
+			if err := alice.Call(nil, "pss_sendAsym", common.ToHex(pubkey), topic, []byte(test.msg)); err != nil {
+				t.Fatalf("error sending pss message: %s", err)
+			}
+		}
+		send()
+		ticker := time.NewTicker(time.Second)
+	loop:
+		for {
+			select {
+			case msg := <-msgC:
+				if msg.Key != common.ToHex(pubkey) {
+					continue
+				}
+				if string(msg.Msg) != test.reply {
+					t.Fatalf("expected %s bot to reply %q, got %q", test.bot, test.reply, msg.Msg)
+				}
+				break loop
+			case <-ticker.C:
+				send()
+			case err := <-sub.Err():
+				t.Fatalf("pss subscription error: %s", err)
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s bot to reply", test.bot)
+			}
+		}
+		ticker.Stop()
+	}
+}
+
+func TestTriviaBot(t *testing.T) {
+	bot := newTriviaBot()
+	replies := bot.Handle("alice", "hi")
+	if len(replies) != 1 || !strings.HasSuffix(replies[0].Text, triviaQuestions[0].Question) {
+		t.Fatalf("expected the first question, got %v", replies)
+	}
+	replies = bot.Handle("alice", " Postal Service over Swarm ")
+	if !strings.HasPrefix(replies[0].Text, "Correct! Score: 1/1. ") || !strings.HasSuffix(replies[0].Text, triviaQuestions[1].Question) {
+		t.Fatalf("expected a correct answer and the second question, got %q", replies[0].Text)
+	}
+	replies = bot.Handle("alice", "seven")
+	if !strings.HasPrefix(replies[0].Text, `Wrong, the answer was "4". Score: 1/2. `) {
+		t.Fatalf("expected a wrong answer, got %q", replies[0].Text)
+	}
+
+	// other players start from the first question
+	replies = bot.Handle("bob", "hi")
+	if replies[0].To != "bob" || !strings.HasSuffix(replies[0].Text, triviaQuestions[0].Question) {
+		t.Fatalf("expected the first question for bob, got %v", replies)
+	}
+}
+
+func TestRelayBot(t *testing.T) {
+	bot := newRelayBot()
+	alice := "0x04aaaaaaaaaaaa"
+	bob := "0x04bbbbbbbbbbbb"
+	expected := []botReply{{To: alice, Text: "relaying your messages to 0 other peers"}}
+	if replies := bot.Handle(alice, "hello?"); !reflect.DeepEqual(replies, expected) {
+		t.Fatalf("expected %v, got %v", expected, replies)
+	}
+	expected = []botReply{
+		{To: bob, Text: "relaying your messages to 1 other peers"},
+		{To: alice, Text: "0x04bbbbbb: hi alice"},
+	}
+	if replies := bot.Handle(bob, "hi alice"); !reflect.DeepEqual(replies, expected) {
+		t.Fatalf("expected %v, got %v", expected, replies)
+	}
+	expected = []botReply{{To: bob, Text: "0x04aaaaaa: hi bob"}}
+	if replies := bot.Handle(alice, "hi bob"); !reflect.DeepEqual(replies, expected) {
+		t.Fatalf("expected %v, got %v", expected, replies)
+	}
+}
+
+func TestBotSpec(t *testing.T) {
+	var spec botSpec
+	if err := spec.UnmarshalText([]byte("echo:2, trivia")); err != nil {
+		t.Fatal(err)
+	}
+	expected := botSpec{{Kind: "echo", Count: 2}, {Kind: "trivia", Count: 1}}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("expected %v, got %v", expected, spec)
+	}
+	if text, _ := spec.MarshalText(); string(text) != "echo:2,trivia:1" {
+		t.Fatalf("unexpected text %q", text)
+	}
+	if spec.Total() != 3 {
+		t.Fatalf("expected 3 bots, got %d", spec.Total())
+	}
+	for _, text := range []string{"parrot", "echo:0", "echo:x"} {
+		if err := spec.UnmarshalText([]byte(text)); err == nil {
+			t.Fatalf("expected error parsing %q", text)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+)
+
+// chaosMinNodes is the minimum number of nodes the chaos engine leaves
+// running
+const chaosMinNodes = 2
+
+// chaosConfig is the configuration of the chaos engine
+type chaosConfig struct {
+	// NodeInterval is the interval between stopping random nodes, zero to
+	// never stop nodes
+	NodeInterval time.Duration
+
+	// LinkInterval is the interval between disconnecting random links, zero
+	// to never disconnect links
+	LinkInterval time.Duration
+
+	// Downtime is how long stopped nodes and disconnected links stay down
+	// before being restored
+	Downtime time.Duration
+
+	// SpareAssigned prevents stopping nodes assigned to clients or
+	// disconnecting their links
+	SpareAssigned bool
+}
+
+// chaosEngine randomly stops nodes and disconnects links in a simulation
+// network, restoring them after a downtime, so that pss can be seen routing
+// around failures
+//
+// The stops, starts, disconnects and connects are emitted as control events
+// on the network's event feed.
+type chaosEngine struct {
+	net      *simulations.Network
+	config   chaosConfig
+	assigned func(discover.NodeID) bool
+	quit     chan struct{}
+	done     chan struct{}
+
+	mtx    sync.Mutex
+	paused bool
+	down   []*chaosAction
+}
+
+// chaosAction is a node stopped or a link disconnected by the chaos engine,
+// which is restored at Until
+type chaosAction struct {
+	Type  simulations.EventType `json:"type"`
+	Node  string                `json:"node,omitempty"`
+	One   string                `json:"one,omitempty"`
+	Other string                `json:"other,omitempty"`
+	Until time.Time             `json:"until"`
+
+	id         discover.NodeID
+	peers      []discover.NodeID
+	one, other discover.NodeID
+}
+
+// chaosStatus is the status of the chaos engine served at /chaos
+type chaosStatus struct {
+	Paused bool           `json:"paused"`
+	Down   []*chaosAction `json:"down"`
+}
+
+// newChaosEngine returns a chaos engine for the network, with assigned
+// reporting whether a node is assigned to a client
+func newChaosEngine(net *simulations.Network, config chaosConfig, assigned func(discover.NodeID) bool) *chaosEngine {
+	return &chaosEngine{
+		net:      net,
+		config:   config,
+		assigned: assigned,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *chaosEngine) Run() {
+	defer close(c.done)
+	var nodeC, linkC <-chan time.Time
+	if c.config.NodeInterval > 0 {
+		ticker := time.NewTicker(c.config.NodeInterval)
+		defer ticker.Stop()
+		nodeC = ticker.C
+	}
+	if c.config.LinkInterval > 0 {
+		ticker := time.NewTicker(c.config.LinkInterval)
+		defer ticker.Stop()
+		linkC = ticker.C
+	}
+	restore := time.NewTicker(time.Second)
+	defer restore.Stop()
+	for {
+		select {
+		case <-nodeC:
+			if !c.Paused() {
+				c.stopNode()
+			}
+		case <-linkC:
+			if !c.Paused() {
+				c.disconnectLink()
+			}
+		case now := <-restore.C:
+			c.restore(now)
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// Stop stops the chaos engine and restores any stopped nodes and
+// disconnected links
+func (c *chaosEngine) Stop() {
+	close(c.quit)
+	<-c.done
+	c.restore(time.Time{})
+}
+
+func (c *chaosEngine) Paused() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.paused
+}
+
+func (c *chaosEngine) SetPaused(paused bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if paused != c.paused {
+		log.Info("chaos: setting paused", "paused", paused)
+	}
+	c.paused = paused
+}
+
+func (c *chaosEngine) Status() *chaosStatus {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return &chaosStatus{
+		Paused: c.paused,
+		Down:   append([]*chaosAction{}, c.down...),
+	}
+}
+
+// spared returns whether the node should not be touched by the chaos engine
+func (c *chaosEngine) spared(id discover.NodeID) bool {
+	return c.config.SpareAssigned && c.assigned(id)
+}
+
+// stopNode stops a random running node which is not spared, recording its
+// connected peers so it can be reconnected when it is restarted
+func (c *chaosEngine) stopNode() {
+	nodes := c.net.GetNodes()
+	var up, candidates []*simulations.Node
+	for _, node := range nodes {
+		if !node.Up {
+			continue
+		}
+		up = append(up, node)
+		if !c.spared(node.ID()) {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(up) <= chaosMinNodes || len(candidates) == 0 {
+		return
+	}
+	node := candidates[rand.Intn(len(candidates))]
+	action := &chaosAction{
+		Type:  simulations.EventTypeNode,
+		Node:  node.Config.Name,
+		Until: time.Now().Add(c.config.Downtime),
+		id:    node.ID(),
+	}
+	for _, other := range nodes {
+		if conn := c.net.GetConn(node.ID(), other.ID()); conn != nil && conn.Up {
+			action.peers = append(action.peers, other.ID())
+		}
+	}
+	log.Info("chaos: stopping node", "node", node.Config.Name, "downtime", c.config.Downtime)
+	if err := c.net.Stop(node.ID()); err != nil {
+		log.Error("chaos: error stopping node", "node", node.Config.Name, "err", err)
+		return
+	}
+	c.addDown(action)
+}
+
+// disconnectLink disconnects a random link between two running nodes which
+// are not spared
+func (c *chaosEngine) disconnectLink() {
+	nodes := c.net.GetNodes()
+	var candidates []*simulations.Conn
+	for i, one := range nodes {
+		if !one.Up || c.spared(one.ID()) {
+			continue
+		}
+		for _, other := range nodes[i+1:] {
+			if !other.Up || c.spared(other.ID()) {
+				continue
+			}
+			if conn := c.net.GetConn(one.ID(), other.ID()); conn != nil && conn.Up {
+				candidates = append(candidates, conn)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	conn := candidates[rand.Intn(len(candidates))]
+	one, other := c.net.GetNode(conn.One), c.net.GetNode(conn.Other)
+	log.Info("chaos: disconnecting link", "one", one.Config.Name, "other", other.Config.Name, "downtime", c.config.Downtime)
+	if err := c.net.Disconnect(conn.One, conn.Other); err != nil {
+		log.Error("chaos: error disconnecting link", "one", one.Config.Name, "other", other.Config.Name, "err", err)
+		return
+	}
+	c.addDown(&chaosAction{
+		Type:  simulations.EventTypeConn,
+		One:   one.Config.Name,
+		Other: other.Config.Name,
+		Until: time.Now().Add(c.config.Downtime),
+		one:   conn.One,
+		other: conn.Other,
+	})
+}
+
+func (c *chaosEngine) addDown(action *chaosAction) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.down = append(c.down, action)
+}
+
+// restore restarts nodes and reconnects links which were due to be restored
+// before the given time (or all of them if it is zero)
+func (c *chaosEngine) restore(now time.Time) {
+	c.mtx.Lock()
+	var due []*chaosAction
+	down := c.down[:0]
+	for _, action := range c.down {
+		if now.IsZero() || !now.Before(action.Until) {
+			due = append(due, action)
+		} else {
+			down = append(down, action)
+		}
+	}
+	c.down = down
+	c.mtx.Unlock()
+
+	for _, action := range due {
+		switch action.Type {
+		case simulations.EventTypeNode:
+			c.startNode(action)
+		case simulations.EventTypeConn:
+			c.connectLink(action)
+		}
+	}
+}
+
+// startNode restarts a node stopped by the chaos engine and reconnects it
+// to its previously connected peers which are still running
+func (c *chaosEngine) startNode(action *chaosAction) {
+	log.Info("chaos: starting node", "node", action.Node)
+	if err := c.net.Start(action.id); err != nil {
+		log.Error("chaos: error starting node", "node", action.Node, "err", err)
+		return
+	}
+
+	// the network only emits a control event when stopping a node, so
+	// emit one for the start
+	c.net.Events().Send(simulations.ControlEvent(c.net.GetNode(action.id)))
+
+	for _, id := range action.peers {
+		if peer := c.net.GetNode(id); peer == nil || !peer.Up {
+			continue
+		}
+		if err := c.net.Connect(action.id, id); err != nil {
+			log.Error("chaos: error reconnecting node", "node", action.Node, "peer", id.TerminalString(), "err", err)
+		}
+	}
+}
+
+// connectLink reconnects a link disconnected by the chaos engine if both
+// nodes are running, otherwise leaves it to be reconnected when a node
+// stopped by the chaos engine is restarted
+func (c *chaosEngine) connectLink(action *chaosAction) {
+	one, other := c.net.GetNode(action.one), c.net.GetNode(action.other)
+	if one == nil || other == nil {
+		return
+	}
+	if !one.Up || !other.Up {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		for _, down := range c.down {
+			if down.Type != simulations.EventTypeNode {
+				continue
+			}
+			if down.id == action.one {
+				down.peers = append(down.peers, action.other)
+				return
+			} else if down.id == action.other {
+				down.peers = append(down.peers, action.one)
+				return
+			}
+		}
+		return
+	}
+	log.Info("chaos: connecting link", "one", action.One, "other", action.Other)
+	if err := c.net.Connect(action.one, action.other); err != nil {
+		log.Error("chaos: error connecting link", "one", action.One, "other", action.Other, "err", err)
+	}
+}
+
+// ServeHTTP serves the chaos engine status at /chaos, and pauses or resumes
+// the engine on POST /chaos/pause and POST /chaos/resume
+func (c *chaosEngine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/chaos":
+	case "/chaos/pause", "/chaos/resume":
+		if req.Method != "POST" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.SetPaused(req.URL.Path == "/chaos/pause")
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(c.Status())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+)
+
+// TestChaosEngine tests that the chaos engine stops a node and disconnects a
+// link, then restarts the node, reconnects it to its peers and reconnects the
+// link once their downtime has passed
+func TestChaosEngine(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "pss-demo-chaos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	net, err := NewPssSimulation(adapters.NewSimAdapter(services), 5, logDir, &keyStore{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer net.Shutdown()
+
+	connUp := func(one, other discover.NodeID) bool {
+		conn := net.GetConn(one, other)
+		return conn != nil && conn.Up
+	}
+	waitUp := func(conns [][2]discover.NodeID) {
+		timeout := time.After(10 * time.Second)
+		for _, conn := range conns {
+			for !connUp(conn[0], conn[1]) {
+				select {
+				case <-timeout:
+					t.Fatalf("timed out waiting for %s - %s to connect", conn[0].TerminalString(), conn[1].TerminalString())
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}
+	}
+	nodes := net.GetNodes()
+	var ring [][2]discover.NodeID
+	for i, node := range nodes {
+		ring = append(ring, [2]discover.NodeID{node.ID(), nodes[(i+1)%len(nodes)].ID()})
+	}
+	waitUp(ring)
+
+	// record the links which go down, as Kademlia may redial a link as
+	// soon as it is disconnected
+	var downMtx sync.Mutex
+	down := make(map[[2]discover.NodeID]bool)
+	events := make(chan *simulations.Event)
+	sub := net.Events().Subscribe(events)
+	defer sub.Unsubscribe()
+	go func() {
+		for {
+			select {
+			case event := <-events:
+				if event.Type == simulations.EventTypeConn && !event.Conn.Up {
+					downMtx.Lock()
+					down[[2]discover.NodeID{event.Conn.One, event.Conn.Other}] = true
+					down[[2]discover.NodeID{event.Conn.Other, event.Conn.One}] = true
+					downMtx.Unlock()
+				}
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	wentDown := func(one, other discover.NodeID) bool {
+		downMtx.Lock()
+		defer downMtx.Unlock()
+		return down[[2]discover.NodeID{one, other}]
+	}
+
+	// spare node01 as if it were assigned to a client
+	spared := nodes[0].ID()
+	config := chaosConfig{Downtime: time.Minute, SpareAssigned: true}
+	chaos := newChaosEngine(net, config, func(id discover.NodeID) bool { return id == spared })
+	chaos.stopNode()
+	chaos.disconnectLink()
+
+	status := chaos.Status()
+	if len(status.Down) != 2 {
+		t.Fatalf("expected a node and a link to be down, got %d actions", len(status.Down))
+	}
+	stopped, link := status.Down[0], status.Down[1]
+	if stopped.Type != simulations.EventTypeNode || link.Type != simulations.EventTypeConn {
+		t.Fatalf("expected a node then a link to be down, got %s then %s", stopped.Type, link.Type)
+	}
+	if stopped.id == spared || link.one == spared || link.other == spared {
+		t.Fatal("expected node01 to be spared")
+	}
+	if net.GetNode(stopped.id).Up {
+		t.Fatalf("expected %s to be stopped", stopped.Node)
+	}
+	if len(stopped.peers) == 0 {
+		t.Fatalf("expected the peers of %s to be recorded", stopped.Node)
+	}
+	for start := time.Now(); !wentDown(link.one, link.other); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for %s - %s to disconnect", link.One, link.Other)
+		}
+	}
+
+	// nothing is restored before the downtime has passed
+	chaos.restore(time.Now())
+	if len(chaos.Status().Down) != 2 || net.GetNode(stopped.id).Up {
+		t.Fatal("expected nothing to be restored before the downtime has passed")
+	}
+
+	chaos.restore(time.Now().Add(config.Downtime))
+	if down := chaos.Status().Down; len(down) != 0 {
+		t.Fatalf("expected nothing to be down after restoring, got %d actions", len(down))
+	}
+	for _, node := range net.GetNodes() {
+		if !node.Up {
+			t.Fatalf("expected %s to be running after restoring", node.Config.Name)
+		}
+	}
+	conns := [][2]discover.NodeID{{link.one, link.other}}
+	for _, peer := range stopped.peers {
+		conns = append(conns, [2]discover.NodeID{stopped.id, peer})
+	}
+	waitUp(conns)
+}
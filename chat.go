@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+// chatVersion is the version of the chat protocol, with envelopes of other
+// versions being ignored
+const chatVersion = 1
+
+// chatTopicPrefix is prefixed to room names to derive their pss topics
+const chatTopicPrefix = "pss-demo-chat/"
+
+const (
+	maxRoomLength = 64
+	maxNickLength = 32
+	maxTextLength = 4096
+)
+
+const (
+	// chatRetryInterval is how long to wait for an envelope to be
+	// acknowledged before resending it
+	chatRetryInterval = time.Second
+
+	// chatMaxAttempts is how many times an envelope is sent before giving
+	// up on it being acknowledged
+	chatMaxAttempts = 5
+
+	// chatSeenTTL is how long the IDs of received envelopes are kept to
+	// ignore duplicates
+	chatSeenTTL = 5 * time.Minute
+)
+
+// chat envelope types
+const (
+	// chatJoin announces that the sender joined the room, with the
+	// recipient replying with a chatMembers envelope
+	chatJoin = "join"
+
+	// chatMembers lists the members of the room known to the sender,
+	// with the recipient sending a chatJoin to any members it did not know
+	// about, and replying with its own members if the sender did not list
+	// all of them
+	chatMembers = "members"
+
+	// chatLeave announces that the sender left the room
+	chatLeave = "leave"
+
+	// chatNick announces that the sender changed their nickname
+	chatNick = "nick"
+
+	// chatMsg is a text message sent to the room
+	chatMsg = "msg"
+
+	// chatAck acknowledges the envelope with the same ID
+	chatAck = "ack"
+)
+
+// chatEnvelope is the pss message sent between members of a chat room
+//
+// The sender of an envelope is the pss public key it was signed with rather
+// than a field of the envelope, so that senders cannot be impersonated.
+// Envelopes other than acks are resent until they are acknowledged, with
+// recipients ignoring envelopes with IDs they have already seen.
+type chatEnvelope struct {
+	Version int           `json:"v"`
+	ID      string        `json:"id"`
+	Type    string        `json:"type"`
+	Room    string        `json:"room"`
+	Nick    string        `json:"nick,omitempty"`
+	Addr    hexutil.Bytes `json:"addr,omitempty"`
+	Text    string        `json:"text,omitempty"`
+	Members []*chatMember `json:"members,omitempty"`
+	Time    int64         `json:"time"`
+}
+
+// chatMember is a member of a chat room
+type chatMember struct {
+	Pubkey hexutil.Bytes `json:"pubkey"`
+	Addr   hexutil.Bytes `json:"addr,omitempty"`
+	Nick   string        `json:"nick"`
+}
+
+// chatEvent is sent to chat_subscribe("messages", room) subscribers when a
+// member joins or leaves the room, changes their nickname or sends a message
+type chatEvent struct {
+	Type    string        `json:"type"`
+	Room    string        `json:"room"`
+	From    hexutil.Bytes `json:"from"`
+	Nick    string        `json:"nick"`
+	OldNick string        `json:"oldNick,omitempty"`
+	Text    string        `json:"text,omitempty"`
+	Time    int64         `json:"time"`
+}
+
+// chatRoom is a room joined by the node
+type chatRoom struct {
+	name  string
+	topic pss.Topic
+	nick  string
+
+	// members are the other members of the room keyed by the hex encoded
+	// public key
+	members map[string]*chatMember
+
+	// invited are the hex encoded public keys of the peers sent a chatJoin
+	invited map[string]struct{}
+
+	deregister func()
+}
+
+// chatSub is a chat_subscribe("messages", room) subscription
+type chatSub struct {
+	room     string
+	notifier *rpc.Notifier
+	sub      *rpc.Subscription
+}
+
+// chatDelivery is an envelope being sent to a member until it is
+// acknowledged
+type chatDelivery struct {
+	topic    pss.Topic
+	to       chatMember
+	data     []byte
+	attempts int
+}
+
+// PssChat runs the chat protocol on a node and exposes it as the chat RPC
+// API, tracking the members of the rooms the node has joined
+type PssChat struct {
+	pss    *pss.Pss
+	pubkey hexutil.Bytes
+	self   string
+	quit   chan struct{}
+
+	mtx   sync.Mutex
+	rooms map[string]*chatRoom
+	subs  map[rpc.ID]*chatSub
+	seen  map[string]time.Time
+
+	// pending are the unacknowledged deliveries keyed by envelope ID and
+	// recipient public key, which have their own lock so they can be added
+	// while holding mtx
+	pendingMtx sync.Mutex
+	pending    map[string]*chatDelivery
+}
+
+func newPssChat(ps *pss.Pss) *PssChat {
+	pubkey := crypto.FromECDSAPub(ps.PublicKey())
+	c := &PssChat{
+		pss:     ps,
+		pubkey:  pubkey,
+		self:    common.ToHex(pubkey),
+		quit:    make(chan struct{}),
+		rooms:   make(map[string]*chatRoom),
+		subs:    make(map[rpc.ID]*chatSub),
+		seen:    make(map[string]time.Time),
+		pending: make(map[string]*chatDelivery),
+	}
+	go c.retry()
+	return c
+}
+
+// chatTopic returns the pss topic of the room
+func chatTopic(room string) pss.Topic {
+	return pss.BytesToTopic([]byte(chatTopicPrefix + room))
+}
+
+func validateRoom(room string) error {
+	if len(room) > maxRoomLength || !nameMatcher.MatchString(room) {
+		return fmt.Errorf("invalid room %q, must be at most %d dot separated lower case letters, digits and hyphens", room, maxRoomLength)
+	}
+	return nil
+}
+
+func validateNick(nick string) error {
+	if nick == "" || utf8.RuneCountInString(nick) > maxNickLength {
+		return fmt.Errorf("invalid nickname %q, must be 1 to %d characters", nick, maxNickLength)
+	}
+	for _, r := range nick {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("invalid nickname %q, must not contain control characters", nick)
+		}
+	}
+	return nil
+}
+
+// Join joins the room with the given nickname, announcing it to the peers
+// with the given public keys, who reply with the members they know about if
+// they are in the room
+//
+// Joining a room which has already been joined announces it to any new peers.
+func (c *PssChat) Join(room, nick string, peers []hexutil.Bytes) error {
+	if err := validateRoom(room); err != nil {
+		return err
+	}
+	if err := validateNick(nick); err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if crypto.ToECDSAPub(peer) == nil {
+			return fmt.Errorf("invalid peer public key: %s", peer)
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	r, ok := c.rooms[room]
+	if !ok {
+		r = &chatRoom{
+			name:    room,
+			topic:   chatTopic(room),
+			nick:    nick,
+			members: make(map[string]*chatMember),
+			invited: make(map[string]struct{}),
+		}
+		r.deregister = c.pss.Register(&r.topic, func(msg []byte, _ *p2p.Peer, asymmetric bool, keyid string) error {
+			if !asymmetric {
+				return nil
+			}
+			return c.handle(room, msg, keyid)
+		})
+		c.rooms[room] = r
+		log.Info("joined chat room", "room", room, "nick", nick)
+	}
+	var invite []*chatMember
+	for _, peer := range peers {
+		id := common.ToHex(peer)
+		if id == c.self {
+			continue
+		}
+		if _, ok := r.invited[id]; ok {
+			continue
+		}
+		r.invited[id] = struct{}{}
+		invite = append(invite, &chatMember{Pubkey: peer})
+	}
+	c.send(r, c.envelope(r, chatJoin), invite...)
+	return nil
+}
+
+// Leave leaves the room, announcing it to the room's members
+func (c *PssChat) Leave(room string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	r, ok := c.rooms[room]
+	if !ok {
+		return fmt.Errorf("not in room %q", room)
+	}
+	delete(c.rooms, room)
+	c.send(r, c.envelope(r, chatLeave), r.memberList()...)
+
+	// keep receiving acks until the leave notices are no longer resent
+	time.AfterFunc(chatRetryInterval*chatMaxAttempts, r.deregister)
+	log.Info("left chat room", "room", room)
+	return nil
+}
+
+// SetNick changes the node's nickname in the room, announcing it to the
+// room's members
+func (c *PssChat) SetNick(room, nick string) error {
+	if err := validateNick(nick); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	r, ok := c.rooms[room]
+	if !ok {
+		return fmt.Errorf("not in room %q", room)
+	}
+	r.nick = nick
+	c.send(r, c.envelope(r, chatNick), r.memberList()...)
+	return nil
+}
+
+// Send sends a text message to the members of the room
+func (c *PssChat) Send(room, text string) error {
+	if text == "" || len(text) > maxTextLength {
+		return fmt.Errorf("invalid message, must be 1 to %d bytes", maxTextLength)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	r, ok := c.rooms[room]
+	if !ok {
+		return fmt.Errorf("not in room %q", room)
+	}
+	env := c.envelope(r, chatMsg)
+	env.Text = text
+	c.send(r, env, r.memberList()...)
+	return nil
+}
+
+// Members returns the members of the room, including the node itself
+func (c *PssChat) Members(room string) ([]*chatMember, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	r, ok := c.rooms[room]
+	if !ok {
+		return nil, fmt.Errorf("not in room %q", room)
+	}
+	members := append(r.memberList(), &chatMember{
+		Pubkey: c.pubkey,
+		Addr:   c.pss.BaseAddr(),
+		Nick:   r.nick,
+	})
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Nick < members[j].Nick
+	})
+	return members, nil
+}
+
+// Rooms returns the names of the rooms the node has joined
+func (c *PssChat) Rooms() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	rooms := make([]string, 0, len(c.rooms))
+	for name := range c.rooms {
+		rooms = append(rooms, name)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Messages subscribes to the events of a room which has been joined
+func (c *PssChat) Messages(ctx context.Context, room string) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.rooms[room]; !ok {
+		return nil, fmt.Errorf("not in room %q", room)
+	}
+	sub := notifier.CreateSubscription()
+	c.subs[sub.ID] = &chatSub{room: room, notifier: notifier, sub: sub}
+	go func() {
+		select {
+		case <-sub.Err():
+		case <-notifier.Closed():
+		}
+		c.mtx.Lock()
+		delete(c.subs, sub.ID)
+		c.mtx.Unlock()
+	}()
+	return sub, nil
+}
+
+// envelope returns a new envelope of the given type from the node to the
+// room
+func (c *PssChat) envelope(r *chatRoom, typ string) *chatEnvelope {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &chatEnvelope{
+		Version: chatVersion,
+		ID:      hexutil.Encode(id),
+		Type:    typ,
+		Room:    r.name,
+		Nick:    r.nick,
+		Addr:    c.pss.BaseAddr(),
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// memberList returns copies of the other members of the room
+func (r *chatRoom) memberList() []*chatMember {
+	members := make([]*chatMember, 0, len(r.members))
+	for _, m := range r.members {
+		m := *m
+		members = append(members, &m)
+	}
+	return members
+}
+
+// send sends the envelope to the members, resending it to members which do
+// not acknowledge it
+func (c *PssChat) send(r *chatRoom, env *chatEnvelope, members ...*chatMember) {
+	if len(members) == 0 {
+		return
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Error("error encoding chat envelope", "err", err)
+		return
+	}
+	c.pendingMtx.Lock()
+	defer c.pendingMtx.Unlock()
+	for _, m := range members {
+		d := &chatDelivery{topic: r.topic, to: *m, data: data, attempts: 1}
+		c.pending[env.ID+common.ToHex(m.Pubkey)] = d
+		go c.deliver(d)
+	}
+}
+
+// ack acknowledges the envelope received from the member
+func (c *PssChat) ack(r *chatRoom, env *chatEnvelope, from *chatMember) {
+	data, err := json.Marshal(&chatEnvelope{
+		Version: chatVersion,
+		ID:      env.ID,
+		Type:    chatAck,
+		Room:    r.name,
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		log.Error("error encoding chat ack", "err", err)
+		return
+	}
+	go c.deliver(&chatDelivery{topic: r.topic, to: *from, data: data})
+}
+
+// deliver sends the delivery's envelope over pss, which is done in a
+// separate goroutine so that it can be called from pss handlers
+func (c *PssChat) deliver(d *chatDelivery) {
+	key := crypto.ToECDSAPub(d.to.Pubkey)
+	if key == nil {
+		return
+	}
+	addr := pss.PssAddress(d.to.Addr)
+	err := c.pss.SetPeerPublicKey(key, d.topic, &addr)
+	if err == nil {
+		err = c.pss.SendAsym(common.ToHex(d.to.Pubkey), d.topic, d.data)
+	}
+	if err != nil {
+		log.Warn("error sending chat envelope", "to", common.ToHex(d.to.Pubkey), "err", err)
+	}
+}
+
+// retry resends unacknowledged deliveries and expires the IDs of received
+// envelopes until the service stops
+func (c *PssChat) retry() {
+	ticker := time.NewTicker(chatRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.quit:
+			return
+		}
+		c.pendingMtx.Lock()
+		for id, d := range c.pending {
+			if d.attempts >= chatMaxAttempts {
+				log.Warn("chat envelope not acknowledged", "to", common.ToHex(d.to.Pubkey), "attempts", d.attempts)
+				delete(c.pending, id)
+				continue
+			}
+			d.attempts++
+			go c.deliver(d)
+		}
+		c.pendingMtx.Unlock()
+
+		c.mtx.Lock()
+		for id, t := range c.seen {
+			if time.Since(t) > chatSeenTTL {
+				delete(c.seen, id)
+			}
+		}
+		c.mtx.Unlock()
+	}
+}
+
+// handle handles an envelope received in the room from the member with the
+// given hex encoded public key
+func (c *PssChat) handle(room string, msg []byte, from string) error {
+	var env chatEnvelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return fmt.Errorf("invalid chat envelope: %s", err)
+	}
+	if env.Version != chatVersion || env.Room != room || from == c.self {
+		return nil
+	}
+	if env.Type == chatAck {
+		c.pendingMtx.Lock()
+		delete(c.pending, env.ID+from)
+		c.pendingMtx.Unlock()
+		return nil
+	}
+	pubkey, err := hexutil.Decode(from)
+	if err != nil {
+		return err
+	}
+	if env.Type != chatLeave {
+		if err := validateNick(env.Nick); err != nil {
+			return err
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	r, ok := c.rooms[room]
+	if !ok {
+		return nil
+	}
+
+	// acknowledge every copy of the envelope as it is resent until the
+	// sender receives an ack, but only handle it once
+	member, known := r.members[from]
+	if !known {
+		member = &chatMember{Pubkey: pubkey}
+	}
+	if len(env.Addr) > 0 {
+		member.Addr = env.Addr
+	}
+	c.ack(r, &env, member)
+	seenID := from + env.ID
+	if _, ok := c.seen[seenID]; ok {
+		return nil
+	}
+	c.seen[seenID] = time.Now()
+
+	oldNick := member.Nick
+	if env.Type != chatLeave {
+		member.Nick = env.Nick
+		if !known {
+			r.members[from] = member
+			r.invited[from] = struct{}{}
+		}
+	}
+
+	event := &chatEvent{
+		Type: env.Type,
+		Room: room,
+		From: pubkey,
+		Nick: env.Nick,
+		Time: env.Time,
+	}
+	switch env.Type {
+	case chatJoin:
+		// reply with the members so the sender learns about them
+		reply := c.envelope(r, chatMembers)
+		reply.Members = r.memberList()
+		c.send(r, reply, member)
+	case chatMembers:
+		// announce the node to members it has not contacted yet
+		var invite []*chatMember
+		listed := make(map[string]struct{}, len(env.Members))
+		for _, m := range env.Members {
+			id := common.ToHex(m.Pubkey)
+			listed[id] = struct{}{}
+			if id == c.self {
+				continue
+			}
+			if _, ok := r.invited[id]; ok {
+				continue
+			}
+			r.invited[id] = struct{}{}
+			invite = append(invite, &chatMember{Pubkey: m.Pubkey, Addr: m.Addr})
+		}
+		c.send(r, c.envelope(r, chatJoin), invite...)
+
+		// members which joined through the node before it knew about the
+		// sender do not know about the sender either, so tell the sender
+		// about them
+		for id := range r.members {
+			if _, ok := listed[id]; !ok && id != from {
+				reply := c.envelope(r, chatMembers)
+				reply.Members = r.memberList()
+				c.send(r, reply, member)
+				break
+			}
+		}
+		if known {
+			return nil
+		}
+		// the sender was already in the room, which is reported as a join
+		event.Type = chatJoin
+	case chatLeave:
+		if !known {
+			return nil
+		}
+		delete(r.members, from)
+		delete(r.invited, from)
+		event.Nick = oldNick
+	case chatNick:
+		if known {
+			event.OldNick = oldNick
+		} else {
+			event.Type = chatJoin
+		}
+	case chatMsg:
+		if env.Text == "" || len(env.Text) > maxTextLength {
+			return errors.New("invalid chat message")
+		}
+		event.Text = env.Text
+	default:
+		return fmt.Errorf("unknown chat envelope type %q", env.Type)
+	}
+	for _, sub := range c.subs {
+		if sub.room == room {
+			sub.notifier.Notify(sub.sub.ID, event)
+		}
+	}
+	return nil
+}
+
+func (c *PssChat) stop() {
+	close(c.quit)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, r := range c.rooms {
+		r.deregister()
+	}
+}
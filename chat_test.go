@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// TestChat tests joining a chat room through different members, sending
+// messages to the room, changing nicknames and leaving
+func TestChat(t *testing.T) {
+	c := newTestConnManager(t, 3, nodeFailureClose)
+	defer c.Close()
+	waitForPeers(t, c.net.GetNodes(), 2, kademliaPeers)
+	alice := newTestClient(t, c)
+	defer alice.Close()
+	bob := newTestClient(t, c)
+	defer bob.Close()
+	carol := newTestClient(t, c)
+	defer carol.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	subscribe := func(client *testClient) chan *chatEvent {
+		ch := make(chan *chatEvent, 10)
+		if _, err := client.Subscribe(ctx, "chat", ch, "messages", "lobby"); err != nil {
+			t.Fatalf("error subscribing to chat events: %s", err)
+		}
+		return ch
+	}
+	expectEvent := func(ch chan *chatEvent, typ, nick, text string) *chatEvent {
+		for {
+			select {
+			case event := <-ch:
+				if event.Type == typ && event.Nick == nick {
+					if event.Text != text {
+						t.Fatalf("expected %s from %s with text %q, got %q", typ, nick, text, event.Text)
+					}
+					return event
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %s from %s", typ, nick)
+			}
+		}
+	}
+	nicks := func(client *testClient) string {
+		var members []*chatMember
+		if err := client.Call(&members, "chat_members", "lobby"); err != nil {
+			t.Fatal(err)
+		}
+		var nicks []string
+		for _, m := range members {
+			nicks = append(nicks, m.Nick)
+		}
+		sort.Strings(nicks)
+		return strings.Join(nicks, ",")
+	}
+	waitForMembers := func(client *testClient, expected string) {
+		for {
+			if nicks(client) == expected {
+				return
+			}
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for members %s, got %s", expected, nicks(client))
+			}
+		}
+	}
+
+	// check invalid params are rejected
+	if err := alice.Call(nil, "chat_join", "Lobby!", "alice", nil); err == nil {
+		t.Fatal("expected error joining invalid room")
+	}
+	if err := alice.Call(nil, "chat_join", "lobby", "", nil); err == nil {
+		t.Fatal("expected error joining with empty nickname")
+	}
+	if err := alice.Call(nil, "chat_send", "lobby", "hello"); err == nil {
+		t.Fatal("expected error sending to room which has not been joined")
+	}
+
+	// alice creates the room, bob joins through alice and carol joins
+	// through bob, with everyone learning about everyone else
+	if err := alice.Call(nil, "chat_join", "lobby", "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	aliceC := subscribe(alice)
+	if err := bob.Call(nil, "chat_join", "lobby", "bob", []hexutil.Bytes{alice.pubkey}); err != nil {
+		t.Fatal(err)
+	}
+	bobC := subscribe(bob)
+	expectEvent(aliceC, chatJoin, "bob", "")
+	if err := carol.Call(nil, "chat_join", "lobby", "carol", []hexutil.Bytes{bob.pubkey}); err != nil {
+		t.Fatal(err)
+	}
+	carolC := subscribe(carol)
+	expectEvent(aliceC, chatJoin, "carol", "")
+	expectEvent(bobC, chatJoin, "carol", "")
+	for _, client := range []*testClient{alice, bob, carol} {
+		waitForMembers(client, "alice,bob,carol")
+	}
+	var rooms []string
+	if err := carol.Call(&rooms, "chat_rooms"); err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0] != "lobby" {
+		t.Fatalf("unexpected rooms: %v", rooms)
+	}
+
+	// send a message to the room
+	if err := alice.Call(nil, "chat_send", "lobby", "hello everyone"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []chan *chatEvent{bobC, carolC} {
+		event := expectEvent(ch, chatMsg, "alice", "hello everyone")
+		if !strings.EqualFold(hexutil.Encode(event.From), hexutil.Encode(alice.pubkey)) {
+			t.Fatalf("expected message from %x, got %x", alice.pubkey, event.From)
+		}
+	}
+
+	// change nickname
+	if err := bob.Call(nil, "chat_setNick", "lobby", "robert"); err != nil {
+		t.Fatal(err)
+	}
+	if event := expectEvent(carolC, chatNick, "robert", ""); event.OldNick != "bob" {
+		t.Fatalf("expected old nickname bob, got %q", event.OldNick)
+	}
+	waitForMembers(alice, "alice,carol,robert")
+
+	// leave the room
+	if err := carol.Call(nil, "chat_leave", "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(aliceC, chatLeave, "carol", "")
+	expectEvent(bobC, chatLeave, "carol", "")
+	waitForMembers(alice, "alice,robert")
+	waitForMembers(bob, "alice,robert")
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// configEnvPrefix is the prefix of the environment variables which override
+// config values, with the rest of the name being the upper-cased config key
+// with dots replaced by underscores (e.g. PSS_DEMO_NETWORK_NODE_COUNT
+// overrides network.node_count)
+const configEnvPrefix = "PSS_DEMO_"
+
+// demoConfig is the configuration of the demo, which is loaded from a JSON or
+// TOML config file and overridden by environment variables and flags
+type demoConfig struct {
+	PssPort   int    `json:"pss_port"`
+	SwarmPort int    `json:"swarm_port"`
+	NetPort   int    `json:"net_port"`
+	NetAddr   string `json:"net_addr"`
+
+	Network     networkConfig   `json:"network"`
+	Networks    namedNetworks   `json:"networks"`
+	Kademlia    kademliaConfig  `json:"kademlia"`
+	Pss         pssConfig       `json:"pss"`
+	Swarm       swarmConfig     `json:"swarm"`
+	Ping        pingConfig      `json:"ping"`
+	NodeFailure nodeFailureMode `json:"node_failure"`
+	Chaos       chaosOptions    `json:"chaos"`
+	Link        linkConfig      `json:"link"`
+	Drain       drainConfig     `json:"drain"`
+	Bots        botsConfig      `json:"bots"`
+	Log         logConfig       `json:"log"`
+}
+
+// networkConfig is the configuration of the simulation network
+type networkConfig struct {
+	NodeCount int    `json:"node_count"`
+	Seed      string `json:"seed"`
+	KeyDir    string `json:"key_dir"`
+	DataDir   string `json:"data_dir"`
+}
+
+// namedNetworks are additional networks hosted alongside the default one,
+// keyed by name (e.g. [networks.track-a] in TOML)
+type namedNetworks map[string]*namedNetworkConfig
+
+// Names returns the sorted names of the networks
+func (n namedNetworks) Names() []string {
+	names := make([]string, 0, len(n))
+	for name := range n {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Nodes returns the config of the network each node of the named networks is
+// in, keyed by node name
+func (n namedNetworks) Nodes() map[string]*namedNetworkConfig {
+	nodes := make(map[string]*namedNetworkConfig)
+	for name, config := range n {
+		for i := 0; i < config.NodeCount; i++ {
+			nodes[pssNodeName(name, i)] = config
+		}
+	}
+	return nodes
+}
+
+// namedNetworkConfig is the configuration of a named network, with the
+// topology defaulting to ring, the pss message TTL defaulting to that of the
+// default network and the pss handshake also being enabled by pss.handshake
+type namedNetworkConfig struct {
+	NodeCount int      `json:"node_count"`
+	Topology  topology `json:"topology"`
+	MsgTTL    duration `json:"msg_ttl"`
+	Handshake bool     `json:"handshake"`
+}
+
+func (c *namedNetworkConfig) topology() topology {
+	if c.Topology == "" {
+		return topologyRing
+	}
+	return c.Topology
+}
+
+// kademliaConfig is the Kademlia configuration of the simulation nodes (see
+// network.KadParams)
+type kademliaConfig struct {
+	MinProxBinSize int `json:"min_prox_bin_size"`
+	MinBinSize     int `json:"min_bin_size"`
+	MaxBinSize     int `json:"max_bin_size"`
+	RetryInterval  int `json:"retry_interval"`
+	RetryExponent  int `json:"retry_exponent"`
+	MaxRetries     int `json:"max_retries"`
+}
+
+// pssConfig is the pss configuration of the simulation nodes
+type pssConfig struct {
+	MsgTTL          duration `json:"msg_ttl"`
+	Handshake       bool     `json:"handshake"`
+	HandshakeConfig string   `json:"handshake_config"`
+}
+
+// swarmConfig is the configuration of the Swarm HTTP gateway's store, which
+// is either a standalone store in Dir or, if Nodes is set, the Swarm services
+// of that many simulation nodes, and of its name registry
+type swarmConfig struct {
+	Dir           string `json:"dir"`
+	DbCapacity    uint64 `json:"db_capacity"`
+	CacheCapacity uint   `json:"cache_capacity"`
+	Nodes         int    `json:"nodes"`
+	Names         string `json:"names"`
+}
+
+// pingConfig is the configuration of the pss reachability prober
+type pingConfig struct {
+	Interval duration `json:"interval"`
+	Sample   int      `json:"sample"`
+}
+
+// chaosOptions is the configuration of chaos mode
+type chaosOptions struct {
+	Enabled       bool     `json:"enabled"`
+	NodeInterval  duration `json:"node_interval"`
+	LinkInterval  duration `json:"link_interval"`
+	Downtime      duration `json:"downtime"`
+	SpareAssigned bool     `json:"spare_assigned"`
+}
+
+// linkConfig is the impairment of the links between nodes, with Delay,
+// Jitter, Loss and Bandwidth being the default (see LinkImpairment) and
+// Matrix overriding it for links between nodes in the given regions, with
+// Regions mapping node names to regions, e.g. [link.matrix.eu.us] in TOML
+type linkConfig struct {
+	Delay     duration                              `json:"delay"`
+	Jitter    duration                              `json:"jitter"`
+	Loss      float64                               `json:"loss"`
+	Bandwidth int                                   `json:"bandwidth"`
+	Regions   map[string]string                     `json:"regions"`
+	Matrix    map[string]map[string]*LinkImpairment `json:"matrix"`
+}
+
+// Default returns the impairment of links which are not in the matrix
+func (c *linkConfig) Default() LinkImpairment {
+	return LinkImpairment{
+		Delay:     c.Delay,
+		Jitter:    c.Jitter,
+		Loss:      c.Loss,
+		Bandwidth: c.Bandwidth,
+	}
+}
+
+// drainConfig is the configuration of the drain phase on shutdown, with
+// clients being notified for Countdown before their connections are closed
+// and servers given up to Timeout to finish in-flight requests
+type drainConfig struct {
+	Countdown duration `json:"countdown"`
+	Timeout   duration `json:"timeout"`
+}
+
+// botsConfig is the configuration of the bots attached to free nodes, with
+// Kinds being the number of bots of each kind and Topics the pss topics they
+// receive messages on
+type botsConfig struct {
+	Kinds  botSpec    `json:"kinds"`
+	Topics stringList `json:"topics"`
+}
+
+// logConfig is the logging configuration, with Format, Level and Vmodule
+// being the log format and level of the demo and Node those of nodes, and the
+// network event log being rotated once it reaches EventsMaxSize bytes and
+// EventsMaxFiles rotated logs being kept
+type logConfig struct {
+	Dir            string        `json:"dir"`
+	Format         string        `json:"format"`
+	Level          string        `json:"level"`
+	Vmodule        string        `json:"vmodule"`
+	Node           nodeLogConfig `json:"node"`
+	EventsMaxSize  int           `json:"events_max_size"`
+	EventsMaxFiles int           `json:"events_max_files"`
+}
+
+// nodeLogConfig is the log format and level of nodes, with Vmodule overriding
+// the level of matching source files using a comma separated list of
+// PATTERN=LEVEL with numeric levels from 0 (crit) to 5 (trace), e.g.
+// "pss/*=5,p2p=4"
+type nodeLogConfig struct {
+	Format  string `json:"format"`
+	Level   string `json:"level"`
+	Vmodule string `json:"vmodule"`
+}
+
+// duration is a time.Duration which is encoded as a string (e.g. "30s")
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("%q is not a duration (e.g. 30s)", text)
+	}
+	*d = duration(v)
+	return nil
+}
+
+func defaultConfig() *demoConfig {
+	return &demoConfig{
+		PssPort:   8080,
+		SwarmPort: 8500,
+		NetPort:   8888,
+		NetAddr:   "127.0.0.1",
+		Network: networkConfig{
+			NodeCount: 10,
+		},
+		Kademlia: defaultKademliaConfig(),
+		Pss: pssConfig{
+			MsgTTL: duration(30 * time.Second),
+		},
+		Swarm: swarmConfig{
+			Dir:           "swarm",
+			DbCapacity:    20000000,
+			CacheCapacity: 500,
+		},
+		Ping: pingConfig{
+			Interval: duration(30 * time.Second),
+		},
+		NodeFailure: nodeFailureClose,
+		Chaos: chaosOptions{
+			NodeInterval: duration(time.Minute),
+			LinkInterval: duration(30 * time.Second),
+			Downtime:     duration(30 * time.Second),
+		},
+		Drain: drainConfig{
+			Countdown: duration(5 * time.Second),
+			Timeout:   duration(10 * time.Second),
+		},
+		Bots: botsConfig{
+			Topics: stringList{"pss-demo-chat"},
+		},
+		Log: logConfig{
+			Dir:    "log",
+			Format: "terminal",
+			Level:  "trace",
+			Node: nodeLogConfig{
+				Format: "logfmt",
+				Level:  "info",
+			},
+			EventsMaxSize:  64 * 1024 * 1024,
+			EventsMaxFiles: 5,
+		},
+	}
+}
+
+func defaultKademliaConfig() kademliaConfig {
+	return kademliaConfig{
+		MinProxBinSize: 2,
+		MinBinSize:     1,
+		MaxBinSize:     3,
+		RetryInterval:  1000000,
+		RetryExponent:  2,
+		MaxRetries:     1000,
+	}
+}
+
+// configFlags maps flags to the config keys they override
+var configFlags = []struct {
+	flag string
+	key  string
+}{
+	{"--pss-port", "pss_port"},
+	{"--swarm-port", "swarm_port"},
+	{"--net-port", "net_port"},
+	{"--net-addr", "net_addr"},
+	{"--swarm-dir", "swarm.dir"},
+	{"--swarm-nodes", "swarm.nodes"},
+	{"--swarm-names", "swarm.names"},
+	{"--node-count", "network.node_count"},
+	{"--log-dir", "log.dir"},
+	{"--log-format", "log.format"},
+	{"--log-format", "log.node.format"},
+	{"--verbosity", "log.level"},
+	{"--vmodule", "log.vmodule"},
+	{"--node-verbosity", "log.node.level"},
+	{"--node-vmodule", "log.node.vmodule"},
+	{"--event-log-size", "log.events_max_size"},
+	{"--event-log-files", "log.events_max_files"},
+	{"--seed", "network.seed"},
+	{"--key-dir", "network.key_dir"},
+	{"--data-dir", "network.data_dir"},
+	{"--handshake", "pss.handshake"},
+	{"--handshake-config", "pss.handshake_config"},
+	{"--ping-interval", "ping.interval"},
+	{"--ping-sample", "ping.sample"},
+	{"--node-failure", "node_failure"},
+	{"--chaos", "chaos.enabled"},
+	{"--chaos-node-interval", "chaos.node_interval"},
+	{"--chaos-link-interval", "chaos.link_interval"},
+	{"--chaos-downtime", "chaos.downtime"},
+	{"--chaos-spare-assigned", "chaos.spare_assigned"},
+	{"--link-delay", "link.delay"},
+	{"--link-jitter", "link.jitter"},
+	{"--link-loss", "link.loss"},
+	{"--link-bandwidth", "link.bandwidth"},
+	{"--drain-countdown", "drain.countdown"},
+	{"--drain-timeout", "drain.timeout"},
+	{"--bots", "bots.kinds"},
+	{"--bot-topics", "bots.topics"},
+}
+
+// loadConfig loads the config from the default values, the config file given
+// by the --config flag, environment variables and flags (in order of
+// increasing precedence), then validates it
+func loadConfig(args map[string]interface{}, env []string) (*demoConfig, error) {
+	config := defaultConfig()
+	if path, ok := args["--config"].(string); ok {
+		if err := config.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.loadEnv(env); err != nil {
+		return nil, err
+	}
+	for _, f := range configFlags {
+		var value string
+		switch v := args[f.flag].(type) {
+		case string:
+			value = v
+		case bool:
+			if !v {
+				continue
+			}
+			value = "true"
+		default:
+			continue
+		}
+		if err := config.set(f.key, value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", f.flag, err)
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadFile loads the config from a TOML file if it has a .toml extension,
+// otherwise a JSON file
+func (c *demoConfig) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %s", err)
+	}
+	if filepath.Ext(path) == ".toml" {
+		v, err := decodeTOML(data)
+		if err != nil {
+			return fmt.Errorf("error decoding config file %s: %s", path, err)
+		}
+		data, err = json.Marshal(v)
+		if err != nil {
+			return err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("error decoding config file %s: %s", path, err)
+	}
+	return nil
+}
+
+// loadEnv overrides config values with the given environment variables
+func (c *demoConfig) loadEnv(env []string) error {
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i != -1 {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	for _, key := range configKeys(reflect.TypeOf(c).Elem(), "") {
+		name := configEnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		value, ok := vars[name]
+		if !ok {
+			continue
+		}
+		if err := c.set(key, value); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// configKeys returns the dotted keys of the values in the config type
+func configKeys(typ reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		key := prefix + field.Tag.Get("json")
+		if field.Type.Kind() == reflect.Struct && !reflect.PtrTo(field.Type).Implements(textUnmarshalerType) {
+			keys = append(keys, configKeys(field.Type, key+".")...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// set sets the config value with the given dotted key from a string
+func (c *demoConfig) set(key, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(key, ".") {
+		var field reflect.Value
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).Tag.Get("json") == name {
+				field = v.Field(i)
+				break
+			}
+		}
+		if !field.IsValid() {
+			return fmt.Errorf("unknown config key %q", key)
+		}
+		v = field
+	}
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean (true or false)", value)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint64:
+		i, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a positive integer", value)
+		}
+		v.SetUint(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported config value type %s", v.Type())
+	}
+	return nil
+}
+
+// validate checks the config values, returning an error listing all the
+// invalid values
+func (c *demoConfig) validate() error {
+	var errs []string
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	ports := map[int]string{}
+	for _, p := range []struct {
+		key  string
+		port int
+	}{
+		{"pss_port", c.PssPort},
+		{"swarm_port", c.SwarmPort},
+		{"net_port", c.NetPort},
+	} {
+		check(p.port > 0 && p.port < 65536, p.key, "%d is not a valid port (1-65535)", p.port)
+		if other, ok := ports[p.port]; ok {
+			check(false, p.key, "port %d is also used by %s", p.port, other)
+		}
+		ports[p.port] = p.key
+	}
+	check(net.ParseIP(c.NetAddr) != nil, "net_addr", "%q is not an IP address", c.NetAddr)
+
+	check(c.Network.NodeCount >= 2, "network.node_count", "must be at least 2, got %d", c.Network.NodeCount)
+
+	for _, name := range c.Networks.Names() {
+		n := c.Networks[name]
+		key := "networks." + name
+		check(networkNamePattern.MatchString(name), key, "network names must be lower case letters, digits and dashes")
+		check(n.NodeCount >= 2, key+".node_count", "must be at least 2, got %d", n.NodeCount)
+		check(n.MsgTTL >= 0, key+".msg_ttl", "must not be negative, got %s", time.Duration(n.MsgTTL))
+	}
+
+	check(c.Kademlia.MinProxBinSize > 0, "kademlia.min_prox_bin_size", "must be positive, got %d", c.Kademlia.MinProxBinSize)
+	check(c.Kademlia.MinBinSize > 0, "kademlia.min_bin_size", "must be positive, got %d", c.Kademlia.MinBinSize)
+	check(c.Kademlia.MaxBinSize >= c.Kademlia.MinBinSize, "kademlia.max_bin_size", "must be at least min_bin_size (%d), got %d", c.Kademlia.MinBinSize, c.Kademlia.MaxBinSize)
+	check(c.Kademlia.RetryInterval > 0, "kademlia.retry_interval", "must be positive, got %d", c.Kademlia.RetryInterval)
+	check(c.Kademlia.RetryExponent > 0, "kademlia.retry_exponent", "must be positive, got %d", c.Kademlia.RetryExponent)
+	check(c.Kademlia.MaxRetries >= 0, "kademlia.max_retries", "must not be negative, got %d", c.Kademlia.MaxRetries)
+
+	check(c.Pss.MsgTTL > 0, "pss.msg_ttl", "must be positive, got %s", time.Duration(c.Pss.MsgTTL))
+
+	check(c.Swarm.Dir != "", "swarm.dir", "must be set")
+	check(c.Swarm.DbCapacity > 0, "swarm.db_capacity", "must be positive")
+	check(c.Swarm.CacheCapacity > 0, "swarm.cache_capacity", "must be positive")
+	check(c.Swarm.Nodes >= 0 && c.Swarm.Nodes <= c.Network.NodeCount, "swarm.nodes", "must be between 0 and network.node_count (%d), got %d", c.Network.NodeCount, c.Swarm.Nodes)
+
+	check(c.Ping.Interval >= 0, "ping.interval", "must not be negative, got %s", time.Duration(c.Ping.Interval))
+	check(c.Ping.Sample >= 0, "ping.sample", "must not be negative, got %d", c.Ping.Sample)
+
+	check(c.NodeFailure == nodeFailureClose || c.NodeFailure == nodeFailureMigrate, "node_failure", "must be %q or %q, got %q", nodeFailureClose, nodeFailureMigrate, c.NodeFailure)
+
+	if c.Chaos.Enabled {
+		check(c.Chaos.NodeInterval >= 0, "chaos.node_interval", "must not be negative, got %s", time.Duration(c.Chaos.NodeInterval))
+		check(c.Chaos.LinkInterval >= 0, "chaos.link_interval", "must not be negative, got %s", time.Duration(c.Chaos.LinkInterval))
+		check(c.Chaos.Downtime > 0, "chaos.downtime", "must be positive, got %s", time.Duration(c.Chaos.Downtime))
+	}
+
+	def := c.Link.Default()
+	if err := def.validate(); err != nil {
+		check(false, "link", "%s", err)
+	}
+	regions := make(map[string]bool)
+	for _, region := range c.Link.Regions {
+		regions[region] = true
+	}
+	for r1, row := range c.Link.Matrix {
+		for r2, l := range row {
+			key := "link.matrix." + r1 + "." + r2
+			check(regions[r1] && regions[r2], key, "regions must be assigned to nodes in link.regions")
+			if l == nil {
+				continue
+			}
+			if err := l.validate(); err != nil {
+				check(false, key, "%s", err)
+			}
+		}
+	}
+
+	check(c.Drain.Countdown >= 0, "drain.countdown", "must not be negative, got %s", time.Duration(c.Drain.Countdown))
+	check(c.Drain.Timeout >= 0, "drain.timeout", "must not be negative, got %s", time.Duration(c.Drain.Timeout))
+
+	check(c.Bots.Kinds.Total() <= c.Network.NodeCount, "bots.kinds", "must be at most network.node_count (%d) bots, got %d", c.Network.NodeCount, c.Bots.Kinds.Total())
+	check(len(c.Bots.Kinds) == 0 || len(c.Bots.Topics) > 0, "bots.topics", "must be set when running bots")
+
+	check(c.Log.Dir != "", "log.dir", "must be set")
+	for _, f := range []struct{ key, format string }{
+		{"log.format", c.Log.Format},
+		{"log.node.format", c.Log.Node.Format},
+	} {
+		_, err := parseLogFormat(f.format, false)
+		check(err == nil, f.key, "must be json, logfmt or terminal, got %q", f.format)
+	}
+	_, err := log.LvlFromString(c.Log.Level)
+	check(err == nil, "log.level", "must be one of trace, debug, info, warn, error or crit, got %q", c.Log.Level)
+	err = checkVmodule(c.Log.Vmodule)
+	check(err == nil, "log.vmodule", "must be a comma separated list of PATTERN=LEVEL, got %q", c.Log.Vmodule)
+	_, err = log.LvlFromString(c.Log.Node.Level)
+	check(err == nil, "log.node.level", "must be one of trace, debug, info, warn, error or crit, got %q", c.Log.Node.Level)
+	err = checkVmodule(c.Log.Node.Vmodule)
+	check(err == nil, "log.node.vmodule", "must be a comma separated list of PATTERN=LEVEL, got %q", c.Log.Node.Vmodule)
+	check(c.Log.EventsMaxSize >= 0, "log.events_max_size", "must not be negative, got %d", c.Log.EventsMaxSize)
+	check(c.Log.EventsMaxFiles >= 0, "log.events_max_files", "must not be negative, got %d", c.Log.EventsMaxFiles)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Print writes the config to stdout as JSON
+func (c *demoConfig) Print() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(data))
+	return err
+}
+
+func (c *chaosOptions) config() chaosConfig {
+	return chaosConfig{
+		NodeInterval:  time.Duration(c.NodeInterval),
+		LinkInterval:  time.Duration(c.LinkInterval),
+		Downtime:      time.Duration(c.Downtime),
+		SpareAssigned: c.SpareAssigned,
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeTOML(t *testing.T) {
+	v, err := decodeTOML([]byte(`
+# comment
+a = "x # not a comment" # comment
+b.c = 'literal'
+
+[d]
+e = 1_000
+f = -1.5
+g = true
+h = ["one", 2, false, "x, y"]
+k = 0
+l = +1e3
+"m=n" = "o=p"
+
+[d.i]
+j = "\"quoted\""
+
+[networks."a.b"]
+'c.d' . "e" = 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a": "x # not a comment",
+		"b": map[string]interface{}{"c": "literal"},
+		"d": map[string]interface{}{
+			"e":   int64(1000),
+			"f":   -1.5,
+			"g":   true,
+			"h":   []interface{}{"one", int64(2), false, "x, y"},
+			"k":   int64(0),
+			"l":   1000.0,
+			"m=n": "o=p",
+			"i":   map[string]interface{}{"j": `"quoted"`},
+		},
+		"networks": map[string]interface{}{
+			"a.b": map[string]interface{}{
+				"c.d": map[string]interface{}{"e": int64(2)},
+			},
+		},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("unexpected TOML value:\nexpected %#v\ngot      %#v", expected, v)
+	}
+
+	for _, s := range []string{
+		"a",
+		"a = ",
+		"a = 1\na = 2",
+		"a = {b = 1}",
+		"[[a]]",
+		"a = 1\n[a]",
+		"a = [1,",
+		"a b = 1",
+		"a..b = 1",
+		"\"a = 1",
+		"[a]\n[b]\n[a]",
+		"[a.\"b\"]\n[ a . b ]",
+		"a = 010",
+		"a = 0x10",
+		"a = 0o10",
+		"a = 0b10",
+		"a = 1__0",
+		"a = _10",
+		"a = 10_",
+		"a = 01.5",
+		"a = 0x1p4",
+	} {
+		if _, err := decodeTOML([]byte(s)); err == nil {
+			t.Fatalf("expected error decoding %q", s)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte(`
+pss_port = 9000
+net_port = 9001
+
+[network]
+node_count = 4
+seed = "seed"
+
+[chaos]
+enabled = true
+downtime = "10s"
+
+[link.regions]
+node01 = "eu"
+node02 = "us"
+
+[link.matrix.eu.us]
+delay = "80ms"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// check flags override the environment which overrides the file
+	config, err := loadConfig(map[string]interface{}{
+		"--config":     path,
+		"--net-port":   "9002",
+		"--handshake":  true,
+		"--chaos":      false,
+		"--log-format": "json",
+		"--link-loss":  "0.01",
+	}, []string{
+		"PSS_DEMO_NET_PORT=9003",
+		"PSS_DEMO_NETWORK_NODE_COUNT=5",
+		"PSS_DEMO_PING_INTERVAL=1m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := defaultConfig()
+	expected.PssPort = 9000
+	expected.NetPort = 9002
+	expected.Network.NodeCount = 5
+	expected.Network.Seed = "seed"
+	expected.Pss.Handshake = true
+	expected.Ping.Interval = duration(time.Minute)
+	expected.Chaos.Enabled = true
+	expected.Chaos.Downtime = duration(10 * time.Second)
+	expected.Log.Format = "json"
+	expected.Log.Node.Format = "json"
+	expected.Link.Loss = 0.01
+	expected.Link.Regions = map[string]string{"node01": "eu", "node02": "us"}
+	expected.Link.Matrix = map[string]map[string]*LinkImpairment{
+		"eu": {"us": {Delay: duration(80 * time.Millisecond)}},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("unexpected config:\nexpected %+v\ngot      %+v", expected, config)
+	}
+
+	// check invalid values are reported
+	for _, test := range []struct {
+		args map[string]interface{}
+		env  []string
+		err  string
+	}{
+		{
+			args: map[string]interface{}{"--pss-port": "abc"},
+			err:  `invalid --pss-port: "abc" is not an integer`,
+		},
+		{
+			env: []string{"PSS_DEMO_CHAOS_DOWNTIME=10"},
+			err: `invalid PSS_DEMO_CHAOS_DOWNTIME: "10" is not a duration (e.g. 30s)`,
+		},
+		{
+			args: map[string]interface{}{"--node-count": "1", "--pss-port": "8888", "--node-failure": "retry"},
+			err:  `invalid config: net_port: port 8888 is also used by pss_port; network.node_count: must be at least 2, got 1; node_failure: must be "close" or "migrate", got "retry"`,
+		},
+		{
+			env: []string{"PSS_DEMO_LOG_NODE_FORMAT=xml"},
+			err: `invalid config: log.node.format: must be json, logfmt or terminal, got "xml"`,
+		},
+		{
+			env: []string{"PSS_DEMO_LINK_LOSS=1"},
+			err: `invalid config: link: loss must be at least 0 and less than 1, got 1`,
+		},
+		{
+			args: map[string]interface{}{"--link-loss": "lots"},
+			err:  `invalid --link-loss: "lots" is not a number`,
+		},
+		{
+			args: map[string]interface{}{"--config": filepath.Join(dir, "missing.json")},
+			err:  "error reading config file",
+		},
+	} {
+		_, err := loadConfig(test.args, test.env)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Fatalf("expected error %q, got %v", test.err, err)
+		}
+	}
+
+	// check unknown keys in config files are reported
+	path = filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"network": {"node_cuont": 3}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(map[string]interface{}{"--config": path}, nil); err == nil || !strings.Contains(err.Error(), `unknown field "node_cuont"`) {
+		t.Fatalf("expected unknown field error, got %v", err)
+	}
+}
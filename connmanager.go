@@ -1,34 +1,238 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/p2p/simulations"
 	"golang.org/x/net/websocket"
 )
 
+// nodeFailureMode determines what happens to a client when its assigned
+// node goes down
+type nodeFailureMode string
+
+const (
+	// nodeFailureClose closes the client's WebSocket connection with a
+	// close reason and frees the node's slot
+	nodeFailureClose nodeFailureMode = "close"
+
+	// nodeFailureMigrate reattaches the client to a free node and sends it
+	// a demo_nodeChanged notification, closing the connection if there are
+	// no free nodes
+	nodeFailureMigrate nodeFailureMode = "migrate"
+)
+
+// closeStatusGoingAway is the WebSocket close status used when a client's
+// node goes down
+const closeStatusGoingAway = 1001
+
+const (
+	// defaultSessionExpiry is how long a client's node stays assigned to
+	// it after it disconnects, so that it can resume its session
+	defaultSessionExpiry = 10 * time.Minute
+
+	// expireInterval is how often the assignments of disconnected clients
+	// are checked for expiry
+	expireInterval = time.Minute
+)
+
 type connList struct {
+	ID       discover.NodeID
+	Name     string
 	Key      string
 	Assigned bool
+	Bot      string `json:",omitempty"`
 }
 
 type connManager struct {
 	net      *simulations.Network
+	failure  nodeFailureMode
+	quit     chan struct{}
 	mtx      sync.Mutex
-	clients  map[string]*simulations.Node
-	assigned map[discover.NodeID]struct{}
+	store    assignmentStore
+	sessions map[discover.NodeID]*clientSession
+	handlers map[string]rpcHandler
+	draining bool
+
+	// sessionExpiry is how long a client's node stays assigned to it after
+	// it disconnects
+	sessionExpiry time.Duration
+
+	// tokens are the nodes assigned to clients keyed by session token, and
+	// reserved are the kinds of the bots nodes are reserved for, so that
+	// sessions and reservations are found without listing the store
+	tokens   map[string]discover.NodeID
+	reserved map[discover.NodeID]string
+
+	// bots are the kinds of the bots running on nodes reserved for them,
+	// with reserved also containing the reservations of bots which ran
+	// before the demo restarted
+	bots map[discover.NodeID]string
+}
+
+// newConnManager returns a conn manager which stores the assignments of
+// nodes in store, dropping those of nodes which are no longer in the
+// network (e.g. because the nodes have new identities) and those of clients
+// whose sessions have expired
+func newConnManager(net *simulations.Network, failure nodeFailureMode, store assignmentStore) (*connManager, error) {
+	c := &connManager{
+		net:           net,
+		failure:       failure,
+		quit:          make(chan struct{}),
+		store:         store,
+		sessions:      make(map[discover.NodeID]*clientSession),
+		handlers:      make(map[string]rpcHandler),
+		sessionExpiry: defaultSessionExpiry,
+		tokens:        make(map[string]discover.NodeID),
+		reserved:      make(map[discover.NodeID]string),
+		bots:          make(map[discover.NodeID]string),
+	}
+	assignments, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("error loading node assignments: %s", err)
+	}
+	now := time.Now()
+	for id, a := range assignments {
+		if c.net.GetNode(id) != nil && !a.expired(now) {
+			c.index(id, a)
+			continue
+		}
+		if err := store.Delete(id); err != nil {
+			return nil, fmt.Errorf("error deleting node assignment: %s", err)
+		}
+	}
+	c.handlers["demo_session"] = c.sessionInfo
+	c.handlers["demo_setNick"] = c.setNick
+	return c, nil
+}
+
+// Run handles assigned nodes going down and frees the nodes of clients
+// whose sessions have expired until Stop is called
+//
+// Nodes going down are handled in a separate goroutine to the one receiving
+// network events, as handling them takes the network's lock (which it holds
+// while sending events) and calls the nodes' RPC APIs.
+func (c *connManager) Run() {
+	events := make(chan *simulations.Event)
+	sub := c.net.Events().Subscribe(events)
+	defer sub.Unsubscribe()
+	expire := time.NewTicker(expireInterval)
+	defer expire.Stop()
+
+	var (
+		downMtx sync.Mutex
+		down    []discover.NodeID
+	)
+	wake := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-wake:
+			case <-c.quit:
+				return
+			}
+			downMtx.Lock()
+			ids := down
+			down = nil
+			downMtx.Unlock()
+			for _, id := range ids {
+				c.nodeDown(id)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case event := <-events:
+			if event.Type == simulations.EventTypeNode && !event.Node.Up {
+				downMtx.Lock()
+				down = append(down, event.Node.ID())
+				downMtx.Unlock()
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		case now := <-expire.C:
+			c.expireSessions(now)
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// expireSessions frees the nodes of disconnected clients whose sessions
+// expired before now
+func (c *connManager) expireSessions(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, id := range c.tokens {
+		if _, ok := c.sessions[id]; ok {
+			continue
+		}
+		a, err := c.store.Get(id)
+		if err != nil {
+			log.Error("error loading node assignment", "node_id", id, "err", err)
+			continue
+		}
+		if a == nil || !a.expired(now) {
+			continue
+		}
+		log.Info("freeing node of expired client session", "node_id", id)
+		c.delete(id, a)
+	}
+}
+
+// put stores and indexes the node's assignment (the caller must hold c.mtx)
+func (c *connManager) put(id discover.NodeID, a *assignment) error {
+	if err := c.store.Put(id, a); err != nil {
+		return err
+	}
+	c.index(id, a)
+	return nil
+}
+
+// index adds the node's assignment to the indexes (the caller must hold
+// c.mtx)
+func (c *connManager) index(id discover.NodeID, a *assignment) {
+	if a.Session != "" {
+		c.tokens[a.Session] = id
+	}
+	if a.Bot != "" {
+		c.reserved[id] = a.Bot
+	}
 }
 
-func newConnManager(net *simulations.Network) *connManager {
-	return &connManager{
-		net:      net,
-		clients:  make(map[string]*simulations.Node),
-		assigned: make(map[discover.NodeID]struct{}),
+// delete deletes the node's assignment a from the store and the indexes,
+// logging any error (the caller must hold c.mtx)
+func (c *connManager) delete(id discover.NodeID, a *assignment) {
+	if err := c.store.Delete(id); err != nil {
+		log.Error("error deleting node assignment", "node_id", id, "err", err)
+	}
+	if c.tokens[a.Session] == id {
+		delete(c.tokens, a.Session)
+	}
+	delete(c.reserved, id)
+}
+
+// Stop stops handling nodes going down and closes the assignment store
+func (c *connManager) Stop() {
+	close(c.quit)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.store.Close(); err != nil {
+		log.Error("error closing assignment store", "err", err)
 	}
 }
 
@@ -36,14 +240,16 @@ func (c *connManager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path == "/list" {
 		list := []connList{}
 		for _, n := range c.net.GetNodes() {
-			rpcclient, _ := n.Client()
 			var pubkey string
-			rpcclient.Call(&pubkey, "pss_getPublicKey")
-			listitem := connList{
-				Key: pubkey,
+			if rpcclient, err := n.Client(); err == nil {
+				rpcclient.Call(&pubkey, "pss_getPublicKey")
 			}
-			if _, ok := c.assigned[n.ID()]; ok {
-				listitem.Assigned = true
+			listitem := connList{
+				ID:       n.ID(),
+				Name:     n.Config.Name,
+				Key:      pubkey,
+				Assigned: c.Assigned(n.ID()),
+				Bot:      c.Bot(n.ID()),
 			}
 			list = append(list, listitem)
 		}
@@ -59,7 +265,18 @@ func (c *connManager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 
 	}
-	node, ok := c.getNode(req)
+	if c.Draining() {
+		http.Error(w, "Service Unavailable: shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// only assign nodes to WebSocket clients, so that plain requests (e.g.
+	// from browsers or crawlers) do not hold a node until their session
+	// expires
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "Bad Request: expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	node, token, ok := c.getNode(req)
 	if !ok {
 		log.Warn("no available node for request", "remote_addr", req.RemoteAddr)
 		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
@@ -68,28 +285,626 @@ func (c *connManager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	log.Info("proxying client to node", "remote_addr", req.RemoteAddr, "node_id", node.ID())
 	websocket.Server{
-		Handler: func(conn *websocket.Conn) { node.ServeRPC(conn) },
+		Handler: func(conn *websocket.Conn) { c.serveClient(conn, node, token) },
 	}.ServeHTTP(w, req)
 }
 
-func (c *connManager) getNode(req *http.Request) (*simulations.Node, bool) {
+// getNode returns the node to proxy the client to along with its session
+// token, which is the node the client was previously assigned if it
+// reconnects with the token in the session query parameter and the node is
+// up and not in use by another connection
+func (c *connManager) getNode(req *http.Request) (*simulations.Node, string, bool) {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
 		log.Error("error parsing RemoteAddr", "remote_addr", req.RemoteAddr, "err", err)
-		return nil, false
+		return nil, "", false
+	}
+	if token := req.URL.Query().Get("session"); token != "" {
+		if node := c.resumeSession(token, clientIP); node != nil {
+			log.Info("resuming client session", "remote_addr", req.RemoteAddr, "node_id", node.ID())
+			return node, token, true
+		}
+	}
+	a := &assignment{
+		Client:  clientIP,
+		Session: newSessionToken(),
+		Expires: time.Now().Add(c.sessionExpiry),
+	}
+	node := c.assignNode(a)
+	if node == nil {
+		return nil, "", false
+	}
+	return node, a.Session, true
+}
+
+// resumeSession returns the node assigned to the session with the given
+// token, returning nil if there is none, it has expired or the node is down
+// or in use (the caller must hold c.mtx)
+func (c *connManager) resumeSession(token, clientIP string) *simulations.Node {
+	id, ok := c.tokens[token]
+	if !ok {
+		return nil
+	}
+	node := c.net.GetNode(id)
+	if _, ok := c.sessions[id]; ok || node == nil || !node.Up {
+		return nil
+	}
+	a, err := c.store.Get(id)
+	if err != nil {
+		log.Error("error loading node assignment", "node_id", id, "err", err)
+		return nil
+	}
+	if a == nil || a.Session != token {
+		return nil
+	}
+	now := time.Now()
+	if a.expired(now) {
+		c.delete(id, a)
+		return nil
+	}
+	a.Client = clientIP
+	a.Expires = now.Add(c.sessionExpiry)
+	if err := c.put(id, a); err != nil {
+		log.Error("error storing node assignment", "node_id", id, "err", err)
+		return nil
+	}
+	return node
+}
+
+// assignNode assigns a free running node, returning nil if there are none
+// (the caller must hold c.mtx)
+func (c *connManager) assignNode(a *assignment) *simulations.Node {
+	for _, node := range c.net.GetNodes() {
+		if !node.Up {
+			continue
+		}
+		existing, err := c.store.Get(node.ID())
+		if err != nil {
+			log.Error("error loading node assignment", "node_id", node.ID(), "err", err)
+			continue
+		}
+		if existing != nil {
+			continue
+		}
+		if err := c.put(node.ID(), a); err != nil {
+			log.Error("error storing node assignment", "node_id", node.ID(), "err", err)
+			return nil
+		}
+		return node
+	}
+	return nil
+}
+
+// Assigned returns whether the node with the given ID is assigned to a
+// client
+func (c *connManager) Assigned(id discover.NodeID) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	a, err := c.store.Get(id)
+	if err != nil {
+		log.Error("error loading node assignment", "node_id", id, "err", err)
+	}
+	return a != nil
+}
+
+// Bot returns the kind of the bot running on the node with the given ID, or
+// an empty string if there is none
+func (c *connManager) Bot(id discover.NodeID) string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.bots[id]
+}
+
+// Reserve assigns a free running node to a bot of the given kind so that it
+// is not assigned to clients, returning nil if there are none
+//
+// A running node reserved for a bot of the same kind before the demo
+// restarted is reserved again in preference to a free node.
+func (c *connManager) Reserve(kind string) *simulations.Node {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	node := c.reservedNode(kind)
+	if node == nil {
+		node = c.assignNode(&assignment{Bot: kind})
+	}
+	if node != nil {
+		c.bots[node.ID()] = kind
 	}
-	//	if node, ok := c.clients[clientIP]; ok {
-	//		return node, true
-	//	}
-	nodes := c.net.GetNodes()
-	for _, node := range nodes {
-		if _, ok := c.assigned[node.ID()]; !ok {
-			c.assigned[node.ID()] = struct{}{}
-			c.clients[clientIP] = node
-			return node, true
+	return node
+}
+
+// reservedNode returns a running node which is reserved for a bot of the
+// given kind that is not running, returning nil if there are none (the
+// caller must hold c.mtx)
+func (c *connManager) reservedNode(kind string) *simulations.Node {
+	for id, reserved := range c.reserved {
+		if reserved != kind {
+			continue
 		}
+		if _, ok := c.bots[id]; ok {
+			continue
+		}
+		if node := c.net.GetNode(id); node != nil && node.Up {
+			return node
+		}
+	}
+	return nil
+}
+
+// Release frees a node reserved for a bot
+func (c *connManager) Release(id discover.NodeID) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if kind, ok := c.bots[id]; ok {
+		delete(c.bots, id)
+		c.delete(id, &assignment{Bot: kind})
+	}
+}
+
+// serveClient proxies RPC requests from the client to its assigned node
+// until the client disconnects, after which the node stays assigned to the
+// client's session until it expires
+func (c *connManager) serveClient(conn *websocket.Conn, node *simulations.Node, token string) {
+	session := &clientSession{conn: conn, token: token}
+	// get the public key before locking as the node may be slow to respond
+	pubkey := nodePubKey(node)
+	c.mtx.Lock()
+	session.attach(node, pubkey)
+	c.sessions[node.ID()] = session
+	c.mtx.Unlock()
+
+	defer func() {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if id := session.NodeID(); c.sessions[id] == session {
+			delete(c.sessions, id)
+			c.disconnected(id)
+		}
+		session.detach()
+	}()
+
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			return
+		}
+		if c.handleLocal(session, msg) {
+			continue
+		}
+		// requests sent while the client is being reattached to another
+		// node are dropped
+		session.writeNode(msg)
+	}
+}
+
+// disconnected sets the expiry of the session of the client which was
+// connected to the node (the caller must hold c.mtx)
+func (c *connManager) disconnected(id discover.NodeID) {
+	a, err := c.store.Get(id)
+	if err != nil {
+		log.Error("error loading node assignment", "node_id", id, "err", err)
+		return
+	}
+	if a == nil {
+		return
+	}
+	a.Expires = time.Now().Add(c.sessionExpiry)
+	if err := c.put(id, a); err != nil {
+		log.Error("error storing node assignment", "node_id", id, "err", err)
+	}
+}
+
+// rpcHandler handles a JSON-RPC method which is served by the conn manager
+// rather than proxied to the client's node
+type rpcHandler func(session *clientSession, params json.RawMessage) (interface{}, error)
+
+// Handle registers a handler for the JSON-RPC method
+func (c *connManager) Handle(method string, handler rpcHandler) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.handlers[method] = handler
+}
+
+// rpcRequest is a JSON-RPC request from a client
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// rpcError is the error of a JSON-RPC response
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// handleLocal handles the message if it is a request for a method with a
+// registered handler, returning whether it was handled
+func (c *connManager) handleLocal(session *clientSession, msg []byte) bool {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return false
+	}
+	var req rpcRequest
+	if err := json.Unmarshal(trimmed, &req); err != nil {
+		return false
+	}
+	c.mtx.Lock()
+	handler, ok := c.handlers[req.Method]
+	c.mtx.Unlock()
+	if !ok {
+		return false
+	}
+	go func() {
+		res := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if result, err := handler(session, req.Params); err != nil {
+			code := -32000
+			if _, ok := err.(*invalidParamsError); ok {
+				code = -32602
+			}
+			res["error"] = &rpcError{Code: code, Message: err.Error()}
+		} else {
+			res["result"] = result
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			log.Error("error encoding JSON-RPC response", "method", req.Method, "err", err)
+			return
+		}
+		session.Write(data)
+	}()
+	return true
+}
+
+// invalidParamsError is returned by handlers when the params of a request
+// are invalid
+type invalidParamsError struct {
+	msg string
+}
+
+func (e *invalidParamsError) Error() string {
+	return e.msg
+}
+
+// decodeParams decodes positional JSON-RPC params into args, with missing
+// trailing params leaving their args unset
+func decodeParams(params json.RawMessage, args ...interface{}) error {
+	var values []json.RawMessage
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &values); err != nil {
+			return &invalidParamsError{"params must be an array"}
+		}
+	}
+	if len(values) > len(args) {
+		return &invalidParamsError{fmt.Sprintf("too many params, want at most %d", len(args))}
+	}
+	for i, value := range values {
+		if err := json.Unmarshal(value, args[i]); err != nil {
+			return &invalidParamsError{fmt.Sprintf("invalid param %d: %s", i+1, err)}
+		}
+	}
+	return nil
+}
+
+// nodeDown frees the node with the given ID, closing the connection of the
+// client assigned to it or reattaching the client to another node
+//
+// The public key of the new node is fetched after releasing c.mtx so that a
+// slow node does not block other clients.
+func (c *connManager) nodeDown(id discover.NodeID) {
+	c.mtx.Lock()
+	a, err := c.store.Get(id)
+	if err != nil {
+		log.Error("error loading node assignment", "node_id", id, "err", err)
+	}
+	if a == nil {
+		c.mtx.Unlock()
+		return
+	}
+	c.delete(id, a)
+	delete(c.bots, id)
+	session, ok := c.sessions[id]
+	if !ok {
+		c.mtx.Unlock()
+		return
+	}
+	delete(c.sessions, id)
+	old := session.Info()
+	reason := fmt.Sprintf("pss node %s went down", old.Name)
+
+	if c.failure == nodeFailureMigrate {
+		if node := c.assignNode(a); node != nil {
+			log.Info("reattaching client to node", "remote_addr", session.conn.Request().RemoteAddr, "old_node_id", id, "node_id", node.ID())
+			session.attach(node, nil)
+			c.sessions[node.ID()] = session
+			c.mtx.Unlock()
+			session.setPubKey(node.ID(), nodePubKey(node))
+			session.notify("demo_nodeChanged", &nodeChanged{
+				Reason: reason,
+				Old:    old,
+				New:    session.Info(),
+			})
+			return
+		}
+		reason += " and there are no available nodes"
+	}
+	c.mtx.Unlock()
+
+	log.Info("closing client connection", "remote_addr", session.conn.Request().RemoteAddr, "node_id", id, "reason", reason)
+	session.close(closeStatusGoingAway, reason)
+}
+
+// Draining returns whether the conn manager is draining client sessions
+// and so not accepting new clients
+func (c *connManager) Draining() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.draining
+}
+
+// Drain stops accepting new clients and sends a demo_shutdown notification
+// to each connected client every second until the countdown ends, then
+// closes their connections
+//
+// Drain returns early if all clients disconnect before the countdown ends.
+func (c *connManager) Drain(countdown time.Duration) {
+	c.mtx.Lock()
+	c.draining = true
+	c.mtx.Unlock()
+
+	const reason = "the pss demo is shutting down"
+	deadline := time.Now().Add(countdown)
+	for {
+		remaining := deadline.Sub(time.Now())
+		sessions := c.activeSessions()
+		if remaining <= 0 || len(sessions) == 0 {
+			break
+		}
+		seconds := int((remaining + time.Second - 1) / time.Second)
+		for _, session := range sessions {
+			session.notify("demo_shutdown", &shutdownNotice{
+				Reason:  reason,
+				Seconds: seconds,
+			})
+		}
+		// sleep until the number of seconds remaining changes
+		time.Sleep(remaining - time.Duration(seconds-1)*time.Second)
+	}
+
+	for _, session := range c.activeSessions() {
+		log.Info("closing client connection", "remote_addr", session.conn.Request().RemoteAddr, "node_id", session.NodeID(), "reason", reason)
+		session.close(closeStatusGoingAway, reason)
+	}
+}
+
+func (c *connManager) activeSessions() []*clientSession {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	sessions := make([]*clientSession, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// sessionInfo is the result of demo_session
+type sessionInfo struct {
+	Token string    `json:"token"`
+	Node  *nodeInfo `json:"node"`
+	Nick  string    `json:"nick,omitempty"`
+}
+
+// sessionInfo handles demo_session by returning the client's session token,
+// node and nickname
+func (c *connManager) sessionInfo(session *clientSession, params json.RawMessage) (interface{}, error) {
+	if err := decodeParams(params); err != nil {
+		return nil, err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	info := session.Info()
+	a, err := c.store.Get(info.ID)
+	if err != nil {
+		return nil, err
+	}
+	result := &sessionInfo{Token: session.token, Node: info}
+	if a != nil {
+		result.Nick = a.Nick
+	}
+	return result, nil
+}
+
+// setNick handles demo_setNick by storing the client's nickname so that it
+// is returned by demo_session when the client reconnects
+func (c *connManager) setNick(session *clientSession, params json.RawMessage) (interface{}, error) {
+	var nick string
+	if err := decodeParams(params, &nick); err != nil {
+		return nil, err
+	}
+	if err := validateNick(nick); err != nil {
+		return nil, &invalidParamsError{err.Error()}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	id := session.NodeID()
+	a, err := c.store.Get(id)
+	if err != nil {
+		return nil, err
+	} else if a == nil {
+		return nil, fmt.Errorf("node %s is no longer assigned", id.TerminalString())
+	}
+	a.Nick = nick
+	if err := c.put(id, a); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// shutdownNotice is the params of the demo_shutdown notification sent to
+// clients while draining, with Seconds being the time left before their
+// connection is closed
+type shutdownNotice struct {
+	Reason  string `json:"reason"`
+	Seconds int    `json:"seconds"`
+}
+
+// nodeInfo identifies the node a client is attached to
+type nodeInfo struct {
+	ID     discover.NodeID `json:"id"`
+	Name   string          `json:"name"`
+	PubKey hexutil.Bytes   `json:"pubkey"`
+}
+
+// nodeChanged is the params of the demo_nodeChanged notification sent to a
+// client when it is reattached to another node
+type nodeChanged struct {
+	Reason string    `json:"reason"`
+	Old    *nodeInfo `json:"old"`
+	New    *nodeInfo `json:"new"`
+}
+
+// clientSession is a client WebSocket connection which is proxied to a node
+// through a pipe, so that it can be reattached to another node
+type clientSession struct {
+	conn *websocket.Conn
+
+	// token is the session token the client can reconnect with to be
+	// reattached to the same node
+	token string
+
+	// writeMtx serializes writes to conn
+	writeMtx sync.Mutex
+
+	mtx  sync.Mutex
+	info *nodeInfo
+	pipe net.Conn
+}
+
+// nodePubKey returns the pss public key of the node, or nil if it cannot be
+// retrieved
+func nodePubKey(node *simulations.Node) []byte {
+	client, err := node.Client()
+	if err != nil {
+		return nil
+	}
+	var pubkey []byte
+	client.Call(&pubkey, "pss_getPublicKey")
+	return pubkey
+}
+
+// attach connects the session to the node with the given pss public key,
+// detaching it from any previous node
+func (s *clientSession) attach(node *simulations.Node, pubkey []byte) {
+	info := &nodeInfo{ID: node.ID(), Name: node.Config.Name, PubKey: pubkey}
+
+	pipe, nodeConn := net.Pipe()
+	go node.ServeRPC(nodeConn)
+	go func() {
+		// write each message from the node as a single frame so that it
+		// is not interleaved with messages written by the conn manager
+		dec := json.NewDecoder(pipe)
+		for {
+			var msg json.RawMessage
+			if err := dec.Decode(&msg); err != nil {
+				break
+			}
+			if _, err := s.Write(msg); err != nil {
+				break
+			}
+		}
+		pipe.Close()
+	}()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.pipe != nil {
+		s.pipe.Close()
+	}
+	s.info = info
+	s.pipe = pipe
+}
+
+func (s *clientSession) detach() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.pipe != nil {
+		s.pipe.Close()
+	}
+}
+
+// setPubKey sets the public key of the attached node if it is still the
+// node with the given ID
+func (s *clientSession) setPubKey(id discover.NodeID, pubkey []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.info.ID == id {
+		info := *s.info
+		info.PubKey = pubkey
+		s.info = &info
+	}
+}
+
+// Info returns the node the session is attached to
+func (s *clientSession) Info() *nodeInfo {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.info
+}
+
+func (s *clientSession) NodeID() discover.NodeID {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.info.ID
+}
+
+// writeNode writes data from the client to the attached node
+func (s *clientSession) writeNode(data []byte) error {
+	s.mtx.Lock()
+	pipe := s.pipe
+	s.mtx.Unlock()
+	_, err := pipe.Write(data)
+	return err
+}
+
+// Write writes data to the client
+func (s *clientSession) Write(data []byte) (int, error) {
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	return s.conn.Write(data)
+}
+
+// notify sends a JSON-RPC notification to the client
+func (s *clientSession) notify(method string, params interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.Write(data)
+	return err
+}
+
+// close detaches the session and closes the client connection with the
+// given status and reason
+//
+// The websocket package only supports closing connections with a status, so
+// the close frame is written directly and the one written by conn.Close is
+// ignored by the client.
+func (s *clientSession) close(status int, reason string) {
+	s.detach()
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	if w, err := s.conn.NewFrameWriter(websocket.CloseFrame); err == nil {
+		msg := make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(msg, uint16(status))
+		copy(msg[2:], reason)
+		w.Write(msg)
+		w.Close()
 	}
-	return nil, false
+	s.conn.Close()
 }
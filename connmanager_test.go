@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+	"golang.org/x/net/websocket"
+)
+
+// testNetwork is an in-memory pss network with its node logs in a
+// temporary directory, along with its link manager if started
+type testNetwork struct {
+	*simulations.Network
+	logDir string
+	links  *linkManager
+}
+
+// newTestNetwork returns a network of nodeCount pss nodes connected in a
+// ring, optionally running the swarm service
+func newTestNetwork(t *testing.T, nodeCount int, swarm bool) *testNetwork {
+	logDir, err := ioutil.TempDir("", "pss-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := NewPssSimulation(adapters.NewSimAdapter(services), nodeCount, logDir, &keyStore{}, swarm)
+	if err != nil {
+		os.RemoveAll(logDir)
+		t.Fatalf("error creating pss simulation: %s", err)
+	}
+	return &testNetwork{Network: net, logDir: logDir}
+}
+
+// startLinks starts a link manager for the network which is stopped by
+// Close
+func (n *testNetwork) startLinks(config *linkConfig) *linkManager {
+	n.links = newLinkManager(n.Network, config)
+	go n.links.Run()
+	return n.links
+}
+
+func (n *testNetwork) Close() {
+	if n.links != nil {
+		n.links.Stop()
+	}
+	n.Shutdown()
+	os.RemoveAll(n.logDir)
+}
+
+// connUp returns whether the nodes with the given names are connected
+func connUp(net *simulations.Network, one, other string) bool {
+	conn := net.GetConn(net.GetNodeByName(one).ID(), net.GetNodeByName(other).ID())
+	return conn != nil && conn.Up
+}
+
+// waitConnsUp waits for each pair of named nodes to be connected
+func waitConnsUp(t *testing.T, net *simulations.Network, conns ...[2]string) {
+	timeout := time.After(10 * time.Second)
+	for _, conn := range conns {
+		for !connUp(net, conn[0], conn[1]) {
+			select {
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s - %s to connect", conn[0], conn[1])
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// testRequest sends a request to the test server and checks the response
+// status, decoding the JSON body of a 200 response into res if it is not nil
+func testRequest(t *testing.T, srv *httptest.Server, method, path, body string, status int, res interface{}) {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("expected status %d for %s %s, got %s", status, method, path, resp.Status)
+	}
+	if status != http.StatusOK || res == nil {
+		return
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		t.Fatalf("error decoding %s %s: %s", method, path, err)
+	}
+}
+
+// testConnManager is a conn manager for an in-memory pss network served by
+// an httptest.Server
+type testConnManager struct {
+	*httptest.Server
+	net     *simulations.Network
+	manager *connManager
+	logDir  string
+}
+
+func newTestConnManager(t *testing.T, nodeCount int, failure nodeFailureMode) *testConnManager {
+	logDir, err := ioutil.TempDir("", "pss-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, err := NewPssSimulation(adapters.NewSimAdapter(services), nodeCount, logDir, &keyStore{}, false)
+	if err != nil {
+		os.RemoveAll(logDir)
+		t.Fatalf("error creating pss simulation: %s", err)
+	}
+	manager, err := newConnManager(net, failure, newMemAssignmentStore())
+	if err != nil {
+		net.Shutdown()
+		os.RemoveAll(logDir)
+		t.Fatal(err)
+	}
+	go manager.Run()
+	return &testConnManager{
+		Server:  httptest.NewServer(manager),
+		net:     net,
+		manager: manager,
+		logDir:  logDir,
+	}
+}
+
+func (c *testConnManager) Close() {
+	c.Server.Close()
+	c.manager.Stop()
+	c.net.Shutdown()
+	os.RemoveAll(c.logDir)
+}
+
+// dial connects an RPC client to a node using the conn manager's WebSocket
+// endpoint
+func (c *testConnManager) dial(t *testing.T) *rpc.Client {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := rpc.DialWebsocket(ctx, "ws"+strings.TrimPrefix(c.URL, "http"), "http://localhost")
+	if err != nil {
+		t.Fatalf("error dialling conn manager: %s", err)
+	}
+	return client
+}
+
+func (c *testConnManager) list(t *testing.T) []connList {
+	res, err := http.Get(c.URL + "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected /list status: %s", res.Status)
+	}
+	var list []connList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("error decoding /list: %s", err)
+	}
+	return list
+}
+
+// testClient is a WebSocket client of the conn manager along with the pss
+// identity of the node it was assigned
+type testClient struct {
+	*rpc.Client
+	pubkey []byte
+	addr   pss.PssAddress
+}
+
+func newTestClient(t *testing.T, c *testConnManager) *testClient {
+	client := &testClient{Client: c.dial(t)}
+	if err := client.Call(&client.pubkey, "pss_getPublicKey"); err != nil {
+		t.Fatalf("error getting pss public key: %s", err)
+	}
+	if err := client.Call(&client.addr, "pss_baseAddr"); err != nil {
+		t.Fatalf("error getting pss base address: %s", err)
+	}
+	return client
+}
+
+// TestConnManager tests connecting WebSocket clients to the conn manager,
+// sending pss messages between them and listing the assigned nodes
+func TestConnManager(t *testing.T) {
+	c := newTestConnManager(t, 2, nodeFailureClose)
+	defer c.Close()
+
+	// check the nodes are listed and unassigned
+	keys := make(map[string]struct{})
+	for _, item := range c.list(t) {
+		if item.Assigned {
+			t.Fatalf("expected %s to be unassigned", item.Key)
+		}
+		keys[item.Key] = struct{}{}
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 distinct nodes in /list, got %d", len(keys))
+	}
+
+	// check plain requests are rejected without being assigned a node
+	for _, path := range []string{"/", "/favicon.ico"} {
+		res, err := http.Get(c.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %d for GET %s, got %s", http.StatusBadRequest, path, res.Status)
+		}
+	}
+	for _, item := range c.list(t) {
+		if item.Assigned {
+			t.Fatalf("expected %s to be unassigned after plain requests", item.Key)
+		}
+	}
+
+	// connect two clients and check they are assigned distinct nodes
+	alice := newTestClient(t, c)
+	defer alice.Close()
+	bob := newTestClient(t, c)
+	defer bob.Close()
+	if bytes.Equal(alice.pubkey, bob.pubkey) {
+		t.Fatalf("expected clients to be assigned distinct nodes, both got %x", alice.pubkey)
+	}
+	for _, client := range []*testClient{alice, bob} {
+		// /list contains the JSON encoded public keys, which are base64
+		if _, ok := keys[base64.StdEncoding.EncodeToString(client.pubkey)]; !ok {
+			t.Fatalf("client assigned node %x which is not in /list", client.pubkey)
+		}
+	}
+
+	// check there is no capacity for a third client
+	req, err := http.NewRequest("GET", c.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d with no available nodes, got %s", http.StatusServiceUnavailable, res.Status)
+	}
+
+	// check the nodes are now listed as assigned
+	for _, item := range c.list(t) {
+		if !item.Assigned {
+			t.Fatalf("expected %s to be assigned", item.Key)
+		}
+	}
+
+	// send a message from alice to bob
+	topic := pss.BytesToTopic([]byte("pss-demo-test"))
+	msgC := make(chan pss.APIMsg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sub, err := bob.Subscribe(ctx, "pss", msgC, "receive", topic)
+	if err != nil {
+		t.Fatalf("error subscribing to pss messages: %s", err)
+	}
+	defer sub.Unsubscribe()
+	if err := alice.Call(nil, "pss_setPeerPublicKey", bob.pubkey, topic, bob.addr); err != nil {
+		t.Fatalf("error setting peer public key: %s", err)
+	}
+	msg := []byte("hello bob")
+
+	// resend the message periodically as it is dropped if sent before the
+	// nodes have completed their bzz handshake
+	send := func() {
+		if err := alice.Call(nil, "pss_sendAsym", common.ToHex(bob.pubkey), topic, msg); err != nil {
+			t.Fatalf("error sending pss message: %s", err)
+		}
+	}
+	send()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case received := <-msgC:
+			if !bytes.Equal(received.Msg, msg) {
+				t.Fatalf("expected message %q, got %q", msg, received.Msg)
+			}
+			if !received.Asymmetric {
+				t.Fatal("expected message to be asymmetric")
+			}
+			return
+		case <-ticker.C:
+			send()
+		case err := <-sub.Err():
+			t.Fatalf("pss subscription error: %s", err)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for pss message")
+		}
+	}
+}
+
+// TestConnManagerNodeFailure tests that clients whose node goes down are
+// either disconnected or reattached to another node
+func TestConnManagerNodeFailure(t *testing.T) {
+	t.Run("close", func(t *testing.T) {
+		c := newTestConnManager(t, 3, nodeFailureClose)
+		defer c.Close()
+		conn := c.dialRaw(t)
+		defer conn.Close()
+		id := c.assignedNode(t)
+
+		if err := c.net.Stop(id); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg json.RawMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != io.EOF {
+			t.Fatalf("expected connection to be closed, got msg=%s err=%v", msg, err)
+		}
+		if c.manager.Assigned(id) {
+			t.Fatal("expected node to be unassigned")
+		}
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		c := newTestConnManager(t, 3, nodeFailureMigrate)
+		defer c.Close()
+		conn := c.dialRaw(t)
+		defer conn.Close()
+		id := c.assignedNode(t)
+
+		if err := c.net.Stop(id); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var notification struct {
+			Method string      `json:"method"`
+			Params nodeChanged `json:"params"`
+		}
+		if err := websocket.JSON.Receive(conn, &notification); err != nil {
+			t.Fatalf("error receiving notification: %s", err)
+		}
+		if notification.Method != "demo_nodeChanged" {
+			t.Fatalf("expected demo_nodeChanged notification, got %s", notification.Method)
+		}
+		params := notification.Params
+		if params.Old == nil || params.Old.ID != id {
+			t.Fatalf("expected old node %s, got %v", id.TerminalString(), params.Old)
+		}
+		if params.New == nil || params.New.ID == id || len(params.New.PubKey) == 0 {
+			t.Fatalf("expected a new node with a public key, got %v", params.New)
+		}
+		if c.manager.Assigned(id) || !c.manager.Assigned(params.New.ID) {
+			t.Fatal("expected the client to be assigned the new node")
+		}
+
+		// check requests are now served by the new node
+		if err := websocket.JSON.Send(conn, map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      1,
+			"method":  "pss_getPublicKey",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var res struct {
+			Result []byte `json:"result"`
+		}
+		if err := websocket.JSON.Receive(conn, &res); err != nil {
+			t.Fatalf("error receiving response: %s", err)
+		}
+		if !bytes.Equal(res.Result, params.New.PubKey) {
+			t.Fatalf("expected public key %x, got %x", []byte(params.New.PubKey), res.Result)
+		}
+	})
+}
+
+// dialRaw connects a WebSocket client to a node using the conn manager
+func (c *testConnManager) dialRaw(t *testing.T) *websocket.Conn {
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(c.URL, "http"), "", "http://localhost")
+	if err != nil {
+		t.Fatalf("error dialling conn manager: %s", err)
+	}
+	return conn
+}
+
+// assignedNode returns the ID of the single node assigned to a client
+func (c *testConnManager) assignedNode(t *testing.T) discover.NodeID {
+	var ids []discover.NodeID
+	for _, node := range c.net.GetNodes() {
+		if c.manager.Assigned(node.ID()) {
+			ids = append(ids, node.ID())
+		}
+	}
+	if len(ids) != 1 {
+		t.Fatalf("expected 1 assigned node, got %d", len(ids))
+	}
+	return ids[0]
+}
+
+// TestConnManagerDrain tests that draining the conn manager counts down
+// connected clients before disconnecting them and rejects new clients
+func TestConnManagerDrain(t *testing.T) {
+	c := newTestConnManager(t, 2, nodeFailureClose)
+	defer c.Close()
+	conn := c.dialRaw(t)
+	defer conn.Close()
+
+	// wait for the session to be registered so that it is drained
+	for start := time.Now(); len(c.manager.activeSessions()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for client session")
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.manager.Drain(2 * time.Second)
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, seconds := range []int{2, 1} {
+		var notification struct {
+			Method string         `json:"method"`
+			Params shutdownNotice `json:"params"`
+		}
+		if err := websocket.JSON.Receive(conn, &notification); err != nil {
+			t.Fatalf("error receiving notification: %s", err)
+		}
+		if notification.Method != "demo_shutdown" {
+			t.Fatalf("expected demo_shutdown notification, got %s", notification.Method)
+		}
+		if notification.Params.Seconds != seconds {
+			t.Fatalf("expected %d seconds until shutdown, got %d", seconds, notification.Params.Seconds)
+		}
+	}
+
+	// check new clients are rejected while draining
+	if _, err := websocket.Dial("ws"+strings.TrimPrefix(c.URL, "http"), "", "http://localhost"); err == nil {
+		t.Fatal("expected new client to be rejected while draining")
+	}
+
+	var msg json.RawMessage
+	if err := websocket.JSON.Receive(conn, &msg); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got msg=%s err=%v", msg, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for drain to finish")
+	}
+}
+
+// TestConnManagerSessions tests that clients can resume their session on
+// the same node with its nickname after the conn manager restarts
+func TestConnManagerSessions(t *testing.T) {
+	c := newTestConnManager(t, 3, nodeFailureClose)
+	defer c.Close()
+	path := filepath.Join(c.logDir, "assignments")
+	restart := func() {
+		c.manager.Stop()
+		store, err := newAssignmentStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.manager, err = newConnManager(c.net, nodeFailureClose, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.manager.Run()
+		c.Config.Handler = c.manager
+	}
+	restart()
+
+	client := c.dial(t)
+	var session sessionInfo
+	if err := client.Call(&session, "demo_session"); err != nil {
+		t.Fatal(err)
+	}
+	if session.Token == "" || session.Node == nil {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	if err := client.Call(nil, "demo_setNick", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(nil, "demo_setNick", ""); err == nil {
+		t.Fatal("expected an error setting an empty nickname")
+	}
+	client.Close()
+
+	restart()
+	if !c.manager.Assigned(session.Node.ID) {
+		t.Fatal("expected node to still be assigned after restart")
+	}
+	dial := func() *rpc.Client {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client, err := rpc.DialWebsocket(ctx, "ws"+strings.TrimPrefix(c.URL, "http")+"/?session="+session.Token, "http://localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	resumed := dial()
+	defer resumed.Close()
+	var info sessionInfo
+	if err := resumed.Call(&info, "demo_session"); err != nil {
+		t.Fatal(err)
+	}
+	if info.Token != session.Token || info.Node.ID != session.Node.ID || info.Nick != "alice" {
+		t.Fatalf("expected to resume session %+v, got %+v", session, info)
+	}
+
+	// check a second connection with the same token gets a new session
+	// as the node is in use
+	other := dial()
+	defer other.Close()
+	if err := other.Call(&info, "demo_session"); err != nil {
+		t.Fatal(err)
+	}
+	if info.Token == session.Token || info.Node.ID == session.Node.ID {
+		t.Fatalf("expected a new session, got %+v", info)
+	}
+}
+
+// TestConnManagerSessionExpiry tests that the node of a disconnected client
+// is freed once its session expires, both while running and when the conn
+// manager restarts with a stale session
+func TestConnManagerSessionExpiry(t *testing.T) {
+	c := newTestConnManager(t, 3, nodeFailureClose)
+	defer c.Close()
+	path := filepath.Join(c.logDir, "assignments")
+	restart := func() {
+		c.manager.Stop()
+		store, err := newAssignmentStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.manager, err = newConnManager(c.net, nodeFailureClose, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.manager.sessionExpiry = 100 * time.Millisecond
+		go c.manager.Run()
+		c.Config.Handler = c.manager
+	}
+	restart()
+	connect := func() *sessionInfo {
+		client := c.dial(t)
+		defer client.Close()
+		var session sessionInfo
+		if err := client.Call(&session, "demo_session"); err != nil {
+			t.Fatal(err)
+		}
+		return &session
+	}
+	waitDisconnected := func(id discover.NodeID) {
+		for start := time.Now(); len(c.manager.activeSessions()) > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("timed out waiting for the client to disconnect")
+			}
+		}
+		if !c.manager.Assigned(id) {
+			t.Fatal("expected node to stay assigned after the client disconnects")
+		}
+	}
+
+	// check an expired session is freed while running
+	session := connect()
+	waitDisconnected(session.Node.ID)
+	c.manager.expireSessions(time.Now())
+	if !c.manager.Assigned(session.Node.ID) {
+		t.Fatal("expected node to stay assigned before the session expires")
+	}
+	c.manager.expireSessions(time.Now().Add(time.Second))
+	if c.manager.Assigned(session.Node.ID) {
+		t.Fatal("expected node to be freed after the session expires")
+	}
+
+	// check a stale session is dropped on restart and cannot be resumed
+	session = connect()
+	waitDisconnected(session.Node.ID)
+	time.Sleep(200 * time.Millisecond)
+	restart()
+	if c.manager.Assigned(session.Node.ID) {
+		t.Fatal("expected node of the stale session to be freed after restart")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := rpc.DialWebsocket(ctx, "ws"+strings.TrimPrefix(c.URL, "http")+"/?session="+session.Token, "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var info sessionInfo
+	if err := client.Call(&info, "demo_session"); err != nil {
+		t.Fatal(err)
+	}
+	if info.Token == session.Token {
+		t.Fatalf("expected a new session, got %+v", info)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+)
+
+// dashboardAssets are the static files of the web dashboard, which are
+// embedded in the binary
+//
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+// dashboard serves the web dashboard at /dashboard/, which renders the node
+// graph from the simulation API's event stream, colours nodes by whether they
+// are assigned to clients, highlights pss message hops and includes a minimal
+// chat client which connects through the conn manager
+type dashboard struct {
+	assets  http.Handler
+	netPort int
+}
+
+// newDashboard returns a dashboard which reads events from the simulation
+// API on netPort of the host serving the dashboard
+func newDashboard(netPort int) *dashboard {
+	return &dashboard{
+		assets:  http.FileServer(http.FS(dashboardAssets)),
+		netPort: netPort,
+	}
+}
+
+// dashboardConfig is the dashboard config served at /dashboard/config.json
+type dashboardConfig struct {
+	NetPort int `json:"netPort"`
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/dashboard/config.json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&dashboardConfig{NetPort: d.netPort})
+		return
+	}
+	d.assets.ServeHTTP(w, req)
+}
@@ -0,0 +1,399 @@
+// Dashboard for the pss demo.
+//
+// Renders the simulation network from the simulation API's event stream,
+// colours nodes using the conn manager's /list endpoint, highlights pss
+// message hops and runs a minimal chat client over the conn manager's
+// WebSocket endpoint.
+(function() {
+  'use strict';
+
+  const SVG_NS = 'http://www.w3.org/2000/svg';
+  const CHAT_TOPIC = 'pss-demo-chat';
+  const LIST_INTERVAL = 2000;
+  const HOP_DURATION = 800;
+
+  const svg = document.getElementById('graph');
+  const connLayer = el('g', {});
+  const hopLayer = el('g', {});
+  const nodeLayer = el('g', {});
+  svg.append(connLayer, hopLayer, nodeLayer);
+
+  const nodes = new Map(); // node ID => node
+  const conns = new Map(); // "ID-ID" => conn
+  let assigned = new Map(); // node ID => /list item
+  let selfID = null;
+
+  function el(name, attrs) {
+    const e = document.createElementNS(SVG_NS, name);
+    for (const k in attrs) {
+      e.setAttribute(k, attrs[k]);
+    }
+    return e;
+  }
+
+  function setStatus(text) {
+    document.getElementById('status').textContent = text;
+  }
+
+  // --- network graph ---
+
+  function addNode(id, name) {
+    let node = nodes.get(id);
+    if (node) {
+      return node;
+    }
+    const angle = Math.random() * 2 * Math.PI;
+    node = {id: id, name: name || id.slice(0, 8), up: false, x: 300 * Math.cos(angle), y: 300 * Math.sin(angle), vx: 0, vy: 0};
+    node.el = el('g', {'class': 'node'});
+    node.el.append(el('circle', {r: 12}));
+    const label = el('text', {dy: 26});
+    label.textContent = node.name;
+    node.el.append(label);
+    nodeLayer.append(node.el);
+    nodes.set(id, node);
+    return node;
+  }
+
+  function connKey(one, other) {
+    return one < other ? one + '-' + other : other + '-' + one;
+  }
+
+  function updateNode(n) {
+    const node = addNode(n.config.id, n.config.name);
+    node.up = n.up;
+    colourNode(node);
+  }
+
+  function updateConn(c) {
+    const key = connKey(c.one, c.other);
+    let conn = conns.get(key);
+    if (!c.up) {
+      if (conn) {
+        conn.el.remove();
+        conns.delete(key);
+      }
+      return;
+    }
+    if (conn) {
+      return;
+    }
+    conn = {one: addNode(c.one), other: addNode(c.other), el: el('line', {'class': 'conn'})};
+    connLayer.append(conn.el);
+    conns.set(key, conn);
+  }
+
+  function colourNode(node) {
+    let state = 'free';
+    if (!node.up) {
+      state = 'down';
+    } else if (node.id === selfID) {
+      state = 'self';
+    } else if (assigned.has(node.id)) {
+      state = 'assigned';
+    }
+    node.el.setAttribute('class', 'node ' + state + (node.hop ? ' hop' : ''));
+  }
+
+  // showHop highlights a pss message being sent from one node to another
+  function showHop(msg) {
+    const one = nodes.get(msg.one);
+    const other = nodes.get(msg.other);
+    if (!one || !other) {
+      return;
+    }
+    const line = el('line', {'class': 'hop-line', x1: one.x, y1: one.y, x2: other.x, y2: other.y});
+    hopLayer.append(line);
+    requestAnimationFrame(function() {
+      line.style.opacity = 0;
+    });
+    setTimeout(function() {
+      line.remove();
+    }, HOP_DURATION);
+    [one, other].forEach(function(node) {
+      node.hop = (node.hop || 0) + 1;
+      colourNode(node);
+      setTimeout(function() {
+        node.hop--;
+        colourNode(node);
+      }, HOP_DURATION);
+    });
+  }
+
+  // layout moves the nodes using a simple force simulation, with nodes
+  // repelling each other and connections pulling nodes together
+  function layout() {
+    const list = Array.from(nodes.values());
+    for (let i = 0; i < list.length; i++) {
+      const a = list[i];
+      for (let j = i + 1; j < list.length; j++) {
+        const b = list[j];
+        let dx = a.x - b.x;
+        let dy = a.y - b.y;
+        const d2 = Math.max(dx * dx + dy * dy, 100);
+        const f = 2000 / d2;
+        dx *= f / Math.sqrt(d2);
+        dy *= f / Math.sqrt(d2);
+        a.vx += dx; a.vy += dy;
+        b.vx -= dx; b.vy -= dy;
+      }
+    }
+    conns.forEach(function(conn) {
+      const dx = conn.other.x - conn.one.x;
+      const dy = conn.other.y - conn.one.y;
+      conn.one.vx += dx * 0.005; conn.one.vy += dy * 0.005;
+      conn.other.vx -= dx * 0.005; conn.other.vy -= dy * 0.005;
+    });
+    list.forEach(function(node) {
+      node.vx -= node.x * 0.002;
+      node.vy -= node.y * 0.002;
+      node.x += node.vx;
+      node.y += node.vy;
+      node.vx *= 0.8;
+      node.vy *= 0.8;
+      node.el.setAttribute('transform', 'translate(' + node.x + ',' + node.y + ')');
+    });
+    conns.forEach(function(conn) {
+      conn.el.setAttribute('x1', conn.one.x);
+      conn.el.setAttribute('y1', conn.one.y);
+      conn.el.setAttribute('x2', conn.other.x);
+      conn.el.setAttribute('y2', conn.other.y);
+    });
+    const rect = svg.getBoundingClientRect();
+    svg.setAttribute('viewBox', [-rect.width / 2, -rect.height / 2, rect.width, rect.height].join(' '));
+    requestAnimationFrame(layout);
+  }
+
+  function streamEvents(netPort) {
+    const url = location.protocol + '//' + location.hostname + ':' + netPort + '/events?current=true&filter=pss:*';
+    const events = new EventSource(url);
+    events.onopen = function() {
+      setStatus('connected to simulation API');
+    };
+    events.onerror = function() {
+      setStatus('simulation API disconnected, retrying...');
+    };
+    events.addEventListener('network', function(e) {
+      const event = JSON.parse(e.data);
+      switch (event.type) {
+      case 'node':
+        updateNode(event.node);
+        break;
+      case 'conn':
+        updateConn(event.conn);
+        break;
+      case 'msg':
+        if (!event.msg.received) {
+          showHop(event.msg);
+        }
+        break;
+      }
+    });
+  }
+
+  function refreshList() {
+    return fetch('/list').then(function(res) {
+      return res.json();
+    }).then(function(list) {
+      assigned = new Map();
+      list.forEach(function(item) {
+        if (item.Assigned) {
+          assigned.set(item.ID, item);
+        }
+      });
+      nodes.forEach(colourNode);
+      updatePeers();
+    });
+  }
+
+  function pollList() {
+    refreshList().catch(function() {}).then(function() {
+      setTimeout(pollList, LIST_INTERVAL);
+    });
+  }
+
+  // --- chat client ---
+
+  let ws = null;
+  let nextID = 1;
+  const pending = new Map();
+  let topic = null;
+  let subscription = null;
+
+  function base64ToHex(b64) {
+    return '0x' + Array.from(atob(b64), function(c) {
+      return ('0' + c.charCodeAt(0).toString(16)).slice(-2);
+    }).join('');
+  }
+
+  function encodeText(text) {
+    return btoa(String.fromCharCode.apply(null, new TextEncoder().encode(text)));
+  }
+
+  function decodeText(b64) {
+    return new TextDecoder().decode(Uint8Array.from(atob(b64), function(c) {
+      return c.charCodeAt(0);
+    }));
+  }
+
+  function call(method, params) {
+    return new Promise(function(resolve, reject) {
+      const id = nextID++;
+      pending.set(id, {resolve: resolve, reject: reject});
+      ws.send(JSON.stringify({jsonrpc: '2.0', id: id, method: method, params: params || []}));
+    });
+  }
+
+  function logChat(text, cls) {
+    const log = document.getElementById('chat-log');
+    const li = document.createElement('li');
+    li.textContent = text;
+    if (cls) {
+      li.className = cls;
+    }
+    log.append(li);
+    log.scrollTop = log.scrollHeight;
+  }
+
+  function nodeName(id) {
+    const node = nodes.get(id);
+    return node ? node.name : id.slice(0, 8);
+  }
+
+  function updatePeers() {
+    const select = document.getElementById('chat-peer');
+    const current = select.value;
+    while (select.options.length > 1) {
+      select.remove(1);
+    }
+    assigned.forEach(function(item, id) {
+      if (id === selfID) {
+        return;
+      }
+      const option = document.createElement('option');
+      option.value = id;
+      option.textContent = (item.Name || nodeName(id)) + (item.Bot ? ' (' + item.Bot + ' bot)' : '');
+      select.append(option);
+    });
+    select.value = current;
+  }
+
+  // setup gets the identity of the assigned node and subscribes to chat
+  // messages, which is repeated if the conn manager moves the client to
+  // another node
+  function setup() {
+    let pubkey;
+    return call('pss_getPublicKey').then(function(key) {
+      pubkey = key;
+      return refreshList();
+    }).then(function() {
+      selfID = null;
+      assigned.forEach(function(item, id) {
+        if (item.Key === pubkey) {
+          selfID = id;
+        }
+      });
+      nodes.forEach(colourNode);
+      updatePeers();
+      document.getElementById('chat-node').textContent = 'node ' + (selfID ? nodeName(selfID) : '') + ' ' + base64ToHex(pubkey).slice(0, 18) + '...';
+      return call('pss_stringToTopic', [CHAT_TOPIC]);
+    }).then(function(t) {
+      topic = t;
+      return call('pss_subscribe', ['receive', topic]);
+    }).then(function(id) {
+      subscription = id;
+    });
+  }
+
+  function receive(msg) {
+    let text = decodeText(msg.Msg);
+    try {
+      const file = JSON.parse(text);
+      if (file.type === 'demo_file') {
+        text = 'sent a file: ' + (file.name || file.hash) + ' (' + file.size + ' bytes)';
+      }
+    } catch (e) {
+      // plain text message
+    }
+    logChat('< ' + text);
+  }
+
+  function connect() {
+    const url = (location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/';
+    ws = new WebSocket(url);
+    ws.onopen = function() {
+      document.getElementById('chat-connect').disabled = true;
+      setup().catch(function(err) {
+        logChat('error: ' + err.message, 'notice');
+      });
+    };
+    ws.onclose = function(e) {
+      logChat('disconnected' + (e.reason ? ': ' + e.reason : ''), 'notice');
+      document.getElementById('chat-node').textContent = 'not connected';
+      document.getElementById('chat-connect').disabled = false;
+      selfID = null;
+      nodes.forEach(colourNode);
+      pending.forEach(function(p) {
+        p.reject(new Error('connection closed'));
+      });
+      pending.clear();
+    };
+    ws.onmessage = function(e) {
+      const msg = JSON.parse(e.data);
+      if (msg.id && pending.has(msg.id)) {
+        const p = pending.get(msg.id);
+        pending.delete(msg.id);
+        if (msg.error) {
+          p.reject(new Error(msg.error.message));
+        } else {
+          p.resolve(msg.result);
+        }
+        return;
+      }
+      switch (msg.method) {
+      case 'pss_subscription':
+        if (msg.params.subscription === subscription) {
+          receive(msg.params.result);
+        }
+        break;
+      case 'demo_nodeChanged':
+        logChat('moved to node ' + msg.params.new.name + ': ' + msg.params.reason, 'notice');
+        setup();
+        break;
+      case 'demo_shutdown':
+        logChat('demo shutting down in ' + msg.params.seconds + 's', 'notice');
+        break;
+      }
+    };
+  }
+
+  function send(e) {
+    e.preventDefault();
+    const peer = assigned.get(document.getElementById('chat-peer').value);
+    const input = document.getElementById('chat-msg');
+    const text = input.value;
+    if (!peer || !ws || !topic) {
+      return;
+    }
+    // the peer's overlay address is not known, so an empty address is used
+    // which sends the message through all peers
+    call('pss_setPeerPublicKey', [peer.Key, topic, '']).then(function() {
+      return call('pss_sendAsym', [base64ToHex(peer.Key), topic, encodeText(text)]);
+    }).then(function() {
+      logChat('> ' + peer.Name + ': ' + text, 'sent');
+      input.value = '';
+    }).catch(function(err) {
+      logChat('error: ' + err.message, 'notice');
+    });
+  }
+
+  document.getElementById('chat-connect').addEventListener('click', connect);
+  document.getElementById('chat-form').addEventListener('submit', send);
+
+  fetch('config.json').then(function(res) {
+    return res.json();
+  }).then(function(config) {
+    streamEvents(config.netPort);
+    pollList();
+    requestAnimationFrame(layout);
+  });
+})();
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestDashboard tests the dashboard assets and config are served
+func TestDashboard(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/dashboard/", newDashboard(8888))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	get := func(path string) (*http.Response, string) {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected GET %s to return 200, got %s", path, res.Status)
+		}
+		return res, string(body)
+	}
+
+	// check the index and the assets it references are served
+	_, index := get("/dashboard")
+	for _, asset := range []string{"dashboard.js", "dashboard.css"} {
+		if !strings.Contains(index, asset) {
+			t.Fatalf("expected index to reference %s", asset)
+		}
+		res, _ := get("/dashboard/" + asset)
+		if typ := res.Header.Get("Content-Type"); typ == "" || strings.HasPrefix(typ, "text/plain") {
+			t.Fatalf("unexpected content type for %s: %q", asset, typ)
+		}
+	}
+
+	_, body := get("/dashboard/config.json")
+	var config dashboardConfig
+	if err := json.Unmarshal([]byte(body), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.NetPort != 8888 {
+		t.Fatalf("expected netPort 8888, got %d", config.NetPort)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+)
+
+// dataDir is a persistent directory holding the state of a simulation
+// network so that it can be resumed when the demo is restarted, with the
+// following layout:
+//
+//	<dir>/network.json              the nodes and connections of the network
+//	<dir>/nodes/<name>/config.json  the node's config
+//	<dir>/nodes/<name>/p2p.key      the node's devp2p key
+//	<dir>/nodes/<name>/pss.key      the node's pss key
+//	<dir>/nodes/<name>/pss-cache    the node's pss DPA cache
+//	<dir>/nodes/<name>/state        the node's Kademlia peers
+//	<dir>/assignments               the conn manager's node assignments
+//	<dir>/exec                      the exec adapter node directories
+//
+// The exec adapter directory is recreated each time the demo starts.
+type dataDir struct {
+	Dir string
+
+	saveMtx sync.Mutex
+}
+
+// networkState is the state of a simulation network stored in
+// network.json
+type networkState struct {
+	Nodes []nodeState `json:"nodes"`
+	Conns []connState `json:"conns"`
+}
+
+type nodeState struct {
+	Name string `json:"name"`
+	Up   bool   `json:"up"`
+}
+
+type connState struct {
+	One   string `json:"one"`
+	Other string `json:"other"`
+}
+
+// nodeConfig is the node config stored in config.json
+type nodeConfig struct {
+	ID       discover.NodeID `json:"id"`
+	Name     string          `json:"name"`
+	Services []string        `json:"services"`
+}
+
+func (d *dataDir) NodesDir() string {
+	return filepath.Join(d.Dir, "nodes")
+}
+
+// AssignmentsDir returns the path of the conn manager's LevelDB assignment
+// store
+func (d *dataDir) AssignmentsDir() string {
+	return filepath.Join(d.Dir, "assignments")
+}
+
+// ExecDir removes and recreates the exec adapter directory, returning its
+// path
+func (d *dataDir) ExecDir() (string, error) {
+	dir := filepath.Join(d.Dir, "exec")
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// LoadNetwork resumes the network stored in the data directory, or creates
+// a new network with nodeCount nodes if the data directory is empty (with
+// nodeCount being ignored when resuming)
+func (d *dataDir) LoadNetwork(adapter adapters.NodeAdapter, nodeCount int, logDir string, keys *keyStore, swarm bool) (*simulations.Network, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.Dir, "network.json"))
+	if os.IsNotExist(err) {
+		net, err := NewPssSimulation(adapter, nodeCount, logDir, keys, swarm)
+		if err != nil {
+			return nil, err
+		}
+		return net, d.SaveNetwork(net)
+	} else if err != nil {
+		return nil, err
+	}
+	var state networkState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error decoding network.json: %s", err)
+	}
+	if len(state.Nodes) != nodeCount {
+		log.Warn("Ignoring node count as the network is resumed from the data directory", "node_count", nodeCount, "nodes", len(state.Nodes))
+	}
+	log.Info("Resuming network from data directory", "dir", d.Dir, "nodes", len(state.Nodes), "conns", len(state.Conns))
+	return d.resumeNetwork(adapter, &state, logDir, keys, swarm)
+}
+
+// resumeNetwork creates the nodes in the given state, starting the nodes
+// which were up and connecting them as they were connected
+func (d *dataDir) resumeNetwork(adapter adapters.NodeAdapter, state *networkState, logDir string, keys *keyStore, swarm bool) (_ *simulations.Network, err error) {
+	net := simulations.NewNetwork(adapter, &simulations.NetworkConfig{
+		ID: "pss-demo",
+	})
+	defer func() {
+		if err != nil {
+			net.Shutdown()
+		}
+	}()
+	for _, n := range state.Nodes {
+		config, err := d.loadNodeConfig(n.Name)
+		if err != nil {
+			return nil, err
+		}
+		node, err := newPssNode(net, n.Name, logDir, keys, swarm)
+		if err != nil {
+			return nil, err
+		}
+		if node.ID() != config.ID {
+			return nil, fmt.Errorf("node ID of %s does not match its config, expected %s, got %s", n.Name, config.ID.TerminalString(), node.ID().TerminalString())
+		}
+		if !n.Up {
+			continue
+		}
+		if err := net.Start(node.ID()); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range state.Conns {
+		one := net.GetNodeByName(c.One)
+		other := net.GetNodeByName(c.Other)
+		if one == nil || other == nil {
+			return nil, fmt.Errorf("invalid connection between unknown nodes %s and %s", c.One, c.Other)
+		}
+		if !one.Up || !other.Up {
+			continue
+		}
+		if err := net.Connect(one.ID(), other.ID()); err != nil {
+			return nil, err
+		}
+	}
+	return net, nil
+}
+
+// SaveNetwork saves the current nodes and connections of the network to
+// network.json, and the config of any new nodes to their config.json
+func (d *dataDir) SaveNetwork(net *simulations.Network) error {
+	d.saveMtx.Lock()
+	defer d.saveMtx.Unlock()
+	nodes := net.GetNodes()
+	state := &networkState{
+		Nodes: make([]nodeState, len(nodes)),
+	}
+	for i, node := range nodes {
+		if err := d.saveNodeConfig(node); err != nil {
+			return err
+		}
+		state.Nodes[i] = nodeState{Name: node.Config.Name, Up: node.Up}
+		for _, other := range nodes[i+1:] {
+			if conn := net.GetConn(node.ID(), other.ID()); conn != nil && conn.Up {
+				state.Conns = append(state.Conns, connState{
+					One:   net.GetNode(conn.One).Config.Name,
+					Other: net.GetNode(conn.Other).Config.Name,
+				})
+			}
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(d.Dir, "network.json"), data)
+}
+
+// WatchNetwork saves the network whenever a node or connection changes
+// until the returned stop function is called, which saves the network a
+// final time
+//
+// The network is saved in a separate goroutine to the one receiving its
+// events, as saving takes the network's lock which it holds while sending
+// events.
+func (d *dataDir) WatchNetwork(net *simulations.Network) (stop func()) {
+	events := make(chan *simulations.Event)
+	sub := net.Events().Subscribe(events)
+	quit := make(chan struct{})
+	changed := make(chan struct{}, 1)
+	var wg sync.WaitGroup
+	save := func() {
+		if err := d.SaveNetwork(net); err != nil {
+			log.Error("error saving network to data directory", "dir", d.Dir, "err", err)
+		}
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case event := <-events:
+				if event.Type != simulations.EventTypeNode && event.Type != simulations.EventTypeConn {
+					continue
+				}
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// save at most once a second
+		for {
+			select {
+			case <-changed:
+				save()
+			case <-quit:
+				return
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		wg.Wait()
+		save()
+	}
+}
+
+func (d *dataDir) loadNodeConfig(name string) (*nodeConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.NodesDir(), name, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	config := &nodeConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("error decoding config of %s: %s", name, err)
+	}
+	return config, nil
+}
+
+func (d *dataDir) saveNodeConfig(node *simulations.Node) error {
+	path := filepath.Join(d.NodesDir(), node.Config.Name, "config.json")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(&nodeConfig{
+		ID:       node.ID(),
+		Name:     node.Config.Name,
+		Services: node.Config.Services,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// fileStateStore is a network.StateStore which stores each key in a file
+// in a directory, used to persist the Kademlia peers of nodes
+type fileStateStore struct {
+	dir string
+}
+
+// Load returns the data stored for the given key, or nil if it does not
+// exist
+func (f *fileStateStore) Load(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, key+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f *fileStateStore) Save(key string, data []byte) error {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(f.dir, key+".json"), data)
+}
+
+// writeFileAtomic writes data to a temporary file then renames it to path so
+// that path is never partially written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
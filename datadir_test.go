@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+)
+
+// TestWriteFileAtomic tests writing and replacing a file without leaving
+// the temporary file behind
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file.json")
+	for _, data := range []string{`{"a":1}`, `{"b":2}`} {
+		if err := writeFileAtomic(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		written, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(written) != data {
+			t.Fatalf("expected %s to be written, got %s", data, written)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Fatalf("expected the temporary file to be removed, got %v", err)
+		}
+	}
+}
+
+// TestFileStateStore tests saving and loading Kademlia state
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &fileStateStore{dir: filepath.Join(dir, "node01", "state")}
+	data, err := store.Load("peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != nil {
+		t.Fatalf("expected no data for a missing key, got %s", data)
+	}
+	if err := store.Save("peers", []byte(`["a","b"]`)); err != nil {
+		t.Fatal(err)
+	}
+	data, err = store.Load("peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `["a","b"]` {
+		t.Fatalf("unexpected data: %s", data)
+	}
+}
+
+// TestDataDirNetwork tests saving a network to a data directory and
+// resuming it with the same nodes, node states and connections
+func TestDataDirNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := &dataDir{Dir: dir}
+	keys := &keyStore{Dir: data.NodesDir()}
+	logDir := filepath.Join(dir, "logs")
+
+	net, err := data.LoadNetwork(adapters.NewSimAdapter(services), 3, logDir, keys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connUp := func(one, other string) bool {
+		conn := net.GetConn(net.GetNodeByName(one).ID(), net.GetNodeByName(other).ID())
+		return conn != nil && conn.Up
+	}
+	for start := time.Now(); !connUp("node01", "node02"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			net.Shutdown()
+			t.Fatal("timed out waiting for node01 - node02 to connect")
+		}
+	}
+	ids := make(map[string]discover.NodeID)
+	for _, node := range net.GetNodes() {
+		ids[node.Config.Name] = node.ID()
+	}
+	if err := net.Stop(ids["node03"]); err != nil {
+		net.Shutdown()
+		t.Fatal(err)
+	}
+	for start := time.Now(); connUp("node01", "node03") || connUp("node02", "node03"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			net.Shutdown()
+			t.Fatal("timed out waiting for node03 to disconnect")
+		}
+	}
+	err = data.SaveNetwork(net)
+	net.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ioutil.ReadFile(filepath.Join(dir, "network.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state networkState
+	if err := json.Unmarshal(saved, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Nodes) != 3 || state.Nodes[2] != (nodeState{Name: "node03", Up: false}) {
+		t.Fatalf("unexpected saved nodes: %+v", state.Nodes)
+	}
+	for _, conn := range state.Conns {
+		if conn.One == "node03" || conn.Other == "node03" {
+			t.Fatalf("expected no saved connections to the stopped node03, got %+v", conn)
+		}
+	}
+	for name, id := range ids {
+		config, err := data.loadNodeConfig(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.ID != id {
+			t.Fatalf("expected the config of %s to have ID %s, got %s", name, id.TerminalString(), config.ID.TerminalString())
+		}
+	}
+
+	// resume the network, ignoring the different node count
+	net, err = data.LoadNetwork(adapters.NewSimAdapter(services), 5, logDir, keys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer net.Shutdown()
+	if nodes := net.GetNodes(); len(nodes) != 3 {
+		t.Fatalf("expected 3 resumed nodes, got %d", len(nodes))
+	}
+	for name, id := range ids {
+		node := net.GetNodeByName(name)
+		if node == nil || node.ID() != id {
+			t.Fatalf("expected %s to be resumed with ID %s", name, id.TerminalString())
+		}
+		if up := name != "node03"; node.Up != up {
+			t.Fatalf("expected %s up to be %t, got %t", name, up, node.Up)
+		}
+	}
+	for _, conn := range state.Conns {
+		for start := time.Now(); !connUp(conn.One, conn.Other); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("timed out waiting for %s - %s to reconnect", conn.One, conn.Other)
+			}
+		}
+	}
+}
+
+// TestWatchNetworkAddNodes tests that nodes can be added to the network
+// while it is being saved, as the network sends events while holding the
+// lock which saving takes
+func TestWatchNetworkAddNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-datadir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := &dataDir{Dir: dir}
+	keys := &keyStore{Dir: data.NodesDir()}
+	logDir := filepath.Join(dir, "logs")
+	net, err := data.LoadNetwork(adapters.NewSimAdapter(services), 2, logDir, keys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer net.Shutdown()
+	stop := data.WatchNetwork(net)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 200; i++ {
+			if _, err := newPssNode(net, fmt.Sprintf("added%03d", i), logDir, keys, false); err != nil {
+				done <- err
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out adding nodes while saving the network")
+	}
+	stop()
+}
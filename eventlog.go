@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+)
+
+// eventLogName is the name of the network event log in the log directory,
+// with rotated logs having a numeric suffix (e.g. events.jsonl.1) which
+// increases with age
+const eventLogName = "events.jsonl"
+
+// playbackMaxGap is the longest a playback waits between two events, so that
+// logs spanning several runs of the demo do not pause for the time the demo
+// was not running
+const playbackMaxGap = 10 * time.Second
+
+// eventLog writes network events to a JSON lines file, rotating it once it
+// reaches MaxSize bytes and keeping up to MaxFiles rotated files
+//
+// Each file starts with node and conn events for the nodes and conns of the
+// network, so that it can be played back without the files before it.
+type eventLog struct {
+	Dir      string
+	MaxSize  int
+	MaxFiles int
+
+	file *os.File
+	size int
+
+	// nodes and conns are the state of the network built up from the
+	// events written to the log, which is written at the start of each
+	// file rather than taking a network snapshot, as that needs the
+	// network's lock which is held while it sends events to the log
+	nodes     []*simulations.Node
+	nodeIndex map[discover.NodeID]int
+	conns     []*simulations.Conn
+	connIndex map[[2]discover.NodeID]int
+}
+
+// Open opens the event log for appending, starting with events for the
+// nodes and conns of the network written so far
+func (l *eventLog) Open() error {
+	f, err := os.OpenFile(l.path(0), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = int(info.Size())
+	return l.writeState()
+}
+
+// writeState writes node and conn events for the current state of the
+// network
+func (l *eventLog) writeState() error {
+	for _, node := range l.nodes {
+		if err := l.write(simulations.NewEvent(node)); err != nil {
+			return err
+		}
+	}
+	for _, conn := range l.conns {
+		if err := l.write(simulations.NewEvent(conn)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update updates the state of the network with a node or conn event
+func (l *eventLog) update(event *simulations.Event) {
+	switch event.Type {
+	case simulations.EventTypeNode:
+		if l.nodeIndex == nil {
+			l.nodeIndex = make(map[discover.NodeID]int)
+		}
+		if i, ok := l.nodeIndex[event.Node.ID()]; ok {
+			l.nodes[i] = event.Node
+			return
+		}
+		l.nodeIndex[event.Node.ID()] = len(l.nodes)
+		l.nodes = append(l.nodes, event.Node)
+	case simulations.EventTypeConn:
+		if l.connIndex == nil {
+			l.connIndex = make(map[[2]discover.NodeID]int)
+		}
+		key := [2]discover.NodeID{event.Conn.One, event.Conn.Other}
+		if i, ok := l.connIndex[key]; ok {
+			l.conns[i] = event.Conn
+			return
+		}
+		l.connIndex[key] = len(l.conns)
+		l.conns = append(l.conns, event.Conn)
+	}
+}
+
+// Close closes the event log
+func (l *eventLog) Close() error {
+	return l.file.Close()
+}
+
+// Write writes the event to the log as a single line of JSON
+func (l *eventLog) Write(event *simulations.Event) error {
+	l.update(event)
+	return l.write(event)
+}
+
+func (l *eventLog) write(event *simulations.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if l.size > 0 && l.size+len(data) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += n
+	return err
+}
+
+// rotate renames the current log to the first rotated log, shifting older
+// ones along and deleting the oldest, then opens a new log
+func (l *eventLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.MaxFiles > 0 {
+		for i := l.MaxFiles - 1; i >= 0; i-- {
+			if err := os.Rename(l.path(i), l.path(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	} else if err := os.Remove(l.path(0)); err != nil {
+		return err
+	}
+	return l.Open()
+}
+
+func (l *eventLog) path(n int) string {
+	path := filepath.Join(l.Dir, eventLogName)
+	if n > 0 {
+		path += "." + strconv.Itoa(n)
+	}
+	return path
+}
+
+// Record writes the current nodes and conns of the network to the log
+// followed by its node, conn and msg events until the returned stop function
+// is called, which closes the log
+//
+// Record must be called before anything else changes the network, as
+// changes between taking the snapshot and subscribing to events are missed.
+func (l *eventLog) Record(net *simulations.Network) (stop func(), err error) {
+	snap, err := net.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	for i := range snap.Nodes {
+		l.update(simulations.NewEvent(&snap.Nodes[i].Node))
+	}
+	for i := range snap.Conns {
+		l.update(simulations.NewEvent(&snap.Conns[i]))
+	}
+	if err := l.writeState(); err != nil {
+		return nil, err
+	}
+	events := make(chan *simulations.Event)
+	sub := net.Events().Subscribe(events)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case event := <-events:
+				if err := l.Write(event); err != nil {
+					log.Error("error writing network event log", "dir", l.Dir, "err", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+		l.Close()
+	}, nil
+}
+
+// eventPlayer serves a recorded event log in the same format as the
+// simulation API's GET /events, so that tools which visualise a live network
+// can replay it
+//
+// Events are streamed at the speed they were recorded, or faster with the
+// speed query parameter (e.g. ?speed=10, or ?speed=0 to stream them all
+// immediately). As with /events, msg events are only streamed if they match
+// the filter query parameter (e.g. ?filter=pss:1-bzz:*). The current
+// parameter is ignored as each log starts with the nodes and conns of the
+// network when it was opened. The stream ends after the last recorded event.
+type eventPlayer struct {
+	Dir string
+}
+
+// recordedEvent is the part of a recorded event needed to play it back
+type recordedEvent struct {
+	Type simulations.EventType `json:"type"`
+	Time time.Time             `json:"time"`
+	Msg  *simulations.Msg      `json:"msg"`
+}
+
+func (p *eventPlayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	speed := 1.0
+	if s := req.URL.Query().Get("speed"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 {
+			http.Error(w, fmt.Sprintf("invalid speed %q", s), http.StatusBadRequest)
+			return
+		}
+		speed = v
+	}
+	var filters simulations.MsgFilters
+	if filter := req.URL.Query().Get("filter"); filter != "" {
+		var err error
+		filters, err = simulations.NewMsgFilters(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	paths, err := p.logs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(paths) == 0 {
+		http.Error(w, "no recorded network events", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("\n\n"))
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	var last time.Time
+	for _, path := range paths {
+		err := playEvents(path, func(data []byte, event *recordedEvent) error {
+			if event.Type == simulations.EventTypeMsg && (event.Msg == nil || !filters.Match(event.Msg)) {
+				return nil
+			}
+			if speed > 0 && !last.IsZero() {
+				gap := event.Time.Sub(last)
+				if gap > playbackMaxGap {
+					gap = playbackMaxGap
+				}
+				if gap > 0 {
+					select {
+					case <-time.After(time.Duration(float64(gap) / speed)):
+					case <-req.Context().Done():
+						return req.Context().Err()
+					}
+				}
+			}
+			last = event.Time
+			if _, err := fmt.Fprintf(w, "event: network\ndata: %s\n\n", data); err != nil {
+				return err
+			}
+			flush()
+			return nil
+		})
+		if err != nil {
+			if req.Context().Err() == nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			}
+			return
+		}
+	}
+}
+
+// logs returns the paths of the recorded event logs, oldest first
+func (p *eventPlayer) logs() ([]string, error) {
+	l := eventLog{Dir: p.Dir}
+	var paths []string
+	for n := 0; ; n++ {
+		path := l.path(n)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// the current log may not exist if the recording demo
+			// failed to reopen it after rotating
+			if n == 0 {
+				continue
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		paths = append([]string{path}, paths...)
+	}
+	return paths, nil
+}
+
+// playEvents calls fn with each line of the event log at the given path and
+// the event it decodes to
+func playEvents(path string, fn func(data []byte, event *recordedEvent) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		data := s.Bytes()
+		if len(data) == 0 {
+			continue
+		}
+		event := &recordedEvent{}
+		if err := json.Unmarshal(data, event); err != nil {
+			return fmt.Errorf("error decoding event in %s: %s", path, err)
+		}
+		if err := fn(data, event); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+)
+
+// TestEventLog tests that network events are written to rotated logs and
+// played back in the order they were recorded
+func TestEventLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// record msg events with alternating protocols a second apart, in logs
+	// which fit two events each
+	one := discover.NodeID{1}
+	other := discover.NodeID{2}
+	start := time.Now().Add(-time.Hour)
+	var events []*simulations.Event
+	for i := 0; i < 7; i++ {
+		proto := "pss"
+		if i%2 == 1 {
+			proto = "bzz"
+		}
+		events = append(events, &simulations.Event{
+			Type: simulations.EventTypeMsg,
+			Time: start.Add(time.Duration(i) * time.Second),
+			Msg:  &simulations.Msg{One: one, Other: other, Protocol: proto, Code: uint64(i)},
+		})
+	}
+	data, _ := json.Marshal(events[0])
+	l := &eventLog{Dir: dir, MaxSize: 2*len(data) + 2, MaxFiles: 2}
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if err := l.Write(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// the oldest log should have been deleted, leaving the last 5 events
+	// across the current log and two rotated logs
+	for n, expected := range []int{1, 2, 2} {
+		data, err := ioutil.ReadFile(l.path(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != expected {
+			t.Fatalf("expected %d events in %s, got %d", expected, l.path(n), lines)
+		}
+	}
+	if _, err := os.Stat(l.path(3)); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to have been deleted", l.path(3))
+	}
+
+	srv := httptest.NewServer(&eventPlayer{Dir: dir})
+	defer srv.Close()
+	play := func(query string) []uint64 {
+		var codes []uint64
+		for _, event := range playEventLog(t, srv, query) {
+			codes = append(codes, event.Msg.Code)
+		}
+		return codes
+	}
+	if codes := play("speed=0&filter=pss:*-bzz:*"); !reflect.DeepEqual(codes, []uint64{2, 3, 4, 5, 6}) {
+		t.Fatalf("unexpected events played back: %v", codes)
+	}
+	if codes := play("speed=0&filter=bzz:*"); !reflect.DeepEqual(codes, []uint64{3, 5}) {
+		t.Fatalf("unexpected filtered events played back: %v", codes)
+	}
+	if codes := play("speed=0"); len(codes) != 0 {
+		t.Fatalf("expected no msg events to be played back without a filter, got %v", codes)
+	}
+
+	// events a second apart at 20x speed should take at least 200ms
+	startPlay := time.Now()
+	play("speed=20&filter=pss:*-bzz:*")
+	if elapsed := time.Since(startPlay); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("expected playback at 20x speed to take around 200ms, took %s", elapsed)
+	}
+}
+
+// playEventLog plays back the event log served by srv with the given query,
+// returning the events
+func playEventLog(t *testing.T, srv *httptest.Server, query string) []*simulations.Event {
+	res, err := http.Get(srv.URL + "/events?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", res.Status)
+	}
+	var events []*simulations.Event
+	s := bufio.NewScanner(res.Body)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		if !strings.HasPrefix(s.Text(), "data: ") {
+			continue
+		}
+		event := &simulations.Event{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(s.Text(), "data: ")), event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// TestEventLogRecord tests recording a network which already has nodes and
+// conns, and that each log file starts with the nodes and conns of the
+// network so that it can be played back on its own
+func TestEventLogRecord(t *testing.T) {
+	net := newTestNetwork(t, 3, false)
+	defer net.Close()
+	ring := [][2]string{{"node01", "node02"}, {"node02", "node03"}, {"node03", "node01"}}
+	waitConnsUp(t, net.Network, ring...)
+
+	dir, err := ioutil.TempDir("", "pss-demo-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := &eventLog{Dir: dir, MaxSize: 64 * 1024 * 1024, MaxFiles: 1}
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	stop, err := l.Record(net.Network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := net.GetNodeByName("node03").ID()
+	if err := net.Stop(stopped); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	for start := time.Now(); connUp(net.Network, "node01", "node03") || connUp(net.Network, "node02", "node03"); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			stop()
+			t.Fatal("timed out waiting for node03 to disconnect")
+		}
+	}
+	stop()
+
+	// check the recording starts with the existing nodes and conns, which
+	// are followed by node03 stopping
+	srv := httptest.NewServer(&eventPlayer{Dir: dir})
+	defer srv.Close()
+	events := playEventLog(t, srv, "speed=0")
+	if len(events) < 3+len(ring) {
+		t.Fatalf("expected at least %d events, got %d", 3+len(ring), len(events))
+	}
+	for i, node := range net.GetNodes() {
+		if event := events[i]; event.Type != simulations.EventTypeNode || event.Node.ID() != node.ID() || !event.Node.Up {
+			t.Fatalf("expected event %d to be %s being up, got %s", i, node.Config.Name, event)
+		}
+	}
+	for i := range ring {
+		if event := events[3+i]; event.Type != simulations.EventTypeConn || !event.Conn.Up {
+			t.Fatalf("expected event %d to be a conn being up, got %s", 3+i, event)
+		}
+	}
+	var down bool
+	for _, event := range events[3+len(ring):] {
+		if event.Type == simulations.EventTypeMsg {
+			t.Fatalf("expected no msg events without a filter, got %s", event)
+		}
+		if event.Type == simulations.EventTypeNode && event.Node.ID() == stopped && !event.Node.Up {
+			down = true
+		}
+	}
+	if !down {
+		t.Fatal("expected node03 to be recorded going down")
+	}
+
+	// check a rotated log starts with the nodes and conns as they were
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if err := os.Remove(l.path(1)); err != nil {
+		t.Fatal(err)
+	}
+	events = playEventLog(t, srv, "speed=0")
+	var nodes int
+	for _, event := range events {
+		switch event.Type {
+		case simulations.EventTypeNode:
+			nodes++
+			if up := event.Node.ID() != stopped; event.Node.Up != up {
+				t.Fatalf("expected %s up to be %t in the rotated log", event.Node.ID().TerminalString(), up)
+			}
+		case simulations.EventTypeConn:
+			if event.Conn.One == stopped || event.Conn.Other == stopped {
+				if event.Conn.Up {
+					t.Fatal("expected the conns of node03 to be down in the rotated log")
+				}
+			}
+		default:
+			t.Fatalf("expected only node and conn events in the rotated log, got %s", event)
+		}
+	}
+	if nodes != 3 {
+		t.Fatalf("expected 3 node events in the rotated log, got %d", nodes)
+	}
+}
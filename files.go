@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/swarm/api"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+// maxFileSize is the maximum size of a file sent with demo_sendFile
+const maxFileSize = 16 * 1024 * 1024
+
+// fileMsgType is the type of the pss messages sent by demo_sendFile
+const fileMsgType = "demo_file"
+
+// fileMsg is the pss message sent by demo_sendFile, which references a file
+// stored in Swarm rather than containing it
+type fileMsg struct {
+	Type        string `json:"type"`
+	Hash        string `json:"hash"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+}
+
+// fileMeta is the optional metadata param of demo_sendFile
+type fileMeta struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+}
+
+// fileContent is the result of demo_fetchFile
+type fileContent struct {
+	Hash        string `json:"hash"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	Data        []byte `json:"data"`
+}
+
+// fileSharer sends payloads which are too large for pss messages by storing
+// them in Swarm through the demo's gateway and sending only their hash and
+// metadata over pss
+type fileSharer struct {
+	net *simulations.Network
+	api *api.Api
+}
+
+func newFileSharer(net *simulations.Network, api *api.Api) *fileSharer {
+	return &fileSharer{net: net, api: api}
+}
+
+// Register registers the demo_sendFile and demo_fetchFile methods with the
+// conn manager
+func (f *fileSharer) Register(c *connManager) {
+	c.Handle("demo_sendFile", f.sendFile)
+	c.Handle("demo_fetchFile", f.fetchFile)
+}
+
+// sendFile handles demo_sendFile(pubkey, topic, data, meta), storing data in
+// Swarm and sending a fileMsg to the recipient through the client's node,
+// returning the sent fileMsg
+//
+// As with pss_sendAsym, the recipient's public key must have been set with
+// pss_setPeerPublicKey.
+func (f *fileSharer) sendFile(session *clientSession, params json.RawMessage) (interface{}, error) {
+	var (
+		pubkey hexutil.Bytes
+		topic  pss.Topic
+		data   []byte
+		meta   fileMeta
+	)
+	if err := decodeParams(params, &pubkey, &topic, &data, &meta); err != nil {
+		return nil, err
+	}
+	if len(pubkey) == 0 {
+		return nil, &invalidParamsError{"missing public key"}
+	}
+	if len(data) > maxFileSize {
+		return nil, &invalidParamsError{fmt.Sprintf("file too large, must be at most %d bytes", maxFileSize)}
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = http.DetectContentType(data)
+	}
+
+	key, err := f.api.Put(string(data), meta.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("error storing file in Swarm: %s", err)
+	}
+	msg := &fileMsg{
+		Type:        fileMsgType,
+		Hash:        key.Hex(),
+		Name:        meta.Name,
+		ContentType: meta.ContentType,
+		Size:        len(data),
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	node := f.net.GetNode(session.NodeID())
+	if node == nil || !node.Up {
+		return nil, errors.New("client node is down")
+	}
+	client, err := node.Client()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Call(nil, "pss_sendAsym", common.ToHex(pubkey), topic, payload); err != nil {
+		return nil, err
+	}
+	log.Info("sent file over pss", "node", node.Config.Name, "hash", msg.Hash, "size", msg.Size)
+	return msg, nil
+}
+
+// fetchFile handles demo_fetchFile(hash), returning the file with the hash
+// from a received fileMsg
+func (f *fileSharer) fetchFile(session *clientSession, params json.RawMessage) (interface{}, error) {
+	var hash string
+	if err := decodeParams(params, &hash); err != nil {
+		return nil, err
+	}
+	if !hashMatcher.MatchString(hash) {
+		return nil, &invalidParamsError{fmt.Sprintf("invalid hash %q, must be 64 hex characters", hash)}
+	}
+	return f.Fetch(common.HexToHash(hash))
+}
+
+// Fetch retrieves the file with the hash from Swarm
+func (f *fileSharer) Fetch(hash common.Hash) (*fileContent, error) {
+	reader, contentType, status, err := f.api.Get(hash[:], "")
+	if err != nil {
+		return nil, fmt.Errorf("error getting file from Swarm: %s (status %d)", err, status)
+	}
+	size, err := reader.Size(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error getting file from Swarm: %s", err)
+	}
+	if size > maxFileSize {
+		return nil, fmt.Errorf("file too large, must be at most %d bytes", maxFileSize)
+	}
+	// the reader does not support reading past the end of the content
+	data := make([]byte, size)
+	if _, err := reader.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading file from Swarm: %s", err)
+	}
+	return &fileContent{
+		Hash:        hash.Hex(),
+		ContentType: contentType,
+		Size:        len(data),
+		Data:        data,
+	}, nil
+}
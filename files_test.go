@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/swarm/api"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+	"github.com/ethereum/go-ethereum/swarm/storage"
+)
+
+// TestSendFile tests sending a file too large for a pss message from one
+// client to another with demo_sendFile and fetching it with demo_fetchFile
+func TestSendFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chunkStore, err := newLocalChunkStore(&swarmConfig{Dir: dir, DbCapacity: 10000, CacheCapacity: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chunkStore.Close()
+	dpa := storage.NewDPA(chunkStore, storage.NewChunkerParams())
+	dpa.Start()
+	defer dpa.Stop()
+
+	c := newTestConnManager(t, 2, nodeFailureClose)
+	defer c.Close()
+	newFileSharer(c.net, api.NewApi(dpa, nil)).Register(c.manager)
+	alice := newTestClient(t, c)
+	defer alice.Close()
+	bob := newTestClient(t, c)
+	defer bob.Close()
+
+	topic := pss.BytesToTopic([]byte("pss-demo-test"))
+	msgC := make(chan pss.APIMsg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sub, err := bob.Subscribe(ctx, "pss", msgC, "receive", topic)
+	if err != nil {
+		t.Fatalf("error subscribing to pss messages: %s", err)
+	}
+	defer sub.Unsubscribe()
+	if err := alice.Call(nil, "pss_setPeerPublicKey", bob.pubkey, topic, bob.addr); err != nil {
+		t.Fatalf("error setting peer public key: %s", err)
+	}
+
+	// check invalid params are rejected
+	if err := alice.Call(nil, "demo_sendFile", "0x", topic, []byte("x")); err == nil {
+		t.Fatal("expected error sending file without a public key")
+	}
+	if err := alice.Call(nil, "demo_fetchFile", "abc"); err == nil {
+		t.Fatal("expected error fetching invalid hash")
+	}
+
+	// resend the file periodically as pss messages are dropped if sent
+	// before the nodes have completed their bzz handshake
+	data := make([]byte, 100000)
+	rand.Read(data)
+	var sent fileMsg
+	send := func() {
+		meta := &fileMeta{Name: "random.bin", ContentType: "application/octet-stream"}
+		if err := alice.Call(&sent, "demo_sendFile", hexutil.Bytes(bob.pubkey), topic, data, meta); err != nil {
+			t.Fatalf("error sending file: %s", err)
+		}
+	}
+	send()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var received fileMsg
+loop:
+	for {
+		select {
+		case msg := <-msgC:
+			if err := json.Unmarshal(msg.Msg, &received); err != nil {
+				t.Fatalf("error decoding file message %q: %s", msg.Msg, err)
+			}
+			break loop
+		case <-ticker.C:
+			send()
+		case err := <-sub.Err():
+			t.Fatalf("pss subscription error: %s", err)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for file message")
+		}
+	}
+	if received != sent {
+		t.Fatalf("expected file message %+v, got %+v", sent, received)
+	}
+	if received.Type != fileMsgType || received.Name != "random.bin" || received.Size != len(data) {
+		t.Fatalf("unexpected file message: %+v", received)
+	}
+
+	var file fileContent
+	if err := bob.Call(&file, "demo_fetchFile", received.Hash); err != nil {
+		t.Fatalf("error fetching file: %s", err)
+	}
+	if file.ContentType != "application/octet-stream" || !bytes.Equal(file.Data, data) {
+		t.Fatalf("fetched file does not match sent file (content type %q, size %d)", file.ContentType, len(file.Data))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/storage"
+)
+
+// swarmGateway is a chunk store for the Swarm HTTP gateway which stores and
+// retrieves chunks through the Swarm services of simulation nodes, so that
+// uploaded content is distributed across the network
+//
+// Chunks are stored through the attached nodes in turn and retrieved through
+// the first attached node which finds them, skipping nodes which are down.
+type swarmGateway struct {
+	net   *simulations.Network
+	nodes []discover.NodeID
+	next  uint32
+}
+
+// newSwarmGateway returns a gateway attached to the first count nodes in the
+// network
+func newSwarmGateway(net *simulations.Network, count int) (*swarmGateway, error) {
+	nodes := net.GetNodes()
+	if count > len(nodes) {
+		return nil, fmt.Errorf("cannot attach Swarm gateway to %d nodes, network only has %d", count, len(nodes))
+	}
+	g := &swarmGateway{net: net}
+	for _, node := range nodes[:count] {
+		g.nodes = append(g.nodes, node.ID())
+	}
+	return g, nil
+}
+
+// Nodes returns the names of the attached nodes
+func (g *swarmGateway) Nodes() []string {
+	names := make([]string, len(g.nodes))
+	for i, id := range g.nodes {
+		names[i] = g.net.GetNode(id).Config.Name
+	}
+	return names
+}
+
+// call calls the RPC method on the attached nodes in turn, starting with
+// the node at index start, until a call succeeds
+func (g *swarmGateway) call(start int, result interface{}, method string, args ...interface{}) error {
+	err := errors.New("no attached nodes are up")
+	for i := range g.nodes {
+		node := g.net.GetNode(g.nodes[(start+i)%len(g.nodes)])
+		if node == nil || !node.Up {
+			continue
+		}
+		var client *rpc.Client
+		client, err = node.Client()
+		if err != nil {
+			continue
+		}
+		if err = client.Call(result, method, args...); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Put stores the chunk through the next attached node
+func (g *swarmGateway) Put(chunk *storage.Chunk) {
+	start := int(atomic.AddUint32(&g.next, 1))
+	if err := g.call(start, nil, "swarm_storeChunk", hexutil.Bytes(chunk.Key), hexutil.Bytes(chunk.SData)); err != nil {
+		log.Error("error storing chunk", "key", chunk.Key.Log(), "err", err)
+	}
+}
+
+// Get retrieves the chunk through the attached nodes
+func (g *swarmGateway) Get(key storage.Key) (*storage.Chunk, error) {
+	var data hexutil.Bytes
+	if err := g.call(0, &data, "swarm_retrieveChunk", hexutil.Bytes(key)); err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, errChunkNotFound
+	}
+	chunk := storage.NewChunk(key, nil)
+	chunk.SData = data
+	chunk.Size = int64(binary.LittleEndian.Uint64(data[:8]))
+	return chunk, nil
+}
+
+func (g *swarmGateway) Close() {}
+
+// chunkReport is the response served at /chunks
+type chunkReport struct {
+	// Nodes maps the names of the nodes running the Swarm service to the
+	// number of chunks they hold
+	Nodes map[string]int `json:"nodes"`
+
+	// Chunks maps chunk keys to the names of the nodes holding them
+	Chunks map[string][]string `json:"chunks"`
+}
+
+// Report returns which nodes hold which chunks
+func (g *swarmGateway) Report() *chunkReport {
+	report := &chunkReport{
+		Nodes:  make(map[string]int),
+		Chunks: make(map[string][]string),
+	}
+	for _, node := range g.net.GetNodes() {
+		if !node.Up {
+			continue
+		}
+		client, err := node.Client()
+		if err != nil {
+			continue
+		}
+		var keys []hexutil.Bytes
+		if err := client.Call(&keys, "swarm_chunks"); err != nil {
+			log.Warn("error getting node chunks", "node", node.Config.Name, "err", err)
+			continue
+		}
+		name := node.Config.Name
+		report.Nodes[name] = len(keys)
+		for _, key := range keys {
+			hex := storage.Key(key).Hex()
+			report.Chunks[hex] = append(report.Chunks[hex], name)
+		}
+	}
+	for _, names := range report.Chunks {
+		sort.Strings(names)
+	}
+	return report
+}
+
+// ServeHTTP serves the chunk report at /chunks
+func (g *swarmGateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(g.Report())
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/pot"
+)
+
+// networkGraph is a snapshot of a network's nodes and connections, which
+// is served at /topology as JSON, Graphviz DOT or GraphML
+type networkGraph struct {
+	Nodes []*graphNode `json:"nodes"`
+	Edges []*graphEdge `json:"edges"`
+}
+
+// graphNode is a node of a network graph, with the overlay address and pss
+// public key only being known for running nodes
+type graphNode struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Up          bool          `json:"up"`
+	OverlayAddr hexutil.Bytes `json:"overlay_addr,omitempty"`
+	PubKey      hexutil.Bytes `json:"pubkey,omitempty"`
+
+	// Assignment is "client" if the node is assigned to a client, "bot"
+	// if it is reserved for a bot of kind Bot, or "free"
+	Assignment string `json:"assignment"`
+	Bot        string `json:"bot,omitempty"`
+}
+
+// graphEdge is a connection between two nodes of a network graph, with
+// Proximity being the Kademlia proximity order of the nodes' overlay
+// addresses (the number of leading bits they have in common), or nil if
+// either address is unknown
+type graphEdge struct {
+	One       string `json:"one"`
+	Other     string `json:"other"`
+	Proximity *int   `json:"proximity"`
+}
+
+// graphExporter serves the current graph of a network along with the
+// assignments of its conn manager
+type graphExporter struct {
+	net   *simulations.Network
+	conns *connManager
+}
+
+func newGraphExporter(net *simulations.Network, conns *connManager) *graphExporter {
+	return &graphExporter{net: net, conns: conns}
+}
+
+// Graph returns the network's nodes and the connections which are up
+func (g *graphExporter) Graph() *networkGraph {
+	graph := &networkGraph{Nodes: []*graphNode{}, Edges: []*graphEdge{}}
+	nodes := g.net.GetNodes()
+	for _, node := range nodes {
+		n := &graphNode{
+			ID:         node.ID().String(),
+			Name:       node.Config.Name,
+			Up:         node.Up,
+			Assignment: "free",
+		}
+		if bot := g.conns.Bot(node.ID()); bot != "" {
+			n.Assignment = "bot"
+			n.Bot = bot
+		} else if g.conns.Assigned(node.ID()) {
+			n.Assignment = "client"
+		}
+		if node.Up {
+			if client, err := node.Client(); err != nil {
+				log.Warn("error getting node client", "node", node.Config.Name, "err", err)
+			} else {
+				// the pss API returns byte slices, which are base64 encoded
+				var addr, pubkey []byte
+				if err := client.Call(&addr, "pss_baseAddr"); err != nil {
+					log.Warn("error getting pss base address", "node", node.Config.Name, "err", err)
+				}
+				if err := client.Call(&pubkey, "pss_getPublicKey"); err != nil {
+					log.Warn("error getting pss public key", "node", node.Config.Name, "err", err)
+				}
+				n.OverlayAddr, n.PubKey = addr, pubkey
+			}
+		}
+		graph.Nodes = append(graph.Nodes, n)
+	}
+	for i, one := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			other := nodes[j]
+			conn := g.net.GetConn(one.ID(), other.ID())
+			if conn == nil || !conn.Up {
+				continue
+			}
+			edge := &graphEdge{
+				One:   g.net.GetNode(conn.One).Config.Name,
+				Other: g.net.GetNode(conn.Other).Config.Name,
+			}
+			if a, b := graph.Nodes[i].OverlayAddr, graph.Nodes[j].OverlayAddr; len(a) > 0 && len(a) == len(b) {
+				po := proximityOrder(a, b)
+				edge.Proximity = &po
+			}
+			graph.Edges = append(graph.Edges, edge)
+		}
+	}
+	return graph
+}
+
+// proximityOrder returns the Kademlia proximity order of two addresses of
+// the same length
+func proximityOrder(one, other []byte) int {
+	po, _ := pot.DefaultPof(len(one)*8)(one, other, 0)
+	return po
+}
+
+// ServeHTTP serves the network graph at /topology in the format given by the
+// format query parameter:
+//
+//	json     the networkGraph as JSON (the default)
+//	dot      a Graphviz undirected graph
+//	graphml  a GraphML graph, for example for Gephi
+func (g *graphExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var write func(io.Writer, *networkGraph) error
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		write = func(w io.Writer, graph *networkGraph) error {
+			return json.NewEncoder(w).Encode(graph)
+		}
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		write = writeDOT
+	case "graphml":
+		w.Header().Set("Content-Type", "application/graphml+xml")
+		write = writeGraphML
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q, must be json, dot or graphml", format), http.StatusBadRequest)
+		return
+	}
+	if err := write(w, g.Graph()); err != nil {
+		log.Error("error writing network graph", "err", err)
+	}
+}
+
+// graphNodeColors are the DOT fill colours of nodes by assignment, matching
+// those of the dashboard (which shows bot nodes as assigned)
+var graphNodeColors = map[string]string{
+	"free":   "#4a90d9",
+	"client": "#3cb371",
+	"bot":    "#3cb371",
+}
+
+// graphDownColor is the DOT fill colour of stopped nodes
+const graphDownColor = "#bbbbbb"
+
+// writeDOT writes a network graph as a Graphviz undirected graph, with nodes
+// coloured like the dashboard and edges labelled with their proximity order
+func writeDOT(w io.Writer, graph *networkGraph) error {
+	var b strings.Builder
+	b.WriteString("graph \"pss-demo\" {\n")
+	b.WriteString("  node [shape=ellipse style=filled];\n")
+	for _, n := range graph.Nodes {
+		color := graphNodeColors[n.Assignment]
+		if !n.Up {
+			color = graphDownColor
+		}
+		attrs := []string{
+			fmt.Sprintf("label=%q", n.Name),
+			fmt.Sprintf("id=%q", n.ID),
+			fmt.Sprintf("assignment=%q", n.Assignment),
+			fmt.Sprintf("fillcolor=%q", color),
+		}
+		if len(n.OverlayAddr) > 0 {
+			attrs = append(attrs, fmt.Sprintf("overlay_addr=%q", n.OverlayAddr.String()))
+		}
+		if len(n.PubKey) > 0 {
+			attrs = append(attrs, fmt.Sprintf("pubkey=%q", n.PubKey.String()))
+		}
+		if n.Bot != "" {
+			attrs = append(attrs, fmt.Sprintf("bot=%q", n.Bot))
+		}
+		fmt.Fprintf(&b, "  %q [%s];\n", n.Name, strings.Join(attrs, " "))
+	}
+	for _, e := range graph.Edges {
+		if e.Proximity != nil {
+			fmt.Fprintf(&b, "  %q -- %q [label=\"%d\" proximity=%d];\n", e.One, e.Other, *e.Proximity, *e.Proximity)
+		} else {
+			fmt.Fprintf(&b, "  %q -- %q;\n", e.One, e.Other)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// graphML is a GraphML document with a single undirected graph
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		ID          string        `xml:"id,attr"`
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLItem `xml:"node"`
+		Edges       []graphMLItem `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// graphMLKey declares an attribute of nodes or edges
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+// graphMLItem is a node, which has an ID, or an edge, which has a source and
+// target
+type graphMLItem struct {
+	ID     string        `xml:"id,attr,omitempty"`
+	Source string        `xml:"source,attr,omitempty"`
+	Target string        `xml:"target,attr,omitempty"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// writeGraphML writes a network graph as GraphML, with nodes identified by
+// name and their other fields and the edges' proximity orders as attributes
+func writeGraphML(w io.Writer, graph *networkGraph) error {
+	doc := &graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "label", For: "node", Name: "label", Type: "string"},
+			{ID: "node_id", For: "node", Name: "node_id", Type: "string"},
+			{ID: "up", For: "node", Name: "up", Type: "boolean"},
+			{ID: "overlay_addr", For: "node", Name: "overlay_addr", Type: "string"},
+			{ID: "pubkey", For: "node", Name: "pubkey", Type: "string"},
+			{ID: "assignment", For: "node", Name: "assignment", Type: "string"},
+			{ID: "bot", For: "node", Name: "bot", Type: "string"},
+			{ID: "proximity", For: "edge", Name: "proximity", Type: "int"},
+		},
+	}
+	doc.Graph.ID = "pss-demo"
+	doc.Graph.EdgeDefault = "undirected"
+	for _, n := range graph.Nodes {
+		item := graphMLItem{ID: n.Name, Data: []graphMLData{
+			{Key: "label", Value: n.Name},
+			{Key: "node_id", Value: n.ID},
+			{Key: "up", Value: fmt.Sprint(n.Up)},
+			{Key: "assignment", Value: n.Assignment},
+		}}
+		if len(n.OverlayAddr) > 0 {
+			item.Data = append(item.Data, graphMLData{Key: "overlay_addr", Value: n.OverlayAddr.String()})
+		}
+		if len(n.PubKey) > 0 {
+			item.Data = append(item.Data, graphMLData{Key: "pubkey", Value: n.PubKey.String()})
+		}
+		if n.Bot != "" {
+			item.Data = append(item.Data, graphMLData{Key: "bot", Value: n.Bot})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, item)
+	}
+	for _, e := range graph.Edges {
+		item := graphMLItem{Source: e.One, Target: e.Other}
+		if e.Proximity != nil {
+			item.Data = append(item.Data, graphMLData{Key: "proximity", Value: fmt.Sprint(*e.Proximity)})
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, item)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProximityOrder tests the proximity order of overlay addresses
+func TestProximityOrder(t *testing.T) {
+	for _, test := range []struct {
+		one, other []byte
+		po         int
+	}{
+		{[]byte{0x00, 0x00}, []byte{0x80, 0x00}, 0},
+		{[]byte{0x24, 0x00}, []byte{0x0b, 0x00}, 2},
+		{[]byte{0xff, 0x00}, []byte{0xff, 0x01}, 15},
+		{[]byte{0x12, 0x34}, []byte{0x12, 0x34}, 16},
+	} {
+		if po := proximityOrder(test.one, test.other); po != test.po {
+			t.Fatalf("expected proximity order of %x and %x to be %d, got %d", test.one, test.other, test.po, po)
+		}
+	}
+}
+
+// TestGraphExporter tests exporting the network graph from /topology in
+// each format
+func TestGraphExporter(t *testing.T) {
+	c := newTestConnManager(t, 3, nodeFailureClose)
+	defer c.Close()
+	client := c.dial(t)
+	defer client.Close()
+	clientNode := c.assignedNode(t)
+	botNode := c.manager.Reserve("echo")
+	if botNode == nil {
+		t.Fatal("expected a node to be reserved for the bot")
+	}
+	srv := httptest.NewServer(newGraphExporter(c.net, c.manager))
+	defer srv.Close()
+
+	get := func(format string, status int) string {
+		res, err := http.Get(srv.URL + "/topology?format=" + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("expected status %d for format %q, got %s", status, format, res.Status)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	// wait for the ring of three nodes to connect
+	var graph networkGraph
+	timeout := time.After(10 * time.Second)
+	for {
+		graph = networkGraph{}
+		if err := json.Unmarshal([]byte(get("json", http.StatusOK)), &graph); err != nil {
+			t.Fatal(err)
+		}
+		if len(graph.Edges) == 3 {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for 3 edges, got %d", len(graph.Edges))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	nodes := make(map[string]*graphNode)
+	for _, n := range graph.Nodes {
+		if len(n.OverlayAddr) == 0 || len(n.PubKey) == 0 {
+			t.Fatalf("expected %s to have an overlay address and pss public key", n.Name)
+		}
+		switch n.ID {
+		case clientNode.String():
+			if n.Assignment != "client" {
+				t.Fatalf("expected %s to be assigned to a client, got %q", n.Name, n.Assignment)
+			}
+		case botNode.ID().String():
+			if n.Assignment != "bot" || n.Bot != "echo" {
+				t.Fatalf("expected %s to be reserved for an echo bot, got %q %q", n.Name, n.Assignment, n.Bot)
+			}
+		default:
+			if n.Assignment != "free" {
+				t.Fatalf("expected %s to be free, got %q", n.Name, n.Assignment)
+			}
+		}
+		nodes[n.Name] = n
+	}
+	for _, e := range graph.Edges {
+		po := proximityOrder(nodes[e.One].OverlayAddr, nodes[e.Other].OverlayAddr)
+		if e.Proximity == nil || *e.Proximity != po {
+			t.Fatalf("expected %s - %s to have proximity order %d, got %v", e.One, e.Other, po, e.Proximity)
+		}
+	}
+
+	dot := get("dot", http.StatusOK)
+	if !strings.HasPrefix(dot, "graph ") || strings.Count(dot, " -- ") != 3 {
+		t.Fatalf("expected a DOT graph with 3 edges, got:\n%s", dot)
+	}
+	var doc graphML
+	if err := xml.Unmarshal([]byte(get("graphml", http.StatusOK)), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Graph.Nodes) != 3 || len(doc.Graph.Edges) != 3 {
+		t.Fatalf("expected a GraphML graph with 3 nodes and 3 edges, got %d and %d", len(doc.Graph.Nodes), len(doc.Graph.Edges))
+	}
+	get("png", http.StatusBadRequest)
+}
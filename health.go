@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+)
+
+// healthChecker serves the liveness of the demo process at /healthz and its
+// readiness at /readyz, with the status of each component as JSON
+//
+// The process is live if all its HTTP listeners are up, and ready if it is
+// live, all the nodes it started with are up and connected, the Swarm DPA is
+// started and it is not draining clients before shutting down.
+type healthChecker struct {
+	net   *simulations.Network
+	nodes []discover.NodeID
+
+	mtx        sync.RWMutex
+	listeners  map[string]string
+	dpaStarted bool
+	draining   bool
+}
+
+// componentStatus is the status of a component of the demo
+type componentStatus struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// healthReport is the response served at /healthz and /readyz
+type healthReport struct {
+	OK         bool                        `json:"ok"`
+	Components map[string]*componentStatus `json:"components"`
+}
+
+// newHealthChecker returns a health checker which requires the nodes
+// currently in the network and the given listeners to be up
+func newHealthChecker(net *simulations.Network, listeners ...string) *healthChecker {
+	h := &healthChecker{
+		net:       net,
+		listeners: make(map[string]string, len(listeners)),
+	}
+	for _, node := range net.GetNodes() {
+		h.nodes = append(h.nodes, node.ID())
+	}
+	for _, name := range listeners {
+		h.listeners[name] = ""
+	}
+	return h
+}
+
+// Listen listens on the given TCP address, with the named listener being
+// reported as up until it is closed
+func (h *healthChecker) Listen(name, addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	h.setListener(name, ln.Addr().String())
+	return &healthListener{Listener: ln, health: h, name: name}, nil
+}
+
+func (h *healthChecker) setListener(name, addr string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.listeners[name] = addr
+}
+
+// SetDPAStarted sets whether the Swarm DPA is started
+func (h *healthChecker) SetDPAStarted(started bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.dpaStarted = started
+}
+
+// SetDraining sets whether the demo is draining clients before shutting
+// down, which makes it not ready
+func (h *healthChecker) SetDraining(draining bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.draining = draining
+}
+
+// healthListener is a listener which is reported as down once closed
+type healthListener struct {
+	net.Listener
+	health *healthChecker
+	name   string
+	once   sync.Once
+}
+
+func (l *healthListener) Close() error {
+	l.once.Do(func() { l.health.setListener(l.name, "") })
+	return l.Listener.Close()
+}
+
+// Live returns the liveness of the demo process
+func (h *healthChecker) Live() *healthReport {
+	report := &healthReport{OK: true, Components: make(map[string]*componentStatus)}
+	h.mtx.RLock()
+	for name, addr := range h.listeners {
+		if addr == "" {
+			report.add(name, false, "not listening")
+		} else {
+			report.add(name, true, "listening on "+addr)
+		}
+	}
+	h.mtx.RUnlock()
+	return report
+}
+
+// Ready returns the readiness of the demo process
+func (h *healthChecker) Ready() *healthReport {
+	report := h.Live()
+
+	var down []string
+	for _, id := range h.nodes {
+		if node := h.net.GetNode(id); node == nil {
+			down = append(down, id.TerminalString())
+		} else if !node.Up {
+			down = append(down, node.Config.Name)
+		}
+	}
+	if len(down) > 0 {
+		report.add("nodes", false, fmt.Sprintf("%d/%d nodes down: %s", len(down), len(h.nodes), strings.Join(down, ", ")))
+	} else {
+		report.add("nodes", true, fmt.Sprintf("%d nodes up", len(h.nodes)))
+	}
+
+	if groups := h.partitions(); len(groups) > 1 {
+		sizes := make([]string, len(groups))
+		for i, group := range groups {
+			sizes[i] = fmt.Sprintf("%d", group)
+		}
+		report.add("topology", false, fmt.Sprintf("%d partitions of %s nodes", len(groups), strings.Join(sizes, ", ")))
+	} else {
+		report.add("topology", true, "connected")
+	}
+
+	h.mtx.RLock()
+	if h.dpaStarted {
+		report.add("swarm_dpa", true, "started")
+	} else {
+		report.add("swarm_dpa", false, "not started")
+	}
+	if h.draining {
+		report.add("drain", false, "draining clients before shutting down")
+	}
+	h.mtx.RUnlock()
+	return report
+}
+
+// partitions returns the sizes of the groups of up nodes which are
+// connected to each other
+func (h *healthChecker) partitions() []int {
+	var nodes []*simulations.Node
+	for _, node := range h.net.GetNodes() {
+		if node.Up {
+			nodes = append(nodes, node)
+		}
+	}
+	seen := make(map[discover.NodeID]bool, len(nodes))
+	var groups []int
+	for _, node := range nodes {
+		if seen[node.ID()] {
+			continue
+		}
+		seen[node.ID()] = true
+		size := 0
+		queue := []*simulations.Node{node}
+		for len(queue) > 0 {
+			n := queue[0]
+			queue = queue[1:]
+			size++
+			for _, other := range nodes {
+				if seen[other.ID()] {
+					continue
+				}
+				if conn := h.net.GetConn(n.ID(), other.ID()); conn != nil && conn.Up {
+					seen[other.ID()] = true
+					queue = append(queue, other)
+				}
+			}
+		}
+		groups = append(groups, size)
+	}
+	return groups
+}
+
+func (r *healthReport) add(name string, ok bool, detail string) {
+	r.Components[name] = &componentStatus{OK: ok, Detail: detail}
+	r.OK = r.OK && ok
+}
+
+// ServeHTTP serves the liveness at /healthz and readiness at /readyz, with
+// status 503 if not live or ready
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var report *healthReport
+	switch req.URL.Path {
+	case "/healthz":
+		report = h.Live()
+	case "/readyz":
+		report = h.Ready()
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
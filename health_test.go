@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+)
+
+// TestHealthChecker tests the liveness and readiness of the demo components
+func TestHealthChecker(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "pss-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	net, err := NewPssSimulation(adapters.NewSimAdapter(services), 3, logDir, &keyStore{}, false)
+	if err != nil {
+		t.Fatalf("error creating pss simulation: %s", err)
+	}
+	defer net.Shutdown()
+	h := newHealthChecker(net, "test")
+
+	// check not live or ready until listening and the DPA is started
+	if report := h.Live(); report.OK {
+		t.Fatalf("expected not live before listening: %v", report.Components)
+	}
+	ln, err := h.Listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if report := h.Live(); !report.OK {
+		t.Fatalf("expected live once listening: %v", report.Components["test"])
+	}
+	if report := h.Ready(); report.OK || report.Components["swarm_dpa"].OK {
+		t.Fatal("expected not ready before the DPA is started")
+	}
+	h.SetDPAStarted(true)
+	waitReady(t, h, true, "")
+
+	// check not ready once the ring is broken into two partitions
+	nodes := net.GetNodes()
+	if err := net.Disconnect(nodes[0].ID(), nodes[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := net.Disconnect(nodes[1].ID(), nodes[2].ID()); err != nil {
+		t.Fatal(err)
+	}
+	waitReady(t, h, false, "topology")
+
+	// check not ready when a node is down
+	if err := net.Stop(nodes[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	waitReady(t, h, false, "nodes")
+
+	// check not live once the listener is closed
+	ln.Close()
+	if report := h.Live(); report.OK {
+		t.Fatal("expected not live once the listener is closed")
+	}
+}
+
+// waitReady waits for the health checker to report the given readiness,
+// with the given component being the reason when not ready (connections
+// being established and dropped asynchronously)
+func waitReady(t *testing.T, h *healthChecker, ready bool, component string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		report := h.Ready()
+		if report.OK == ready && (ready || !report.Components[component].OK) {
+			return
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			for name, status := range report.Components {
+				t.Logf("%s: ok=%t %s", name, status.OK, status.Detail)
+			}
+			t.Fatalf("timed out waiting for ready=%t", ready)
+		}
+	}
+}
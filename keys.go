@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// keyStore provides the private keys of simulation nodes, which are loaded
+// from Dir if set, otherwise derived from Seed if set, otherwise randomly
+// generated (with derived and generated keys being saved to Dir if set)
+//
+// Keys are identified by the node name (e.g. "node01") and the kind of key
+// ("p2p" for the devp2p key which determines the node ID and overlay address,
+// "pss" for the pss key), and are stored in Dir as <name>/<kind>.key
+type keyStore struct {
+	Seed string `json:"seed,omitempty"`
+	Dir  string `json:"dir,omitempty"`
+}
+
+// key returns the key of the given kind for the node with the given name
+func (k *keyStore) key(name, kind string) (*ecdsa.PrivateKey, error) {
+	var path string
+	if k.Dir != "" {
+		path = filepath.Join(k.Dir, name, kind+".key")
+		key, err := crypto.LoadECDSA(path)
+		if err == nil {
+			return key, nil
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error loading %s key for %s: %s", kind, name, err)
+		}
+	}
+
+	var key *ecdsa.PrivateKey
+	var err error
+	if k.Seed != "" {
+		key, err = crypto.ToECDSA(crypto.Keccak256([]byte(fmt.Sprintf("%s/%s/%s", k.Seed, name, kind))))
+	} else {
+		key, err = crypto.GenerateKey()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error generating %s key for %s: %s", kind, name, err)
+	}
+
+	if path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := crypto.SaveECDSA(path, key); err != nil {
+			return nil, fmt.Errorf("error saving %s key for %s: %s", kind, name, err)
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TestKeyStore tests that keys are loaded from Dir in preference to being
+// derived from Seed, that derived keys are deterministic and distinct per
+// node name and kind, and that keys are random without a seed
+func TestKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "node01"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := crypto.SaveECDSA(filepath.Join(dir, "node01", "p2p.key"), saved); err != nil {
+		t.Fatal(err)
+	}
+	derivedDir := filepath.Join(dir, "derived")
+
+	type key struct {
+		store      *keyStore
+		name, kind string
+	}
+	for _, test := range []struct {
+		desc       string
+		one, other key
+		same       bool
+	}{
+		{
+			desc:  "same seed, name and kind",
+			one:   key{&keyStore{Seed: "a"}, "node01", "p2p"},
+			other: key{&keyStore{Seed: "a"}, "node01", "p2p"},
+			same:  true,
+		},
+		{
+			desc:  "different seed",
+			one:   key{&keyStore{Seed: "a"}, "node01", "p2p"},
+			other: key{&keyStore{Seed: "b"}, "node01", "p2p"},
+		},
+		{
+			desc:  "different name",
+			one:   key{&keyStore{Seed: "a"}, "node01", "p2p"},
+			other: key{&keyStore{Seed: "a"}, "node02", "p2p"},
+		},
+		{
+			desc:  "different kind",
+			one:   key{&keyStore{Seed: "a"}, "node01", "p2p"},
+			other: key{&keyStore{Seed: "a"}, "node01", "pss"},
+		},
+		{
+			desc:  "saved key loaded from dir",
+			one:   key{&keyStore{Seed: "a", Dir: dir}, "node01", "p2p"},
+			other: key{&keyStore{Dir: dir}, "node01", "p2p"},
+			same:  true,
+		},
+		{
+			desc:  "saved key wins over seed",
+			one:   key{&keyStore{Seed: "a", Dir: dir}, "node01", "p2p"},
+			other: key{&keyStore{Seed: "a"}, "node01", "p2p"},
+		},
+		{
+			desc:  "derived key saved to dir",
+			one:   key{&keyStore{Seed: "a", Dir: derivedDir}, "node02", "pss"},
+			other: key{&keyStore{Dir: derivedDir}, "node02", "pss"},
+			same:  true,
+		},
+		{
+			desc:  "unseeded",
+			one:   key{&keyStore{}, "node01", "p2p"},
+			other: key{&keyStore{}, "node01", "p2p"},
+		},
+	} {
+		one, err := test.one.store.key(test.one.name, test.one.kind)
+		if err != nil {
+			t.Fatalf("%s: %s", test.desc, err)
+		}
+		other, err := test.other.store.key(test.other.name, test.other.kind)
+		if err != nil {
+			t.Fatalf("%s: %s", test.desc, err)
+		}
+		if same := one.D.Cmp(other.D) == 0; same != test.same {
+			t.Fatalf("%s: expected keys to be the same: %t, got %t", test.desc, test.same, same)
+		}
+	}
+
+	// a saved key is used regardless of the seed
+	loaded, err := (&keyStore{Seed: "b", Dir: dir}).key("node01", "p2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.D.Cmp(saved.D) != 0 {
+		t.Fatal("expected the saved key to be loaded from dir")
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// linkPacketSize is the size of the packets data is assumed to be sent in
+// when applying the loss rate of a link
+const linkPacketSize = 1460
+
+// linkMinRetransmit is the minimum time before lost data is retransmitted
+// (the minimum TCP retransmission timeout on Linux)
+const linkMinRetransmit = 200 * time.Millisecond
+
+// LinkImpairment is the emulated delay, jitter, loss rate and bandwidth of a
+// link between two nodes, with the zero value being an unimpaired link
+//
+// Links are reliable streams like TCP, so rather than data being lost, data
+// which would have been lost is delivered after a retransmission timeout of
+// twice the link's maximum delay (but at least 200ms).
+type LinkImpairment struct {
+	// Delay is the one way delay of data sent over the link
+	Delay duration `json:"delay"`
+
+	// Jitter is the maximum random variation of the delay
+	Jitter duration `json:"jitter"`
+
+	// Loss is the fraction of packets which are lost, from 0 to 1
+	Loss float64 `json:"loss"`
+
+	// Bandwidth is the throughput limit of each direction in kbit/s, with
+	// 0 meaning unlimited
+	Bandwidth int `json:"bandwidth"`
+}
+
+// validate checks the impairment settings are in range
+func (l *LinkImpairment) validate() error {
+	switch {
+	case l.Delay < 0:
+		return fmt.Errorf("delay must not be negative, got %s", time.Duration(l.Delay))
+	case l.Jitter < 0:
+		return fmt.Errorf("jitter must not be negative, got %s", time.Duration(l.Jitter))
+	case l.Loss < 0 || l.Loss >= 1:
+		return fmt.Errorf("loss must be at least 0 and less than 1, got %v", l.Loss)
+	case l.Bandwidth < 0:
+		return fmt.Errorf("bandwidth must not be negative, got %d", l.Bandwidth)
+	}
+	return nil
+}
+
+// schedule returns when data of the given size which is written at now
+// would arrive, given that the link is busy transmitting earlier data until
+// busy, returning the new busy time
+func (l *LinkImpairment) schedule(size int, now, busy time.Time) (arrive, newBusy time.Time) {
+	if busy.Before(now) {
+		busy = now
+	}
+	if l.Bandwidth > 0 {
+		busy = busy.Add(time.Duration(size) * 8 * time.Second / time.Duration(l.Bandwidth*1000))
+	}
+	delay := time.Duration(l.Delay)
+	if l.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * float64(l.Jitter))
+		if delay < 0 {
+			delay = 0
+		}
+	}
+	arrive = busy.Add(delay)
+	if l.Loss > 0 {
+		packets := (size + linkPacketSize - 1) / linkPacketSize
+		if rand.Float64() < 1-math.Pow(1-l.Loss, float64(packets)) {
+			retransmit := 2 * time.Duration(l.Delay+l.Jitter)
+			if retransmit < linkMinRetransmit {
+				retransmit = linkMinRetransmit
+			}
+			arrive = arrive.Add(retransmit)
+		}
+	}
+	return arrive, busy
+}
+
+// nodeLinks are the impairments of the links a node dials, keyed by peer,
+// with Default applying to the links to other peers
+type nodeLinks struct {
+	mtx     sync.RWMutex
+	current LinkImpairments
+	blocked map[discover.NodeID]bool
+}
+
+// LinkImpairments is the default impairment of a node's links along with
+// those of the links to particular peers, and the peers which the node
+// must not dial as they are in another partition of the network
+type LinkImpairments struct {
+	Default LinkImpairment                     `json:"default"`
+	Peers   map[discover.NodeID]LinkImpairment `json:"peers,omitempty"`
+	Blocked []discover.NodeID                  `json:"blocked,omitempty"`
+}
+
+func (n *nodeLinks) Get(peer discover.NodeID) LinkImpairment {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+	if l, ok := n.current.Peers[peer]; ok {
+		return l
+	}
+	return n.current.Default
+}
+
+// Blocked returns whether dialling the peer is blocked
+func (n *nodeLinks) Blocked(peer discover.NodeID) bool {
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+	return n.blocked[peer]
+}
+
+// LinkAPI is the link_ RPC API which the demo uses to set the impairment of
+// the links a node dials
+type LinkAPI struct {
+	links *nodeLinks
+}
+
+// SetImpairments replaces the impairments of the node's links, which also
+// applies to existing connections
+func (api *LinkAPI) SetImpairments(links LinkImpairments) error {
+	if err := links.Default.validate(); err != nil {
+		return err
+	}
+	for _, l := range links.Peers {
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+	blocked := make(map[discover.NodeID]bool, len(links.Blocked))
+	for _, id := range links.Blocked {
+		blocked[id] = true
+	}
+	api.links.mtx.Lock()
+	defer api.links.mtx.Unlock()
+	api.links.current = links
+	api.links.blocked = blocked
+	return nil
+}
+
+// Impairments returns the impairments of the node's links
+func (api *LinkAPI) Impairments() LinkImpairments {
+	api.links.mtx.RLock()
+	defer api.links.mtx.RUnlock()
+	return api.links.current
+}
+
+// impairedDialer wraps the connections of a dialer in an impairedConn,
+// failing to dial blocked peers
+type impairedDialer struct {
+	p2p.NodeDialer
+	links *nodeLinks
+}
+
+func (d *impairedDialer) Dial(dest *discover.Node) (net.Conn, error) {
+	if d.links.Blocked(dest.ID) {
+		return nil, fmt.Errorf("link to %s is partitioned", dest.ID.TerminalString())
+	}
+	conn, err := d.NodeDialer.Dial(dest)
+	if err != nil {
+		return nil, err
+	}
+	return newImpairedConn(conn, func() LinkImpairment { return d.links.Get(dest.ID) }), nil
+}
+
+// impairedConn is a net.Conn which delays the data written to and read from
+// the underlying connection as if it were sent over an impaired link, so
+// that impairing the dialling end of a connection impairs both directions
+//
+// Data is written and read in the background using unbounded buffers, so
+// deadlines are ignored.
+type impairedConn struct {
+	net.Conn
+
+	link func() LinkImpairment
+	out  *linkQueue
+	in   *linkQueue
+
+	mtx  sync.Mutex
+	cond *sync.Cond
+	rbuf bytes.Buffer
+	rerr error
+}
+
+// errLinkClosed is returned when writing to a closed impairedConn
+var errLinkClosed = errors.New("use of closed impaired connection")
+
+func newImpairedConn(conn net.Conn, link func() LinkImpairment) *impairedConn {
+	c := &impairedConn{
+		Conn: conn,
+		link: link,
+		out:  newLinkQueue(),
+		in:   newLinkQueue(),
+	}
+	c.cond = sync.NewCond(&c.mtx)
+	go c.out.run(func(data []byte) error {
+		_, err := c.Conn.Write(data)
+		return err
+	})
+	go c.in.run(func(data []byte) error {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		c.rbuf.Write(data)
+		c.cond.Broadcast()
+		return nil
+	})
+	go c.readLoop()
+	return c
+}
+
+func (c *impairedConn) Read(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for c.rbuf.Len() == 0 && c.rerr == nil {
+		c.cond.Wait()
+	}
+	if c.rbuf.Len() > 0 {
+		return c.rbuf.Read(p)
+	}
+	return 0, c.rerr
+}
+
+func (c *impairedConn) Write(p []byte) (int, error) {
+	if err := c.out.push(p, c.link()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *impairedConn) Close() error {
+	c.out.close()
+	c.in.close()
+	c.mtx.Lock()
+	if c.rerr == nil {
+		c.rerr = errLinkClosed
+	}
+	c.cond.Broadcast()
+	c.mtx.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *impairedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *impairedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *impairedConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// readLoop reads from the underlying connection into the inbound queue,
+// with read errors being returned by Read once the data read before them
+// has been delivered
+func (c *impairedConn) readLoop() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			c.in.push(buf[:n], c.link())
+		}
+		if err != nil {
+			c.in.finish(func() {
+				c.mtx.Lock()
+				defer c.mtx.Unlock()
+				c.rerr = err
+				c.cond.Broadcast()
+			})
+			return
+		}
+	}
+}
+
+// linkQueue delivers data in the order it was pushed at the time it would
+// arrive over an impaired link
+type linkQueue struct {
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	queue  []*linkData
+	busy   time.Time
+	last   time.Time
+	err    error
+	closed bool
+	quit   chan struct{}
+}
+
+type linkData struct {
+	data   []byte
+	arrive time.Time
+	done   func()
+}
+
+func newLinkQueue() *linkQueue {
+	q := &linkQueue{quit: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mtx)
+	return q
+}
+
+// push queues a copy of data for delivery according to the impairment
+func (q *linkQueue) push(data []byte, link LinkImpairment) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if q.closed {
+		return errLinkClosed
+	}
+	arrive, busy := link.schedule(len(data), time.Now(), q.busy)
+	q.busy = busy
+	// data is delivered in order, as over a TCP connection
+	if arrive.Before(q.last) {
+		arrive = q.last
+	}
+	q.last = arrive
+	q.queue = append(q.queue, &linkData{data: append([]byte(nil), data...), arrive: arrive})
+	q.cond.Broadcast()
+	return nil
+}
+
+// finish calls f once the data pushed so far has been delivered
+func (q *linkQueue) finish(f func()) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return
+	}
+	q.queue = append(q.queue, &linkData{arrive: q.last, done: f})
+	q.cond.Broadcast()
+}
+
+func (q *linkQueue) close() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.quit)
+		q.cond.Broadcast()
+	}
+}
+
+// run delivers the queued data until the queue is closed or deliver fails
+func (q *linkQueue) run(deliver func([]byte) error) {
+	for {
+		q.mtx.Lock()
+		for len(q.queue) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mtx.Unlock()
+			return
+		}
+		d := q.queue[0]
+		q.mtx.Unlock()
+
+		if wait := d.arrive.Sub(time.Now()); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-q.quit:
+				return
+			}
+		}
+
+		q.mtx.Lock()
+		q.queue = q.queue[1:]
+		q.mtx.Unlock()
+		if len(d.data) > 0 {
+			if err := deliver(d.data); err != nil {
+				q.mtx.Lock()
+				q.err = err
+				q.queue = nil
+				q.mtx.Unlock()
+				return
+			}
+		}
+		if d.done != nil {
+			d.done()
+		}
+	}
+}
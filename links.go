@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+)
+
+// linkManager emulates real-world links between the nodes of a network by
+// setting the impairment of each node's links using the node's link API,
+// with the impairment of a link being (in order of precedence) that set for
+// the link with Set, that of the regions of its nodes in the region matrix,
+// or the default
+//
+// It also blocks nodes from dialling nodes in other groups while the network
+// is partitioned (see partitioner).
+type linkManager struct {
+	net  *simulations.Network
+	quit chan struct{}
+
+	mtx     sync.Mutex
+	def     LinkImpairment
+	regions map[string]string
+	matrix  map[string]map[string]*LinkImpairment
+	links   map[linkKey]LinkImpairment
+	groups  map[discover.NodeID]int
+
+	// pushMtx serializes setting the impairments of nodes so that they
+	// are not set out of order
+	pushMtx sync.Mutex
+}
+
+// linkKey identifies a link, with the lowest node ID first
+type linkKey [2]discover.NodeID
+
+func newLinkKey(one, other discover.NodeID) linkKey {
+	if bytes.Compare(one[:], other[:]) > 0 {
+		one, other = other, one
+	}
+	return linkKey{one, other}
+}
+
+func newLinkManager(net *simulations.Network, config *linkConfig) *linkManager {
+	return &linkManager{
+		net:     net,
+		quit:    make(chan struct{}),
+		def:     config.Default(),
+		regions: config.Regions,
+		matrix:  config.Matrix,
+		links:   make(map[linkKey]LinkImpairment),
+	}
+}
+
+// Run sets the impairments of the network's nodes, and those of nodes
+// which start later, until Stop is called
+func (m *linkManager) Run() {
+	events := make(chan *simulations.Event)
+	sub := m.net.Events().Subscribe(events)
+	defer sub.Unsubscribe()
+	m.pushAll()
+	for {
+		select {
+		case event := <-events:
+			if event.Type == simulations.EventTypeNode && event.Node.Up {
+				go m.push(event.Node)
+			}
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+func (m *linkManager) Stop() {
+	close(m.quit)
+}
+
+// Impairment returns the impairment of the link between two nodes
+func (m *linkManager) Impairment(one, other *simulations.Node) LinkImpairment {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.impairment(one, other)
+}
+
+// impairment returns the impairment of the link between two nodes (the
+// caller must hold m.mtx)
+func (m *linkManager) impairment(one, other *simulations.Node) LinkImpairment {
+	if l, ok := m.links[newLinkKey(one.ID(), other.ID())]; ok {
+		return l
+	}
+	r1, ok1 := m.regions[one.Config.Name]
+	r2, ok2 := m.regions[other.Config.Name]
+	if ok1 && ok2 {
+		if l, ok := m.matrix[r1][r2]; ok {
+			return *l
+		}
+		if l, ok := m.matrix[r2][r1]; ok {
+			return *l
+		}
+	}
+	return m.def
+}
+
+// blocked returns whether the link between two nodes is blocked by a
+// partition, with nodes which are not in a group not being blocked (the
+// caller must hold m.mtx)
+func (m *linkManager) blocked(one, other *simulations.Node) bool {
+	g1, ok1 := m.groups[one.ID()]
+	g2, ok2 := m.groups[other.ID()]
+	return ok1 && ok2 && g1 != g2
+}
+
+// SetDefault sets the impairment of links without their own settings
+func (m *linkManager) SetDefault(l LinkImpairment) {
+	m.mtx.Lock()
+	m.def = l
+	m.mtx.Unlock()
+	m.pushAll()
+}
+
+// Set sets the impairment of the link between two nodes
+func (m *linkManager) Set(one, other *simulations.Node, l LinkImpairment) {
+	m.mtx.Lock()
+	m.links[newLinkKey(one.ID(), other.ID())] = l
+	m.mtx.Unlock()
+	m.push(one)
+	m.push(other)
+}
+
+// Reset removes the settings of the link between two nodes so that it has
+// the impairment of its regions or the default
+func (m *linkManager) Reset(one, other *simulations.Node) {
+	m.mtx.Lock()
+	delete(m.links, newLinkKey(one.ID(), other.ID()))
+	m.mtx.Unlock()
+	m.push(one)
+	m.push(other)
+}
+
+// SetGroups blocks links between nodes in different groups, with groups
+// mapping node IDs to group indexes (nil unblocks all links)
+func (m *linkManager) SetGroups(groups map[discover.NodeID]int) {
+	m.mtx.Lock()
+	m.groups = groups
+	m.mtx.Unlock()
+	m.pushAll()
+}
+
+func (m *linkManager) pushAll() {
+	for _, node := range m.net.GetNodes() {
+		m.push(node)
+	}
+}
+
+// push sets the impairments of the node's links to the other nodes, which
+// are applied to the connections the node dials (so that whichever node
+// dials a connection applies the impairment to both directions)
+func (m *linkManager) push(node *simulations.Node) {
+	m.pushMtx.Lock()
+	defer m.pushMtx.Unlock()
+	if !node.Up {
+		return
+	}
+	m.mtx.Lock()
+	links := LinkImpairments{Default: m.def, Peers: make(map[discover.NodeID]LinkImpairment)}
+	for _, peer := range m.net.GetNodes() {
+		if peer.ID() == node.ID() {
+			continue
+		}
+		if l := m.impairment(node, peer); l != m.def {
+			links.Peers[peer.ID()] = l
+		}
+		if m.blocked(node, peer) {
+			links.Blocked = append(links.Blocked, peer.ID())
+		}
+	}
+	m.mtx.Unlock()
+	client, err := node.Client()
+	if err == nil {
+		err = client.Call(nil, "link_setImpairments", links)
+	}
+	if err != nil {
+		log.Warn("error setting link impairments", "node", node.Config.Name, "err", err)
+	}
+}
+
+// linkEntry is the impairment of a link served by the /links endpoints
+type linkEntry struct {
+	One        string         `json:"one"`
+	Other      string         `json:"other"`
+	Impairment LinkImpairment `json:"impairment"`
+}
+
+// linkStatus is the link settings served at /links
+type linkStatus struct {
+	Default LinkImpairment                        `json:"default"`
+	Regions map[string]string                     `json:"regions,omitempty"`
+	Matrix  map[string]map[string]*LinkImpairment `json:"matrix,omitempty"`
+	Links   []*linkEntry                          `json:"links"`
+}
+
+// Status returns the default impairment, the region matrix and the links
+// with their own settings
+func (m *linkManager) Status() *linkStatus {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	status := &linkStatus{
+		Default: m.def,
+		Regions: m.regions,
+		Matrix:  m.matrix,
+		Links:   []*linkEntry{},
+	}
+	for key, l := range m.links {
+		one, other := m.net.GetNode(key[0]), m.net.GetNode(key[1])
+		if one == nil || other == nil {
+			continue
+		}
+		status.Links = append(status.Links, &linkEntry{One: one.Config.Name, Other: other.Config.Name, Impairment: l})
+	}
+	return status
+}
+
+// ServeHTTP serves the link endpoints on the simulation API port:
+//
+//	GET    /links               the default, region and link settings
+//	PUT    /links               set the default impairment
+//	GET    /links/ONE/OTHER     the impairment of the link between two nodes
+//	PUT    /links/ONE/OTHER     set the impairment of the link
+//	DELETE /links/ONE/OTHER     remove the link's own settings
+//
+// with nodes identified by name or ID, and the PUT body being a JSON
+// impairment, for example {"delay":"80ms","jitter":"10ms","loss":0.01,
+// "bandwidth":1000}.
+func (m *linkManager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/links"), "/")
+	if path == "" {
+		switch req.Method {
+		case "GET":
+		case "PUT", "POST":
+			l, err := readLinkImpairment(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			m.SetDefault(l)
+			log.Info("set default link impairment", "delay", time.Duration(l.Delay), "jitter", time.Duration(l.Jitter), "loss", l.Loss, "bandwidth", l.Bandwidth)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.Status())
+		return
+	}
+
+	names := strings.Split(path, "/")
+	if len(names) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	var nodes [2]*simulations.Node
+	for i, name := range names {
+		nodes[i] = m.node(name)
+		if nodes[i] == nil {
+			http.Error(w, fmt.Sprintf("unknown node %q", name), http.StatusNotFound)
+			return
+		}
+	}
+	if nodes[0] == nodes[1] {
+		http.Error(w, "a link must be between two different nodes", http.StatusBadRequest)
+		return
+	}
+	one, other := nodes[0], nodes[1]
+	switch req.Method {
+	case "GET":
+	case "PUT", "POST":
+		l, err := readLinkImpairment(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Set(one, other, l)
+		log.Info("set link impairment", "one", one.Config.Name, "other", other.Config.Name, "delay", time.Duration(l.Delay), "jitter", time.Duration(l.Jitter), "loss", l.Loss, "bandwidth", l.Bandwidth)
+	case "DELETE":
+		m.Reset(one, other)
+		log.Info("reset link impairment", "one", one.Config.Name, "other", other.Config.Name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&linkEntry{
+		One:        one.Config.Name,
+		Other:      other.Config.Name,
+		Impairment: m.Impairment(one, other),
+	})
+}
+
+// node returns the node with the given name or ID, or nil if there is none
+func (m *linkManager) node(name string) *simulations.Node {
+	if node := m.net.GetNodeByName(name); node != nil {
+		return node
+	}
+	if id, err := discover.HexID(name); err == nil {
+		return m.net.GetNode(id)
+	}
+	return nil
+}
+
+// readLinkImpairment reads a JSON link impairment from a request body
+func readLinkImpairment(r io.Reader) (LinkImpairment, error) {
+	var l LinkImpairment
+	if err := json.NewDecoder(io.LimitReader(r, 4096)).Decode(&l); err != nil {
+		return l, fmt.Errorf("invalid link impairment: %s", err)
+	}
+	return l, l.validate()
+}
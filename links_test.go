@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestLinkSchedule tests the arrival times of data sent over impaired links
+func TestLinkSchedule(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		link   LinkImpairment
+		size   int
+		busy   time.Time
+		arrive time.Duration
+	}{
+		{LinkImpairment{}, 1000, now, 0},
+		{LinkImpairment{Delay: duration(50 * time.Millisecond)}, 1000, now, 50 * time.Millisecond},
+		// 10 kbit takes a second at 10 kbit/s
+		{LinkImpairment{Bandwidth: 10}, 1250, now, time.Second},
+		// the link is busy for another second with earlier data
+		{LinkImpairment{Bandwidth: 10}, 1250, now.Add(time.Second), 2 * time.Second},
+		// lost data is retransmitted after twice the delay
+		{LinkImpairment{Delay: duration(150 * time.Millisecond), Loss: 0.9999999}, 1000, now, 450 * time.Millisecond},
+		// or at least the minimum retransmission timeout
+		{LinkImpairment{Loss: 0.9999999}, 1000, now, linkMinRetransmit},
+	} {
+		arrive, _ := test.link.schedule(test.size, now, test.busy)
+		if d := arrive.Sub(now); d != test.arrive {
+			t.Fatalf("expected %+v to arrive after %s, got %s", test.link, test.arrive, d)
+		}
+	}
+
+	link := LinkImpairment{Delay: duration(50 * time.Millisecond), Jitter: duration(10 * time.Millisecond)}
+	for i := 0; i < 100; i++ {
+		arrive, _ := link.schedule(100, now, now)
+		if d := arrive.Sub(now); d < 40*time.Millisecond || d > 60*time.Millisecond {
+			t.Fatalf("expected delay with jitter to be between 40ms and 60ms, got %s", d)
+		}
+	}
+}
+
+// TestImpairedConn tests that data written to and read from an impaired
+// connection is delayed
+func TestImpairedConn(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	c1, c2 := net.Pipe()
+	conn := newImpairedConn(c1, func() LinkImpairment {
+		return LinkImpairment{Delay: duration(delay)}
+	})
+	defer conn.Close()
+	defer c2.Close()
+
+	read := func(r net.Conn, expected string) time.Duration {
+		start := time.Now()
+		buf := make([]byte, len(expected))
+		if _, err := r.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != expected {
+			t.Fatalf("expected %q, got %q", expected, buf)
+		}
+		return time.Since(start)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if d := read(c2, "ping"); d < delay {
+		t.Fatalf("expected write to be delayed by %s, got %s", delay, d)
+	}
+	go c2.Write([]byte("pong"))
+	if d := read(conn, "pong"); d < delay {
+		t.Fatalf("expected read to be delayed by %s, got %s", delay, d)
+	}
+
+	// check the read error is returned once the data before it is read
+	go func() {
+		c2.Write([]byte("bye"))
+		c2.Close()
+	}()
+	read(conn, "bye")
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected an error reading from the closed connection")
+	}
+}
+
+// TestLinkManager tests setting the impairment of links with the /links
+// endpoints
+func TestLinkManager(t *testing.T) {
+	net := newTestNetwork(t, 3, false)
+	defer net.Close()
+	links := net.startLinks(&linkConfig{
+		Delay:   duration(5 * time.Millisecond),
+		Regions: map[string]string{"node01": "eu", "node02": "eu", "node03": "us"},
+		Matrix: map[string]map[string]*LinkImpairment{
+			"eu": {"us": {Delay: duration(80 * time.Millisecond)}},
+		},
+	})
+	srv := httptest.NewServer(links)
+	defer srv.Close()
+
+	request := func(method, path, body string, status int) *linkEntry {
+		entry := &linkEntry{}
+		testRequest(t, srv, method, path, body, status, entry)
+		return entry
+	}
+	// nodeDelay returns the delay node01 applies to the link to node02
+	nodeDelay := func() time.Duration {
+		client, err := net.GetNodeByName("node01").Client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var impairments LinkImpairments
+		if err := client.Call(&impairments, "link_impairments"); err != nil {
+			t.Fatal(err)
+		}
+		if l, ok := impairments.Peers[net.GetNodeByName("node02").ID()]; ok {
+			return time.Duration(l.Delay)
+		}
+		return time.Duration(impairments.Default.Delay)
+	}
+
+	if l := request("GET", "/links/node01/node02", "", http.StatusOK); l.Impairment.Delay != duration(5*time.Millisecond) {
+		t.Fatalf("expected the default delay, got %+v", l)
+	}
+	if l := request("GET", "/links/node03/node01", "", http.StatusOK); l.Impairment.Delay != duration(80*time.Millisecond) {
+		t.Fatalf("expected the region delay, got %+v", l)
+	}
+	request("PUT", "/links/node01/node02", `{"delay":"40ms","loss":0.1}`, http.StatusOK)
+	if l := request("GET", "/links/node02/node01", "", http.StatusOK); l.Impairment.Delay != duration(40*time.Millisecond) || l.Impairment.Loss != 0.1 {
+		t.Fatalf("expected the link's own settings, got %+v", l)
+	}
+	if d := nodeDelay(); d != 40*time.Millisecond {
+		t.Fatalf("expected node01 to delay the link by 40ms, got %s", d)
+	}
+	request("DELETE", "/links/node01/node02", "", http.StatusOK)
+	request("PUT", "/links", `{"delay":"20ms"}`, http.StatusOK)
+	if d := nodeDelay(); d != 20*time.Millisecond {
+		t.Fatalf("expected node01 to delay the link by the new default of 20ms, got %s", d)
+	}
+
+	request("PUT", "/links/node01/node02", `{"loss":2}`, http.StatusBadRequest)
+	request("PUT", "/links/node01/node01", `{}`, http.StatusBadRequest)
+	request("GET", "/links/node01/node04", "", http.StatusNotFound)
+}
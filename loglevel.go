@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+)
+
+// logLevelNames are the names of log levels accepted in config and by the
+// admin API, indexed by level
+var logLevelNames = []string{"crit", "error", "warn", "info", "debug", "trace"}
+
+// parseLogLevel parses a log level name
+func parseLogLevel(name string) (log.Lvl, error) {
+	lvl, err := log.LvlFromString(name)
+	if err != nil {
+		return 0, fmt.Errorf("invalid log level %q, must be one of trace, debug, info, warn, error or crit", name)
+	}
+	return lvl, nil
+}
+
+// parseLogFormat returns the log format with the given name (json, logfmt or
+// terminal), with the terminal format using colours if color is set
+func parseLogFormat(name string, color bool) (log.Format, error) {
+	switch name {
+	case "json":
+		return log.JsonFormat(), nil
+	case "logfmt":
+		return log.LogfmtFormat(), nil
+	case "terminal":
+		return log.TerminalFormat(color), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be json, logfmt or terminal", name)
+	}
+}
+
+// checkVmodule checks the syntax of a vmodule pattern
+func checkVmodule(pattern string) error {
+	return log.NewGlogHandler(log.DiscardHandler()).Vmodule(pattern)
+}
+
+// logLevel is a log handler whose verbosity and per-module verbosity can be
+// changed at runtime, with the vmodule pattern being a comma separated list
+// of PATTERN=LEVEL using numeric levels (e.g. "pss/*=5,p2p=4")
+type logLevel struct {
+	glog *log.GlogHandler
+
+	mtx    sync.Mutex
+	status LogLevelStatus
+}
+
+// LogLevelStatus is the verbosity and vmodule pattern of a logLevel
+type LogLevelStatus struct {
+	Level   string `json:"level"`
+	Vmodule string `json:"vmodule"`
+}
+
+func newLogLevel(h log.Handler, level log.Lvl, vmodule string) (*logLevel, error) {
+	l := &logLevel{glog: log.NewGlogHandler(h)}
+	if err := l.Set(level, vmodule); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logLevel) Log(r *log.Record) error {
+	return l.glog.Log(r)
+}
+
+// Set sets the verbosity and vmodule pattern
+func (l *logLevel) Set(level log.Lvl, vmodule string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if err := l.glog.Vmodule(vmodule); err != nil {
+		return err
+	}
+	l.glog.Verbosity(level)
+	l.status = LogLevelStatus{Level: logLevelNames[level], Vmodule: vmodule}
+	return nil
+}
+
+// SetLevel sets the verbosity, leaving the vmodule pattern unchanged
+func (l *logLevel) SetLevel(level log.Lvl) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.glog.Verbosity(level)
+	l.status.Level = logLevelNames[level]
+}
+
+// SetVmodule sets the vmodule pattern, leaving the verbosity unchanged
+func (l *logLevel) SetVmodule(vmodule string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if err := l.glog.Vmodule(vmodule); err != nil {
+		return err
+	}
+	l.status.Vmodule = vmodule
+	return nil
+}
+
+// Status returns the verbosity and vmodule pattern
+func (l *logLevel) Status() LogLevelStatus {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.status
+}
+
+// nodeLogLevel is the log level of an exec node process, which replaces the
+// root log handler installed by the exec adapter (which always logs at info
+// level in logfmt) with one using the configured level and format
+var nodeLogLevel struct {
+	once  sync.Once
+	level *logLevel
+	err   error
+}
+
+// setupNodeLogging sets the log format and level of the exec node process it
+// is called in, with every record being tagged with the node's ID and name,
+// returning nil for sim nodes as they log through the demo's handler
+//
+// The exec adapter reads the node's RPC address from its "WebSocket endpoint
+// opened" log line, which is therefore logged regardless of the level.
+func setupNodeLogging(config *nodeLogConfig, id discover.NodeID, name string) (*logLevel, error) {
+	if os.Args[0] != "p2p-node" {
+		return nil, nil
+	}
+	nodeLogLevel.once.Do(func() {
+		nodeLogLevel.level, nodeLogLevel.err = newNodeLogLevel(config, id, name)
+	})
+	return nodeLogLevel.level, nodeLogLevel.err
+}
+
+func newNodeLogLevel(config *nodeLogConfig, id discover.NodeID, name string) (*logLevel, error) {
+	format, err := parseLogFormat(config.Format, false)
+	if err != nil {
+		return nil, err
+	}
+	lvl, err := parseLogLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	h := log.StreamHandler(os.Stderr, format)
+	l, err := newLogLevel(h, lvl, config.Vmodule)
+	if err != nil {
+		return nil, err
+	}
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		r.Ctx = append([]interface{}{"node_id", id.String(), "node_name", name}, r.Ctx...)
+		if strings.HasPrefix(r.Msg, "WebSocket endpoint opened") {
+			return h.Log(r)
+		}
+		return l.Log(r)
+	}))
+	return l, nil
+}
+
+// NodeDebugAPI overrides the debug_verbosity and debug_vmodule RPC methods of
+// exec nodes, as the node's built in methods change a log handler which the
+// exec adapter does not use, and adds debug_logLevel to get the current level
+type NodeDebugAPI struct {
+	level *logLevel
+}
+
+// Verbosity sets the log verbosity, with levels from 0 (crit) to 5 (trace)
+func (api *NodeDebugAPI) Verbosity(level int) error {
+	if level < int(log.LvlCrit) || level > int(log.LvlTrace) {
+		return fmt.Errorf("invalid log level %d, must be between 0 (crit) and 5 (trace)", level)
+	}
+	api.level.SetLevel(log.Lvl(level))
+	return nil
+}
+
+// Vmodule sets the log verbosity pattern
+func (api *NodeDebugAPI) Vmodule(pattern string) error {
+	return api.level.SetVmodule(pattern)
+}
+
+// LogLevel returns the log verbosity and verbosity pattern
+func (api *NodeDebugAPI) LogLevel() LogLevelStatus {
+	return api.level.Status()
+}
+
+// logAdmin serves the log level of the demo and of nodes at /admin/log:
+//
+//	GET  /admin/log            - the demo's log level
+//	POST /admin/log            - set the demo's log level
+//	GET  /admin/log?node=NAME  - a node's log level
+//	POST /admin/log?node=NAME  - set a node's log level via its debug_ RPC
+//
+// Levels are set with the level (e.g. debug) and vmodule (e.g. pss/*=5)
+// query parameters, with omitted parameters being left unchanged, and the
+// resulting level is returned as JSON.
+type logAdmin struct {
+	demo *logLevel
+	net  *simulations.Network
+}
+
+func newLogAdmin(demo *logLevel, net *simulations.Network) *logAdmin {
+	return &logAdmin{demo: demo, net: net}
+}
+
+func (a *logAdmin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/admin/log" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	var level *log.Lvl
+	if s := query.Get("level"); s != "" {
+		lvl, err := parseLogLevel(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level = &lvl
+	}
+	vmodule, setVmodule := query["vmodule"]
+	if setVmodule {
+		if err := checkVmodule(vmodule[0]); err != nil {
+			http.Error(w, fmt.Sprintf("invalid vmodule %q: %s", vmodule[0], err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var status LogLevelStatus
+	if name := query.Get("node"); name != "" {
+		node := a.net.GetNodeByName(name)
+		if node == nil {
+			http.Error(w, fmt.Sprintf("unknown node %q", name), http.StatusNotFound)
+			return
+		}
+		client, err := node.Client()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if req.Method == "POST" {
+			if level != nil {
+				err = client.Call(nil, "debug_verbosity", int(*level))
+			}
+			if err == nil && setVmodule {
+				err = client.Call(nil, "debug_vmodule", vmodule[0])
+			}
+		}
+		if err == nil {
+			err = client.Call(&status, "debug_logLevel")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.Method == "POST" {
+			log.Info("set node log level", "node", name, "level", status.Level, "vmodule", status.Vmodule)
+		}
+	} else {
+		if req.Method == "POST" {
+			if level != nil {
+				a.demo.SetLevel(*level)
+			}
+			if setVmodule {
+				a.demo.SetVmodule(vmodule[0])
+			}
+		}
+		status = a.demo.Status()
+		if req.Method == "POST" {
+			log.Info("set demo log level", "level", status.Level, "vmodule", status.Vmodule)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
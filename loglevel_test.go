@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// TestLogAdmin tests changing the demo's log level at runtime
+func TestLogAdmin(t *testing.T) {
+	var logged []string
+	level, err := newLogLevel(log.FuncHandler(func(r *log.Record) error {
+		logged = append(logged, r.Msg)
+		return nil
+	}), log.LvlInfo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(level)
+
+	srv := httptest.NewServer(newLogAdmin(level, nil))
+	defer srv.Close()
+	request := func(method, query string, expected LogLevelStatus) {
+		req, _ := http.NewRequest(method, srv.URL+"/admin/log"+query, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status for %s %q: %s", method, query, res.Status)
+		}
+		var status LogLevelStatus
+		if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status != expected {
+			t.Fatalf("expected %s %q to return %+v, got %+v", method, query, expected, status)
+		}
+	}
+
+	request("GET", "", LogLevelStatus{Level: "info"})
+	logger.Debug("hidden")
+	logger.Info("shown")
+	request("POST", "?level=debug", LogLevelStatus{Level: "debug"})
+	logger.Debug("debug shown")
+	logger.Trace("hidden")
+	request("POST", "?vmodule=pss-demo/*=5", LogLevelStatus{Level: "debug", Vmodule: "pss-demo/*=5"})
+	request("POST", "?level=warn&vmodule=", LogLevelStatus{Level: "warn"})
+	logger.Info("hidden")
+	logger.Warn("warning shown")
+	expected := []string{"shown", "debug shown", "warning shown"}
+	if len(logged) != len(expected) {
+		t.Fatalf("expected %v to be logged, got %v", expected, logged)
+	}
+	for i, msg := range expected {
+		if logged[i] != msg {
+			t.Fatalf("expected %v to be logged, got %v", expected, logged)
+		}
+	}
+
+	for _, query := range []string{"?level=loud", "?vmodule=pss"} {
+		res, err := http.Post(srv.URL+"/admin/log"+query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %q, got %s", query, res.Status)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/ethereum/go-ethereum/log"
@@ -20,16 +24,63 @@ import (
 )
 
 var usage = `
-usage: pss-demo [options]
+usage:
+  pss-demo [options]
+  pss-demo partition [options] (--prefix-bits=BITS | <group>...)
+  pss-demo heal [options]
 
 options:
-  -p, --pss-port=PORT      Conn manager WebSocket port [default: 8080]
-  -s, --swarm-port=PORT    Swarm HTTP gateway port [default: 8500]
-  -n, --net-port=PORT      Simulation API port [default: 8888]
-  -a, --net-addr=ADDR      Simulation node listen address [default: 127.0.0.1]
-  -d, --swarm-dir=DIR      Swarm data directory [default: swarm]
-  -n, --node-count=COUNT   Initial number of pss nodes to start [default: 10]
-  -l, --log-dir=DIR        Directory to store node logs [default: log]
+  -c, --config=FILE        Load the config from a JSON or TOML (.toml) file
+  --print-config           Print the effective config as JSON and exit
+  -p, --pss-port=PORT      Conn manager WebSocket port (default 8080)
+  -s, --swarm-port=PORT    Swarm HTTP gateway port (default 8500)
+  --net-port=PORT          Simulation API port (default 8888)
+  -a, --net-addr=ADDR      Simulation node listen address (default 127.0.0.1)
+  -d, --swarm-dir=DIR      Swarm data directory (default swarm)
+  --swarm-nodes=COUNT      Attach the Swarm gateway to this many simulation nodes instead of using --swarm-dir
+  --swarm-names=PATH       Store bzz:/ names in a JSON file (.json) or LevelDB directory instead of memory
+  -n, --node-count=COUNT   Initial number of pss nodes to start (default 10)
+  -l, --log-dir=DIR        Directory to store node logs and the network event log (default log)
+  --event-log-size=BYTES   Rotate the network event log at this size, 0 to disable it (default 67108864)
+  --event-log-files=COUNT  Number of rotated network event logs to keep (default 5)
+  --log-format=FORMAT      Format of the demo and node logs: json, logfmt or terminal (default terminal for the demo, logfmt for nodes)
+  --verbosity=LEVEL        Demo log level: trace, debug, info, warn, error or crit (default trace)
+  --vmodule=PATTERN        Per-module demo log levels as PATTERN=LEVEL,... (e.g. pss/*=5,p2p=4)
+  --node-verbosity=LEVEL   Node log level (default info)
+  --node-vmodule=PATTERN   Per-module node log levels as PATTERN=LEVEL,...
+  --playback=DIR           Replay the network event log in DIR at /events on --net-port instead of running the demo
+  --seed=SEED              Derive node IDs and pss keys from the given seed
+  --key-dir=DIR            Directory to load node IDs and pss keys from (or save them to)
+  --data-dir=DIR           Persistent data directory to resume the network from
+  --handshake              Enable the pss handshake controller on all nodes
+  --handshake-config=FILE  JSON file of per-node pss handshake params
+  --ping-interval=DUR      Interval between pss reachability probes, 0 to disable (default 30s)
+  --ping-sample=COUNT      Node pairs to ping per probe, 0 for all pairs (default 0)
+  --node-failure=MODE      What to do with clients whose node goes down, "close" or "migrate" (default close)
+  --chaos                  Randomly stop nodes and disconnect links
+  --chaos-node-interval=DUR  Interval between stopping random nodes, 0 to disable (default 1m)
+  --chaos-link-interval=DUR  Interval between disconnecting random links, 0 to disable (default 30s)
+  --chaos-downtime=DUR     Time before restoring stopped nodes and disconnected links (default 30s)
+  --chaos-spare-assigned   Never stop nodes assigned to clients or disconnect their links
+  --link-delay=DUR         One way delay of links between nodes (default 0s)
+  --link-jitter=DUR        Maximum random variation of the link delay (default 0s)
+  --link-loss=FRACTION     Fraction of packets lost on links, from 0 to 1 (default 0)
+  --link-bandwidth=KBITS   Throughput limit of links in kbit/s, 0 for unlimited (default 0)
+  --drain-countdown=DUR    Time clients are given to disconnect on shutdown (default 5s)
+  --drain-timeout=DUR      Time servers are given to finish requests on shutdown (default 10s)
+  --bots=SPEC              Bots to attach to free nodes as KIND[:COUNT],... (kinds: echo, ping-pong, trivia, relay)
+  --bot-topics=TOPICS      Comma separated pss topics bots receive messages on (default pss-demo-chat)
+  --prefix-bits=BITS       Partition the network by the first BITS bits of the nodes' overlay addresses
+  --net=NAME               Partition or heal the named network rather than the default network
+
+The partition and heal commands partition and heal the network of a running
+demo on --net-port, with each <group> being a comma separated list of node
+names (for example "pss-demo partition node01,node02 node03,node04", with
+nodes not in any group forming another group).
+
+Options override values in the config file, which are in turn overridden by
+PSS_DEMO_* environment variables named after the config keys (for example
+PSS_DEMO_NETWORK_NODE_COUNT=5 sets network.node_count, see --print-config).
 `[1:]
 
 func main() {
@@ -45,117 +96,425 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	args := Args(v)
-
-	// start pss network
-	tmpDir, err := ioutil.TempDir("", "pss-demo")
+	config, err := loadConfig(v, os.Environ())
+	if err != nil {
+		return err
+	}
+	if v["--print-config"].(bool) {
+		return config.Print()
+	}
+	if v["partition"].(bool) || v["heal"].(bool) {
+		return runPartitionCommand(v, config.NetPort)
+	}
+	level, _ := log.LvlFromString(config.Log.Level)
+	format, _ := parseLogFormat(config.Log.Format, true)
+	logLevel, err := newLogLevel(log.StreamHandler(os.Stderr, format), level, config.Log.Vmodule)
 	if err != nil {
 		return err
 	}
-	shutdown.BeforeExit(func() { os.RemoveAll(tmpDir) })
-	logDir := args.String("--log-dir")
+	log.Root().SetHandler(logLevel)
+	if dir, ok := v["--playback"].(string); ok {
+		return runPlayback(dir, config.NetPort)
+	}
+
+	// configure the node keys and services
+	var data *dataDir
+	if dir := config.Network.DataDir; dir != "" {
+		dir, err = filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		data = &dataDir{Dir: dir}
+	}
+	keys := keyStore{Seed: config.Network.Seed}
+	if dir := config.Network.KeyDir; dir != "" {
+		keys.Dir, err = filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+	} else if data != nil {
+		keys.Dir = data.NodesDir()
+	}
+	serviceConfig := &serviceConfig{
+		Keys:     keys,
+		Kademlia: config.Kademlia,
+		MsgTTL:   config.Pss.MsgTTL,
+		Log:      config.Log.Node,
+	}
+	if data != nil {
+		serviceConfig.DataDir = data.NodesDir()
+	}
+	if config.Pss.Handshake {
+		serviceConfig.Handshake = newHandshakeConfig()
+	}
+	if path := config.Pss.HandshakeConfig; path != "" {
+		serviceConfig.NodeHandshake, err = loadHandshakeConfig(path)
+		if err != nil {
+			return err
+		}
+	}
+	for name, n := range config.Networks.Nodes() {
+		if n.MsgTTL > 0 {
+			if serviceConfig.NodeMsgTTL == nil {
+				serviceConfig.NodeMsgTTL = make(map[string]duration)
+			}
+			serviceConfig.NodeMsgTTL[name] = n.MsgTTL
+		}
+		if _, ok := serviceConfig.NodeHandshake[name]; n.Handshake && !ok {
+			if serviceConfig.NodeHandshake == nil {
+				serviceConfig.NodeHandshake = make(map[string]*handshakeConfig)
+			}
+			serviceConfig.NodeHandshake[name] = newHandshakeConfig()
+		}
+	}
+	if err := setServiceConfig(serviceConfig); err != nil {
+		return err
+	}
+
+	// start pss network
+	var baseDir string
+	if data != nil {
+		baseDir, err = data.ExecDir()
+		if err != nil {
+			return err
+		}
+	} else {
+		baseDir, err = ioutil.TempDir("", "pss-demo")
+		if err != nil {
+			return err
+		}
+		shutdown.BeforeExit(func() { os.RemoveAll(baseDir) })
+	}
+	logDir := config.Log.Dir
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
 	}
-	adapter := adapters.NewExecAdapter(tmpDir)
-	adapter.ListenAddr = args.String("--net-addr")
-	net, err := NewPssSimulation(adapter, args.Int("--node-count"), logDir)
+	adapter := adapters.NewExecAdapter(baseDir)
+	adapter.ListenAddr = config.NetAddr
+	var net *simulations.Network
+	if data != nil {
+		net, err = data.LoadNetwork(adapter, config.Network.NodeCount, logDir, &keys, config.Swarm.Nodes > 0)
+	} else {
+		net, err = NewPssSimulation(adapter, config.Network.NodeCount, logDir, &keys, config.Swarm.Nodes > 0)
+	}
 	if err != nil {
 		return err
 	}
 	shutdown.BeforeExit(func() { net.Shutdown() })
+	if config.Log.EventsMaxSize > 0 {
+		events := &eventLog{
+			Dir:      logDir,
+			MaxSize:  config.Log.EventsMaxSize,
+			MaxFiles: config.Log.EventsMaxFiles,
+		}
+		if err := events.Open(); err != nil {
+			return err
+		}
+		stop, err := events.Record(net)
+		if err != nil {
+			events.Close()
+			return err
+		}
+		shutdown.BeforeExit(stop)
+	}
+	if data != nil {
+		stop := data.WatchNetwork(net)
+		shutdown.BeforeExit(stop)
+	}
 
-	// start Swarm HTTP gateway
-	swarmDir := args.String("--swarm-dir")
-	if err := os.MkdirAll(swarmDir, 0755); err != nil {
-		return err
+	// start the named networks, which are routed to at /net/{name}/ on the
+	// conn manager and simulation API ports
+	netRouter := make(networkRouter)
+	connRouter := make(networkRouter)
+	var networks []*namedNetwork
+	for _, name := range config.Networks.Names() {
+		n, err := startNamedNetwork(adapter, name, config.Networks[name], config.NodeFailure, logDir, &keys)
+		if err != nil {
+			return err
+		}
+		log.Info("Started network", "name", name, "nodes", config.Networks[name].NodeCount, "topology", config.Networks[name].topology())
+		shutdown.BeforeExit(n.Stop)
+		networks = append(networks, n)
+		links := newLinkManager(n.net, &config.Link)
+		go links.Run()
+		shutdown.BeforeExit(links.Stop)
+		partition := newPartitioner(n.net, links)
+		netMux := http.NewServeMux()
+		netMux.Handle("/links", links)
+		netMux.Handle("/links/", links)
+		netMux.Handle("/admin/partition", partition)
+		netMux.Handle("/admin/heal", partition)
+		netMux.Handle("/logs/", newNodeLogs(n.net))
+		netMux.Handle("/", simulations.NewServer(n.net))
+		netRouter[name] = netMux
+		connMux := http.NewServeMux()
+		connMux.Handle("/topology", newGraphExporter(n.net, n.conns))
+		connMux.Handle("/", n.conns)
+		connRouter[name] = connMux
 	}
-	dpa, api, err := newSwarmAPI(swarmDir)
+
+	health := newHealthChecker(net, "swarm_gateway", "simulation_api", "conn_manager")
+
+	// start Swarm HTTP gateway, either on top of the simulation nodes or a
+	// standalone store
+	swarmMux := http.NewServeMux()
+	var chunkStore storage.ChunkStore
+	if config.Swarm.Nodes > 0 {
+		gateway, err := newSwarmGateway(net, config.Swarm.Nodes)
+		if err != nil {
+			return err
+		}
+		log.Info("Attaching Swarm HTTP gateway to simulation nodes", "nodes", gateway.Nodes())
+		chunkStore = gateway
+		swarmMux.Handle("/chunks", gateway)
+	} else {
+		if err := os.MkdirAll(config.Swarm.Dir, 0755); err != nil {
+			return err
+		}
+		chunkStore, err = newLocalChunkStore(&config.Swarm)
+		if err != nil {
+			return err
+		}
+	}
+	dpa := storage.NewDPA(chunkStore, storage.NewChunkerParams())
+	dpa.Start()
+	names, err := newNameRegistry(config.Swarm.Names)
 	if err != nil {
 		return err
 	}
-	shutdown.BeforeExit(func() { dpa.Stop() })
+	shutdown.BeforeExit(func() { names.Close() })
+	swarmMux.Handle("/names", names.ReadOnly())
+	swarmMux.Handle("/names/", names.ReadOnly())
+	health.SetDPAStarted(true)
+	shutdown.BeforeExit(func() {
+		health.SetDPAStarted(false)
+		dpa.Stop()
+	})
 
 	swarmSrv := http.Server{
-		Addr:    "0.0.0.0:" + args.String("--swarm-port"),
-		Handler: swarmhttp.NewServer(api),
+		Addr:    fmt.Sprintf("0.0.0.0:%d", config.SwarmPort),
+		Handler: swarmMux,
+	}
+	swarmAPI := api.NewApi(dpa, names)
+	swarmMux.Handle("/", swarmhttp.NewServer(swarmAPI))
+	swarmLn, err := health.Listen("swarm_gateway", swarmSrv.Addr)
+	if err != nil {
+		return err
 	}
 	log.Info("Starting Swarm HTTP gateway", "addr", swarmSrv.Addr)
 	go func() {
-		if err := swarmSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := swarmSrv.Serve(swarmLn); err != nil && err != http.ErrServerClosed {
 			shutdown.Fatalf("Swarm server exited unexpectedly: %s", err)
 		}
 	}()
 	shutdown.BeforeExit(func() { swarmSrv.Close() })
 
+	links := newLinkManager(net, &config.Link)
+	go links.Run()
+	shutdown.BeforeExit(links.Stop)
+	partition := newPartitioner(net, links)
+	netMux := http.NewServeMux()
+	netMux.Handle("/links", links)
+	netMux.Handle("/links/", links)
+	netMux.Handle("/admin/partition", partition)
+	netMux.Handle("/admin/heal", partition)
+	netMux.Handle("/admin/log", newLogAdmin(logLevel, net))
+	netMux.Handle("/names", names)
+	netMux.Handle("/names/", names)
+	netMux.Handle("/logs/", newNodeLogs(net))
+	netMux.Handle("/net/", netRouter)
+	netMux.Handle("/", simulations.NewServer(net))
 	netSrv := http.Server{
-		Addr:    "0.0.0.0:" + args.String("--net-port"),
-		Handler: simulations.NewServer(net),
+		Addr:    fmt.Sprintf("0.0.0.0:%d", config.NetPort),
+		Handler: netMux,
+	}
+	netLn, err := health.Listen("simulation_api", netSrv.Addr)
+	if err != nil {
+		return err
 	}
 	log.Info("Starting Simulation API", "addr", netSrv.Addr)
 	go func() {
-		if err := netSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := netSrv.Serve(netLn); err != nil && err != http.ErrServerClosed {
 			shutdown.Fatalf("Simulation server exited unexpectedly: %s", err)
 		}
 	}()
 	shutdown.BeforeExit(func() { netSrv.Close() })
 
+	// start pss reachability prober
+	mux := http.NewServeMux()
+	if interval := time.Duration(config.Ping.Interval); interval > 0 {
+		prober := newPssProber(net, interval, config.Ping.Sample)
+		go prober.Run()
+		shutdown.BeforeExit(func() { prober.Stop() })
+		mux.Handle("/health/pss", prober)
+		mux.Handle("/metrics", prober)
+	}
+
+	// create conn manager and start bots
+	var assignmentsPath string
+	if data != nil {
+		assignmentsPath = data.AssignmentsDir()
+	}
+	assignments, err := newAssignmentStore(assignmentsPath)
+	if err != nil {
+		return err
+	}
+	connManager, err := newConnManager(net, config.NodeFailure, assignments)
+	if err != nil {
+		assignments.Close()
+		return err
+	}
+	newFileSharer(net, swarmAPI).Register(connManager)
+	go connManager.Run()
+	shutdown.BeforeExit(func() { connManager.Stop() })
+	if len(config.Bots.Kinds) > 0 {
+		bots := newBotManager(connManager, config.Bots.Topics)
+		log.Info("Starting bots", "bots", config.Bots.Kinds.Total(), "topics", config.Bots.Topics)
+		bots.Start(config.Bots.Kinds)
+		shutdown.BeforeExit(func() { bots.Stop() })
+	}
+
+	// start chaos engine
+	if config.Chaos.Enabled {
+		chaos := newChaosEngine(net, config.Chaos.config(), connManager.Assigned)
+		log.Info("Starting chaos engine")
+		go chaos.Run()
+		shutdown.BeforeExit(func() { chaos.Stop() })
+		netMux.Handle("/chaos", chaos)
+		netMux.Handle("/chaos/", chaos)
+	}
+
 	// start conn manager
+	mux.Handle("/healthz", health)
+	mux.Handle("/readyz", health)
+	mux.Handle("/dashboard/", newDashboard(config.NetPort))
+	mux.Handle("/topology", newGraphExporter(net, connManager))
+	mux.Handle("/net/", connRouter)
+	mux.Handle("/", connManager)
 	connSrv := http.Server{
-		Addr:    "0.0.0.0:" + args.String("--pss-port"),
-		Handler: newConnManager(net),
+		Addr:    fmt.Sprintf("0.0.0.0:%d", config.PssPort),
+		Handler: mux,
+	}
+	connLn, err := health.Listen("conn_manager", connSrv.Addr)
+	if err != nil {
+		return err
 	}
 	log.Info("Starting conn manager", "addr", connSrv.Addr)
 	go func() {
-		if err := connSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := connSrv.Serve(connLn); err != nil && err != http.ErrServerClosed {
 			shutdown.Fatalf("Conn manager server exited unexpectedly: %s", err)
 		}
 	}()
 	shutdown.BeforeExit(func() { connSrv.Close() })
 
-	// shutdown on SIGINT or SIGTERM
+	// drain clients then shutdown on SIGINT or SIGTERM, taking over the
+	// signals from the shutdown package which would exit immediately
 	ch := make(chan os.Signal, 1)
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
-	log.Info("received signal, exiting...")
+	log.Info("received signal, draining clients...", "countdown", time.Duration(config.Drain.Countdown), "timeout", time.Duration(config.Drain.Timeout))
+	go func() {
+		<-ch
+		log.Warn("received second signal, exiting immediately")
+		killNodes(net)
+		os.Exit(1)
+	}()
+	health.SetDraining(true)
+	drainNetworks(time.Duration(config.Drain.Countdown), connManager, networks)
+	drainServers(time.Duration(config.Drain.Timeout), &connSrv, &netSrv, &swarmSrv)
+	log.Info("exiting...")
 	shutdown.Exit()
 	return nil
 }
 
-func newSwarmAPI(dataDir string) (*storage.DPA, *api.Api, error) {
-	hashFn := storage.MakeHashFunc("SHA3")
-	localStore, err := storage.NewLocalStore(hashFn, &storage.StoreParams{
-		DbCapacity:    20000000,
-		Radius:        0,
-		ChunkDbPath:   dataDir,
-		CacheCapacity: 500,
-	})
-	if err != nil {
-		return nil, nil, err
+// runPlayback serves the network event log in dir at /events on the given
+// port until SIGINT or SIGTERM
+func runPlayback(dir string, port int) error {
+	mux := http.NewServeMux()
+	mux.Handle("/events", &eventPlayer{Dir: dir})
+	srv := http.Server{
+		Addr:    fmt.Sprintf("0.0.0.0:%d", port),
+		Handler: mux,
 	}
-	dpa := storage.NewDPA(localStore, storage.NewChunkerParams())
-	dpa.Start()
-	return dpa, api.NewApi(dpa, nil), nil
+	log.Info("Starting network event playback", "dir", dir, "addr", srv.Addr)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			shutdown.Fatalf("Playback server exited unexpectedly: %s", err)
+		}
+	}()
+	ch := make(chan os.Signal, 1)
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+	log.Info("exiting...")
+	srv.Close()
+	shutdown.Exit()
+	return nil
 }
 
-type Args map[string]interface{}
-
-func (args Args) String(flag string) string {
-	v, ok := args[flag]
-	if !ok {
-		panic(fmt.Sprintf("missing flag: %s", flag))
+// drainServers gracefully shuts down the servers, waiting up to the timeout
+// for in-flight requests to finish before closing them
+func drainServers(timeout time.Duration, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Warn("error draining server, closing it", "addr", srv.Addr, "err", err)
+				srv.Close()
+			}
+		}(srv)
 	}
-	s, ok := v.(string)
-	if !ok {
-		panic(fmt.Sprintf("invalid flag: %s=%q", flag, v))
+	wg.Wait()
+}
+
+// killNodes kills the processes of exec nodes, which ignore SIGINT, so they
+// are not left running if the demo exits without stopping them
+func killNodes(net *simulations.Network) {
+	for _, node := range net.GetNodes() {
+		if n, ok := node.Node.(*adapters.ExecNode); ok && n.Cmd != nil && n.Cmd.Process != nil {
+			n.Cmd.Process.Kill()
+		}
 	}
-	return s
 }
 
-func (args Args) Int(flag string) int {
-	i, err := strconv.Atoi(args.String(flag))
+// newLocalChunkStore returns a standalone chunk store for the Swarm HTTP
+// gateway which is not connected to the simulation network
+func newLocalChunkStore(config *swarmConfig) (*storage.LocalStore, error) {
+	return storage.NewLocalStore(storage.MakeHashFunc("SHA3"), &storage.StoreParams{
+		DbCapacity:    config.DbCapacity,
+		Radius:        0,
+		ChunkDbPath:   config.Dir,
+		CacheCapacity: config.CacheCapacity,
+	})
+}
+
+// loadHandshakeConfig loads per-node pss handshake params from a JSON file
+// mapping node names to params, for example:
+//
+//	{"node01": {"SymKeyCapacity": 8, "SymKeyExpiryTimeout": "1m"}, "node02": {}}
+//
+// with unset params taking their default values
+func loadHandshakeConfig(path string) (map[string]*handshakeConfig, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(fmt.Sprintf("invalid int flag %s: %s", flag, err))
+		return nil, err
+	}
+	var nodes map[string]json.RawMessage
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("error decoding handshake config %s: %s", path, err)
+	}
+	config := make(map[string]*handshakeConfig, len(nodes))
+	for name, data := range nodes {
+		params := newHandshakeConfig()
+		if err := json.Unmarshal(data, params); err != nil {
+			return nil, fmt.Errorf("error decoding handshake params for %s: %s", name, err)
+		}
+		config[name] = params
 	}
-	return i
+	return config, nil
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// nameRegistry is a local registry of names to Swarm hashes which is used as
+// the Swarm gateway's api.Resolver, so that bzz:/ URLs can use names (e.g.
+// bzz:/chat.demo/) without ENS
+//
+// Names are persisted in a nameStore if one is given.
+type nameRegistry struct {
+	store nameStore
+
+	mtx   sync.RWMutex
+	names map[string]common.Hash
+}
+
+// nameStore persists the names in a nameRegistry
+type nameStore interface {
+	Load() (map[string]common.Hash, error)
+	Put(name string, hash common.Hash) error
+	Delete(name string) error
+	Close() error
+}
+
+var (
+	nameMatcher = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+	hashMatcher = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{64}$`)
+)
+
+// errNameNotFound is returned when resolving a name which is not registered
+var errNameNotFound = errors.New("name not found")
+
+// newNameRegistry returns a name registry stored at path, which is a JSON
+// file if it has a .json extension and a LevelDB directory otherwise, or an
+// in-memory registry if path is empty
+func newNameRegistry(path string) (*nameRegistry, error) {
+	r := &nameRegistry{names: make(map[string]common.Hash)}
+	switch {
+	case path == "":
+		return r, nil
+	case strings.HasSuffix(path, ".json"):
+		r.store = &jsonNameStore{path: path}
+	default:
+		db, err := leveldb.OpenFile(path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error opening name registry %s: %s", path, err)
+		}
+		r.store = &levelDBNameStore{db: db}
+	}
+	names, err := r.store.Load()
+	if err != nil {
+		r.store.Close()
+		return nil, fmt.Errorf("error loading name registry %s: %s", path, err)
+	}
+	r.names = names
+	return r, nil
+}
+
+// Resolve implements api.Resolver by returning the hash registered for the
+// name
+func (r *nameRegistry) Resolve(name string) (common.Hash, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	hash, ok := r.names[name]
+	if !ok {
+		return common.Hash{}, errNameNotFound
+	}
+	return hash, nil
+}
+
+// Register registers the name, replacing any existing hash
+func (r *nameRegistry) Register(name string, hash common.Hash) error {
+	if !nameMatcher.MatchString(name) {
+		return fmt.Errorf("invalid name %q, must be dot separated lower case letters, digits and hyphens", name)
+	}
+	if hashMatcher.MatchString(name) {
+		return fmt.Errorf("invalid name %q, must not be a hash", name)
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.store != nil {
+		if err := r.store.Put(name, hash); err != nil {
+			return err
+		}
+	}
+	r.names[name] = hash
+	return nil
+}
+
+// Unregister removes the name, returning errNameNotFound if it is not
+// registered
+func (r *nameRegistry) Unregister(name string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.names[name]; !ok {
+		return errNameNotFound
+	}
+	if r.store != nil {
+		if err := r.store.Delete(name); err != nil {
+			return err
+		}
+	}
+	delete(r.names, name)
+	return nil
+}
+
+// Names returns the registered names
+func (r *nameRegistry) Names() map[string]common.Hash {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	names := make(map[string]common.Hash, len(r.names))
+	for name, hash := range r.names {
+		names[name] = hash
+	}
+	return names
+}
+
+func (r *nameRegistry) Close() error {
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Close()
+}
+
+// nameEntry is a name and hash served by the /names endpoints
+type nameEntry struct {
+	Name string      `json:"name"`
+	Hash common.Hash `json:"hash"`
+}
+
+// ServeHTTP serves the admin endpoints of the registry:
+//
+//	GET    /names        list the registered names
+//	GET    /names/NAME   get the hash registered for NAME
+//	PUT    /names/NAME   register or update NAME with the hash in the body
+//	DELETE /names/NAME   unregister NAME
+//
+// with the PUT body being either a JSON object {"hash": "..."} or the hash
+// itself.
+func (r *nameRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/names"), "/")
+	if name == "" {
+		if req.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Names())
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		hash, err := r.Resolve(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&nameEntry{Name: name, Hash: hash})
+	case "PUT", "POST":
+		hash, err := readNameHash(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.Register(name, hash); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info("registered Swarm name", "name", name, "hash", hash.Hex())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&nameEntry{Name: name, Hash: hash})
+	case "DELETE":
+		if err := r.Unregister(name); err == errNameNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info("unregistered Swarm name", "name", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ReadOnly returns a handler which serves the GET endpoints of the registry
+// and rejects changes, for serving names publicly on the Swarm gateway port
+// while they are changed on the simulation API port
+func (r *nameRegistry) ReadOnly() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			http.Error(w, "method not allowed, names are changed on the simulation API port", http.StatusMethodNotAllowed)
+			return
+		}
+		r.ServeHTTP(w, req)
+	})
+}
+
+// readNameHash reads the hash from a request body which is either a JSON
+// object with a "hash" field or the hash itself
+func readNameHash(req *http.Request) (common.Hash, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, 1024))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	s := strings.TrimSpace(string(data))
+	if strings.HasPrefix(s, "{") {
+		var v struct {
+			Hash string `json:"hash"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return common.Hash{}, fmt.Errorf("invalid JSON body: %s", err)
+		}
+		s = v.Hash
+	}
+	if !hashMatcher.MatchString(s) {
+		return common.Hash{}, fmt.Errorf("invalid hash %q, must be 64 hex characters", s)
+	}
+	return common.HexToHash(s), nil
+}
+
+// jsonNameStore stores names in a JSON file mapping names to hashes
+type jsonNameStore struct {
+	path  string
+	names map[string]common.Hash
+}
+
+func (s *jsonNameStore) Load() (map[string]common.Hash, error) {
+	s.names = make(map[string]common.Hash)
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return make(map[string]common.Hash), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.names); err != nil {
+		return nil, err
+	}
+	names := make(map[string]common.Hash, len(s.names))
+	for name, hash := range s.names {
+		names[name] = hash
+	}
+	return names, nil
+}
+
+func (s *jsonNameStore) Put(name string, hash common.Hash) error {
+	prev, exists := s.names[name]
+	s.names[name] = hash
+	if err := s.save(); err != nil {
+		if exists {
+			s.names[name] = prev
+		} else {
+			delete(s.names, name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *jsonNameStore) Delete(name string) error {
+	prev := s.names[name]
+	delete(s.names, name)
+	if err := s.save(); err != nil {
+		s.names[name] = prev
+		return err
+	}
+	return nil
+}
+
+func (s *jsonNameStore) save() error {
+	data, err := json.MarshalIndent(s.names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *jsonNameStore) Close() error {
+	return nil
+}
+
+// levelDBNameStore stores names in a LevelDB database as name => hash
+type levelDBNameStore struct {
+	db *leveldb.DB
+}
+
+func (s *levelDBNameStore) Load() (map[string]common.Hash, error) {
+	names := make(map[string]common.Hash)
+	it := s.db.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		names[string(it.Key())] = common.BytesToHash(it.Value())
+	}
+	return names, it.Error()
+}
+
+func (s *levelDBNameStore) Put(name string, hash common.Hash) error {
+	return s.db.Put([]byte(name), hash[:], nil)
+}
+
+func (s *levelDBNameStore) Delete(name string) error {
+	return s.db.Delete([]byte(name), nil)
+}
+
+func (s *levelDBNameStore) Close() error {
+	return s.db.Close()
+}
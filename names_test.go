@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/swarm/api"
+)
+
+// TestNameRegistry tests registering names in JSON and LevelDB registries,
+// reopening them and resolving the names through the Swarm API
+func TestNameRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash := common.HexToHash("3b72a3bb84036045fe714a0a8941933d54bd26aeec1a454974511cde255ad3b4")
+	other := common.HexToHash("5d488f8741b8a5bcbdbf8dfce0c5a53b2e8bfed6c270ef38ae815b01aaed258e")
+
+	for _, path := range []string{
+		filepath.Join(dir, "names.json"),
+		filepath.Join(dir, "names.db"),
+	} {
+		r, err := newNameRegistry(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"", "Chat.demo", "chat..demo", "chat/demo", "-chat", other.Hex()[2:]} {
+			if err := r.Register(name, hash); err == nil {
+				t.Fatalf("expected error registering %q", name)
+			}
+		}
+		if err := r.Register("chat.demo", other); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Register("chat.demo", hash); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Register("old.demo", hash); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Unregister("old.demo"); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Unregister("old.demo"); err != errNameNotFound {
+			t.Fatalf("expected errNameNotFound, got %v", err)
+		}
+		r.Close()
+
+		// check the names are persisted and resolved by the Swarm API
+		r, err = newNameRegistry(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := r.Names(); len(names) != 1 || names["chat.demo"] != hash {
+			t.Fatalf("unexpected names in %s: %v", path, names)
+		}
+		a := api.NewApi(nil, r)
+		key, err := a.Resolve(&api.URI{Scheme: "bzz", Addr: "chat.demo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, hash[:]) {
+			t.Fatalf("expected chat.demo to resolve to %s, got %s", hash.Hex(), key.Hex())
+		}
+		key, err = a.Resolve(&api.URI{Scheme: "bzz", Addr: other.Hex()[2:]})
+		if err != nil || !bytes.Equal(key, other[:]) {
+			t.Fatalf("expected hash to resolve to itself, got %s (err=%v)", key.Hex(), err)
+		}
+		if _, err := a.Resolve(&api.URI{Scheme: "bzz", Addr: "missing.demo"}); err == nil {
+			t.Fatal("expected error resolving unregistered name")
+		}
+		r.Close()
+	}
+}
+
+// TestNameRegistryHTTP tests the name registry admin endpoints
+func TestNameRegistryHTTP(t *testing.T) {
+	r, err := newNameRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	hash := "3b72a3bb84036045fe714a0a8941933d54bd26aeec1a454974511cde255ad3b4"
+
+	do := func(method, path, body string, status int) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Fatalf("expected %s %s to return %d, got %s", method, path, status, res.Status)
+		}
+		return res
+	}
+
+	do("PUT", "/names/chat.demo", hash, http.StatusOK).Body.Close()
+	do("PUT", "/names/files.demo", `{"hash": "0x`+hash+`"}`, http.StatusOK).Body.Close()
+	do("PUT", "/names/bad.demo", "abc", http.StatusBadRequest).Body.Close()
+	do("PUT", "/names/Bad", hash, http.StatusBadRequest).Body.Close()
+
+	res := do("GET", "/names/chat.demo", "", http.StatusOK)
+	var entry nameEntry
+	if err := json.NewDecoder(res.Body).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if entry.Name != "chat.demo" || entry.Hash != common.HexToHash(hash) {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+
+	do("DELETE", "/names/files.demo", "", http.StatusNoContent).Body.Close()
+	do("GET", "/names/files.demo", "", http.StatusNotFound).Body.Close()
+
+	res = do("GET", "/names", "", http.StatusOK)
+	var names map[string]common.Hash
+	if err := json.NewDecoder(res.Body).Decode(&names); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(names) != 1 || names["chat.demo"] != common.HexToHash(hash) {
+		t.Fatalf("unexpected names: %v", names)
+	}
+}
+
+// TestNameRegistryReadOnly tests that the read-only registry handler serves
+// names but rejects changes
+func TestNameRegistryReadOnly(t *testing.T) {
+	r, err := newNameRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := common.HexToHash("3b72a3bb84036045fe714a0a8941933d54bd26aeec1a454974511cde255ad3b4")
+	if err := r.Register("chat.demo", hash); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(r.ReadOnly())
+	defer srv.Close()
+
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/names", http.StatusOK},
+		{"GET", "/names/chat.demo", http.StatusOK},
+		{"PUT", "/names/files.demo", http.StatusMethodNotAllowed},
+		{"POST", "/names/files.demo", http.StatusMethodNotAllowed},
+		{"DELETE", "/names/chat.demo", http.StatusMethodNotAllowed},
+	} {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(hash.Hex()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Fatalf("expected %s %s to return %d, got %s", test.method, test.path, test.status, res.Status)
+		}
+	}
+	if names := r.Names(); len(names) != 1 || names["chat.demo"] != hash {
+		t.Fatalf("expected the names to be unchanged, got %v", names)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+)
+
+// topology is how the nodes of a network are initially connected
+type topology string
+
+const (
+	// topologyRing connects each node to the next, and the last to the
+	// first
+	topologyRing topology = "ring"
+
+	// topologyChain connects each node to the next
+	topologyChain topology = "chain"
+
+	// topologyStar connects every node to the first
+	topologyStar topology = "star"
+
+	// topologyFull connects every node to every other node
+	topologyFull topology = "full"
+)
+
+func (t *topology) UnmarshalText(text []byte) error {
+	switch v := topology(text); v {
+	case topologyRing, topologyChain, topologyStar, topologyFull:
+		*t = v
+		return nil
+	default:
+		return fmt.Errorf("unknown topology %q, must be ring, chain, star or full", text)
+	}
+}
+
+// conns returns the pairs of node indexes to connect for a network of the
+// given number of nodes
+func (t topology) conns(nodeCount int) [][2]int {
+	var conns [][2]int
+	switch t {
+	case topologyChain, topologyRing:
+		for i := 1; i < nodeCount; i++ {
+			conns = append(conns, [2]int{i, i - 1})
+		}
+		if t == topologyRing && nodeCount > 2 {
+			conns = append(conns, [2]int{0, nodeCount - 1})
+		}
+	case topologyStar:
+		for i := 1; i < nodeCount; i++ {
+			conns = append(conns, [2]int{i, 0})
+		}
+	case topologyFull:
+		for i := 1; i < nodeCount; i++ {
+			for j := 0; j < i; j++ {
+				conns = append(conns, [2]int{i, j})
+			}
+		}
+	}
+	return conns
+}
+
+// networkNamePattern is the pattern of network names, which are used in URLs
+// and node names
+var networkNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// namedNetwork is an additional simulation network hosted alongside the
+// default one, with its own conn manager and node logs mounted at /net/{name}/
+// on the conn manager port and its own simulation API mounted at /net/{name}/
+// on the simulation API port
+//
+// Named networks are lightweight networks for side by side experiments, so
+// only get a subset of the default network's features: the conn manager,
+// node logs, topology, link impairment and partitions. They have no chaos
+// engine, prober, bots, Swarm gateway or health checks, and are not
+// persisted in the data directory, so their assignments are kept in memory.
+type namedNetwork struct {
+	name  string
+	net   *simulations.Network
+	conns *connManager
+}
+
+// startNamedNetwork starts a named network with nodes named after the
+// network (e.g. "track-a-node01"), which are therefore distinct from the
+// nodes of other networks
+func startNamedNetwork(adapter adapters.NodeAdapter, name string, config *namedNetworkConfig, failure nodeFailureMode, logDir string, keys *keyStore) (*namedNetwork, error) {
+	net, err := newPssNetwork(adapter, name, config.NodeCount, config.topology(), logDir, keys, false)
+	if err != nil {
+		return nil, fmt.Errorf("error starting network %q: %s", name, err)
+	}
+	conns, err := newConnManager(net, failure, newMemAssignmentStore())
+	if err != nil {
+		net.Shutdown()
+		return nil, err
+	}
+	go conns.Run()
+	return &namedNetwork{name: name, net: net, conns: conns}, nil
+}
+
+// Stop stops the network's conn manager and nodes
+func (n *namedNetwork) Stop() {
+	n.conns.Stop()
+	n.net.Shutdown()
+}
+
+// networkRouter routes requests for /net/{name}/ to the handler of the named
+// network with the /net/{name} prefix removed, listing the network names at
+// /net/
+type networkRouter map[string]http.Handler
+
+func (r networkRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/net/")
+	if path == "" {
+		names := make([]string, 0, len(r))
+		for name := range r {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(names)
+		return
+	}
+	name := path
+	if i := strings.Index(path, "/"); i != -1 {
+		name = path[:i]
+	}
+	handler, ok := r[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown network %q", name), http.StatusNotFound)
+		return
+	}
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.URL = new(url.URL)
+	*r2.URL = *req.URL
+	r2.URL.Path = "/" + strings.TrimPrefix(path[len(name):], "/")
+	r2.URL.RawPath = ""
+	handler.ServeHTTP(w, r2)
+}
+
+// drainNetworks drains the clients of the default network's conn manager and
+// those of the named networks in parallel
+func drainNetworks(countdown time.Duration, conns *connManager, networks []*namedNetwork) {
+	all := []*connManager{conns}
+	for _, n := range networks {
+		all = append(all, n.conns)
+	}
+	var wg sync.WaitGroup
+	for _, c := range all {
+		wg.Add(1)
+		go func(c *connManager) {
+			defer wg.Done()
+			c.Drain(countdown)
+		}(c)
+	}
+	wg.Wait()
+}
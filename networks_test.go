@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestTopology tests the initial connections of each topology
+func TestTopology(t *testing.T) {
+	for _, test := range []struct {
+		topology  topology
+		nodeCount int
+		conns     [][2]int
+	}{
+		{topologyRing, 2, [][2]int{{1, 0}}},
+		{topologyRing, 4, [][2]int{{1, 0}, {2, 1}, {3, 2}, {0, 3}}},
+		{topologyChain, 4, [][2]int{{1, 0}, {2, 1}, {3, 2}}},
+		{topologyStar, 4, [][2]int{{1, 0}, {2, 0}, {3, 0}}},
+		{topologyFull, 3, [][2]int{{1, 0}, {2, 0}, {2, 1}}},
+	} {
+		if conns := test.topology.conns(test.nodeCount); !reflect.DeepEqual(conns, test.conns) {
+			t.Fatalf("expected %s of %d nodes to have conns %v, got %v", test.topology, test.nodeCount, test.conns, conns)
+		}
+	}
+	var top topology
+	if err := top.UnmarshalText([]byte("mesh")); err == nil {
+		t.Fatal("expected an error for an unknown topology")
+	}
+}
+
+// TestNetworkRouter tests routing requests to named networks
+func TestNetworkRouter(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%s %s?%s", name, req.URL.Path, req.URL.RawQuery)
+		})
+	}
+	srv := httptest.NewServer(networkRouter{
+		"track-a": handler("track-a"),
+		"track-b": handler("track-b"),
+	})
+	defer srv.Close()
+
+	get := func(path string, status int) string {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("expected status %d for %s, got %s", status, path, res.Status)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	var names []string
+	if err := json.Unmarshal([]byte(get("/net/", http.StatusOK)), &names); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"track-a", "track-b"}) {
+		t.Fatalf("unexpected network names %v", names)
+	}
+	for path, expected := range map[string]string{
+		"/net/track-a":                   "track-a /?",
+		"/net/track-a/":                  "track-a /?",
+		"/net/track-b/list":              "track-b /list?",
+		"/net/track-b/logs/search?q=abc": "track-b /logs/search?q=abc",
+	} {
+		if body := get(path, http.StatusOK); body != expected {
+			t.Fatalf("expected %s to return %q, got %q", path, expected, body)
+		}
+	}
+	get("/net/track-c/list", http.StatusNotFound)
+}
+
+// TestNamedNetworkNodes tests the node names and config of named networks
+func TestNamedNetworkNodes(t *testing.T) {
+	networks := namedNetworks{
+		"track-a": {NodeCount: 2},
+		"track-b": {NodeCount: 3, Topology: topologyStar},
+	}
+	if names := networks.Names(); !reflect.DeepEqual(names, []string{"track-a", "track-b"}) {
+		t.Fatalf("unexpected network names %v", names)
+	}
+	nodes := networks.Nodes()
+	if len(nodes) != 5 {
+		t.Fatalf("expected 5 nodes, got %d", len(nodes))
+	}
+	if nodes["track-a-node02"] != networks["track-a"] || nodes["track-b-node03"] != networks["track-b"] {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+	if top := networks["track-a"].topology(); top != topologyRing {
+		t.Fatalf("expected default topology ring, got %s", top)
+	}
+}
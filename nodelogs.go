@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"golang.org/x/net/websocket"
+)
+
+// logTailInterval is how often node logs are checked for new lines
+const logTailInterval = 250 * time.Millisecond
+
+// logRecentBytes is how much of the end of each node log is read to get its
+// recent lines, for the backlog of tails and for searches
+const logRecentBytes = 1024 * 1024
+
+// defaultLogLines and maxLogLines are the default and maximum number of lines
+// returned by searches and sent as the backlog of tails
+const (
+	defaultLogLines = 100
+	maxLogLines     = 1000
+)
+
+// logLine is a line of a node's log, labelled with the node's name
+type logLine struct {
+	Node  string    `json:"node"`
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Line  string    `json:"line"`
+
+	lvl log.Lvl
+}
+
+var (
+	logTimePattern     = regexp.MustCompile(`(?:^|\s)t=(\S+)`)
+	logLevelPattern    = regexp.MustCompile(`(?:^|\s)lvl=(\w+)`)
+	logTerminalPattern = regexp.MustCompile(`^(TRACE|DEBUG|INFO|WARN|ERROR|CRIT) *\[(\d\d-\d\d\|\d\d:\d\d:\d\d)`)
+)
+
+// parseLogLine parses the time and level of a log line in any of the formats
+// of --log-format, with lines which have neither (e.g. a stack trace) being
+// assumed to be a continuation of the previous line
+func parseLogLine(node, text string, prev *logLine) *logLine {
+	line := &logLine{Node: node, Line: text, Level: "info", lvl: log.LvlInfo}
+	if prev != nil {
+		line.Time, line.Level, line.lvl = prev.Time, prev.Level, prev.lvl
+	}
+	setLevel := func(name string) {
+		if lvl, err := log.LvlFromString(name); err == nil {
+			line.Level, line.lvl = name, lvl
+		}
+	}
+	switch {
+	case strings.HasPrefix(text, "{"):
+		var record struct {
+			T   time.Time `json:"t"`
+			Lvl string    `json:"lvl"`
+		}
+		if err := json.Unmarshal([]byte(text), &record); err == nil {
+			line.Time = record.T
+			setLevel(record.Lvl)
+		}
+	case logTerminalPattern.MatchString(text):
+		// terminal timestamps have no year so assume the current one
+		m := logTerminalPattern.FindStringSubmatch(text)
+		if t, err := time.ParseInLocation("2006-01-02|15:04:05", fmt.Sprintf("%d-%s", time.Now().Year(), m[2]), time.Local); err == nil {
+			line.Time = t
+		}
+		setLevel(strings.ToLower(m[1]))
+	default:
+		if m := logTimePattern.FindStringSubmatch(text); m != nil {
+			if t, err := time.Parse("2006-01-02T15:04:05-0700", m[1]); err == nil {
+				line.Time = t
+			}
+		}
+		if m := logLevelPattern.FindStringSubmatch(text); m != nil {
+			setLevel(m[1])
+		}
+	}
+	return line
+}
+
+// logTail reads the lines appended to a node's log file
+type logTail struct {
+	node    string
+	path    string
+	offset  int64
+	partial []byte
+	prev    *logLine
+}
+
+// Recent returns the lines in the last logRecentBytes of the log, with
+// subsequent calls to Read returning the lines appended after them
+func (t *logTail) Recent() ([]*logLine, error) {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start := info.Size() - logRecentBytes
+	if start < 0 {
+		start = 0
+	}
+	data := make([]byte, info.Size()-start)
+	if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	// skip the first line if it was cut off
+	if start > 0 {
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			data = data[i+1:]
+		} else {
+			data = nil
+		}
+	}
+	t.offset = info.Size()
+	t.partial = nil
+	return t.lines(data), nil
+}
+
+// Read returns the lines appended to the log since the last call to Read or
+// Recent, starting from the beginning if the log was truncated
+func (t *logTail) Read() ([]*logLine, error) {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < t.offset {
+		t.offset = 0
+		t.partial = nil
+	}
+	if info.Size() == t.offset {
+		return nil, nil
+	}
+	data := make([]byte, info.Size()-t.offset)
+	n, err := f.ReadAt(data, t.offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	t.offset += int64(n)
+	return t.lines(append(t.partial, data[:n]...)), nil
+}
+
+// lines parses the complete lines in data, keeping any trailing partial line
+// to be completed by the next read
+func (t *logTail) lines(data []byte) []*logLine {
+	var lines []*logLine
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			break
+		}
+		if text := strings.TrimRight(string(data[:i]), "\r"); text != "" {
+			t.prev = parseLogLine(t.node, text, t.prev)
+			lines = append(lines, t.prev)
+		}
+		data = data[i+1:]
+	}
+	t.partial = append([]byte(nil), data...)
+	return lines
+}
+
+// logFilter filters log lines by their level and a case insensitive
+// substring
+type logFilter struct {
+	lvl   log.Lvl
+	query string
+}
+
+func (f *logFilter) Match(line *logLine) bool {
+	return line.lvl <= f.lvl && (f.query == "" || strings.Contains(strings.ToLower(line.Line), f.query))
+}
+
+// filterLogLines returns the lines matching the filter ordered by time,
+// keeping the order of lines from the same node which were logged in the
+// same second
+func filterLogLines(lines []*logLine, filter *logFilter) []*logLine {
+	var matched []*logLine
+	for _, line := range lines {
+		if filter.Match(line) {
+			matched = append(matched, line)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Time.Before(matched[j].Time)
+	})
+	return matched
+}
+
+// nodeLogs serves the logs the simulation nodes write to the log directory:
+//
+//	GET /logs/search  - JSON array of recent log lines matching ?q=
+//	GET /logs/tail    - WebSocket tail of the merged logs of ?nodes=
+//	GET /logs/{node}  - WebSocket tail of the log of a node (name or ID)
+//
+// The search and merged tail accept ?nodes= (comma separated names or IDs,
+// default all nodes), and all endpoints accept ?level= (only lines at least
+// as severe, default trace) and ?q= (only lines containing the text, ignoring
+// case). Each line is sent as a JSON object with the node's name, the time
+// and level of the line and the line itself. Tails start with the last
+// ?lines= recent lines (default 100), which is also the number of lines
+// searches return.
+type nodeLogs struct {
+	net *simulations.Network
+}
+
+func newNodeLogs(net *simulations.Network) *nodeLogs {
+	return &nodeLogs{net: net}
+}
+
+func (l *nodeLogs) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodes := req.URL.Query().Get("nodes")
+	switch path := strings.TrimPrefix(req.URL.Path, "/logs"); path {
+	case "/search", "/tail":
+	case "/":
+		http.NotFound(w, req)
+		return
+	default:
+		nodes = strings.TrimPrefix(path, "/")
+	}
+	tails, err := l.tails(nodes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	filter, limit, err := parseLogQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var recent []*logLine
+	for _, tail := range tails {
+		lines, err := tail.Recent()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recent = append(recent, lines...)
+	}
+	recent = filterLogLines(recent, filter)
+	if len(recent) > limit {
+		recent = recent[len(recent)-limit:]
+	}
+	if req.URL.Path == "/logs/search" {
+		if recent == nil {
+			recent = []*logLine{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recent)
+		return
+	}
+	websocket.Server{
+		Handler: func(conn *websocket.Conn) { l.serveTail(conn, tails, filter, recent) },
+	}.ServeHTTP(w, req)
+}
+
+// parseLogQuery parses the level, q and lines query parameters
+func parseLogQuery(req *http.Request) (filter *logFilter, limit int, err error) {
+	query := req.URL.Query()
+	filter = &logFilter{lvl: log.LvlTrace, query: strings.ToLower(query.Get("q"))}
+	if s := query.Get("level"); s != "" {
+		filter.lvl, err = log.LvlFromString(s)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid level %q, must be one of trace, debug, info, warn, error or crit", s)
+		}
+	}
+	limit = defaultLogLines
+	if s := query.Get("lines"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 || limit > maxLogLines {
+			return nil, 0, fmt.Errorf("invalid lines %q, must be between 0 and %d", s, maxLogLines)
+		}
+	}
+	return filter, limit, nil
+}
+
+// tails returns tails of the logs of the given comma separated node names or
+// IDs, or of all nodes if empty
+func (l *nodeLogs) tails(nodes string) ([]*logTail, error) {
+	var selected []*simulations.Node
+	if nodes == "" {
+		selected = l.net.GetNodes()
+	} else {
+		for _, name := range strings.Split(nodes, ",") {
+			node := l.node(strings.TrimSpace(name))
+			if node == nil {
+				return nil, fmt.Errorf("unknown node %q", name)
+			}
+			selected = append(selected, node)
+		}
+	}
+	var tails []*logTail
+	for _, node := range selected {
+		if node.Config.LogFile == "" {
+			continue
+		}
+		tails = append(tails, &logTail{node: node.Config.Name, path: node.Config.LogFile})
+	}
+	return tails, nil
+}
+
+// node returns the node with the given name or (possibly abbreviated) hex ID
+func (l *nodeLogs) node(name string) *simulations.Node {
+	if node := l.net.GetNodeByName(name); node != nil {
+		return node
+	}
+	if len(name) < 8 {
+		return nil
+	}
+	for _, node := range l.net.GetNodes() {
+		if strings.HasPrefix(node.ID().String(), strings.ToLower(name)) {
+			return node
+		}
+	}
+	return nil
+}
+
+// serveTail sends the recent lines then the lines appended to the logs
+// matching the filter, merged in time order, until the client disconnects
+func (l *nodeLogs) serveTail(conn *websocket.Conn, tails []*logTail, filter *logFilter, recent []*logLine) {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var msg []byte
+		for {
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				return
+			}
+		}
+	}()
+	send := func(lines []*logLine) error {
+		for _, line := range lines {
+			if err := websocket.JSON.Send(conn, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := send(recent); err != nil {
+		return
+	}
+	ticker := time.NewTicker(logTailInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var lines []*logLine
+			for _, tail := range tails {
+				tailLines, err := tail.Read()
+				if err != nil {
+					log.Warn("error reading node log", "node", tail.node, "err", err)
+					continue
+				}
+				lines = append(lines, tailLines...)
+			}
+			if err := send(filterLogLines(lines, filter)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
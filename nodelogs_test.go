@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+	"golang.org/x/net/websocket"
+)
+
+// TestNodeLogs tests searching and tailing the merged logs of nodes
+func TestNodeLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	net := simulations.NewNetwork(adapters.NewSimAdapter(services), &simulations.NetworkConfig{})
+	defer net.Shutdown()
+	logs := map[string]string{
+		"node01": "t=2018-10-28T19:40:00+0000 lvl=info msg=\"Starting P2P networking\"\n" +
+			"t=2018-10-28T19:40:02+0000 lvl=warn msg=\"Peer dropped\" peer=abc\n",
+		"node02": "t=2018-10-28T19:40:01+0000 lvl=eror msg=\"Forwarding failed\"\n" +
+			"goroutine 1 [running]:\n",
+	}
+	paths := make(map[string]string)
+	for name, data := range logs {
+		config := adapters.RandomNodeConfig()
+		config.Name = name
+		config.Services = []string{"pss"}
+		config.LogFile = filepath.Join(dir, name+".log")
+		if _, err := net.NewNodeWithConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(config.LogFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths[name] = config.LogFile
+	}
+	srv := httptest.NewServer(newNodeLogs(net))
+	defer srv.Close()
+
+	format := func(lines []*logLine) string {
+		s := make([]string, len(lines))
+		for i, line := range lines {
+			s[i] = line.Node + "/" + line.Level + "/" + line.Time.Format("15:04:05")
+		}
+		return strings.Join(s, " ")
+	}
+	search := func(query string) string {
+		res, err := http.Get(srv.URL + "/logs/search?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status for %q: %s", query, res.Status)
+		}
+		var lines []*logLine
+		if err := json.NewDecoder(res.Body).Decode(&lines); err != nil {
+			t.Fatal(err)
+		}
+		return format(lines)
+	}
+	for query, expected := range map[string]string{
+		"":                   "node01/info/19:40:00 node02/eror/19:40:01 node02/eror/19:40:01 node01/warn/19:40:02",
+		"level=warn&lines=2": "node02/eror/19:40:01 node01/warn/19:40:02",
+		"q=PEER":             "node01/warn/19:40:02",
+		"nodes=node02":       "node02/eror/19:40:01 node02/eror/19:40:01",
+		"q=nothing":          "",
+	} {
+		if lines := search(query); lines != expected {
+			t.Fatalf("expected search %q to return %q, got %q", query, expected, lines)
+		}
+	}
+	for query, status := range map[string]int{
+		"level=loud":   http.StatusBadRequest,
+		"lines=-1":     http.StatusBadRequest,
+		"nodes=node03": http.StatusNotFound,
+	} {
+		res, err := http.Get(srv.URL + "/logs/search?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("expected status %d for %q, got %s", status, query, res.Status)
+		}
+	}
+
+	// tail the merged warnings, which should start with the most recent
+	// one then get the new ones
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/logs/tail?level=warn&lines=1", "", "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	receive := func() *logLine {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line := &logLine{}
+		if err := websocket.JSON.Receive(conn, line); err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	if line := receive(); format([]*logLine{line}) != "node01/warn/19:40:02" {
+		t.Fatalf("unexpected backlog line %q", line.Line)
+	}
+	appendLog := func(name, data string) {
+		f, err := os.OpenFile(paths[name], os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendLog("node01", "t=2018-10-28T19:40:04+0000 lvl=eror msg=\"Second error\"\n")
+	appendLog("node02", "t=2018-10-28T19:40:03+0000 lvl=info msg=\"Ignored\"\n")
+	appendLog("node02", "t=2018-10-28T19:40:03+0000 lvl=crit msg=\"First")
+	time.Sleep(2 * logTailInterval)
+	appendLog("node02", " error\"\n")
+	expected := []string{
+		`t=2018-10-28T19:40:03+0000 lvl=crit msg="First error"`,
+		`t=2018-10-28T19:40:04+0000 lvl=eror msg="Second error"`,
+	}
+	// the second error may be sent before the first if the tail reads
+	// the partial line, as they are only ordered within each read
+	got := map[string]bool{receive().Line: true, receive().Line: true}
+	for _, line := range expected {
+		if !got[line] {
+			t.Fatalf("expected to receive %q, got %v", line, got)
+		}
+	}
+
+	// tail a single node by name
+	conn2, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/logs/node02?lines=1", "", "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	line := &logLine{}
+	conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(conn2, line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Node != "node02" || line.Line != expected[0] {
+		t.Fatalf("unexpected node02 line %+v", line)
+	}
+}
+
+// TestParseLogLine tests parsing the time and level of each log format
+func TestParseLogLine(t *testing.T) {
+	year := time.Now().Year()
+	prev := &logLine{Level: "warn", Time: time.Date(2018, 10, 28, 19, 40, 0, 0, time.UTC)}
+	for _, test := range []struct {
+		text  string
+		level string
+		time  time.Time
+	}{
+		{`t=2018-10-28T19:40:38+0000 lvl=eror msg="Peer dropped"`, "eror", time.Date(2018, 10, 28, 19, 40, 38, 0, time.UTC)},
+		{`{"lvl":"dbug","msg":"Peer dropped","node_id":"abc","t":"2018-10-28T19:40:38.5Z"}`, "dbug", time.Date(2018, 10, 28, 19, 40, 38, 5e8, time.UTC)},
+		{`WARN [10-28|19:40:38] Peer dropped    node_name=node01`, "warn", time.Date(year, 10, 28, 19, 40, 38, 0, time.Local)},
+		{`goroutine 1 [running]:`, "warn", prev.Time},
+	} {
+		line := parseLogLine("node01", test.text, prev)
+		if line.Level != test.level || !line.Time.Equal(test.time) {
+			t.Fatalf("expected %q to have level %s and time %s, got %s and %s", test.text, test.level, test.time, line.Level, line.Time)
+		}
+	}
+}
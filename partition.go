@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+// maxPartitionPrefixBits is the maximum number of overlay address bits a
+// network can be partitioned by (giving up to 256 groups)
+const maxPartitionPrefixBits = 8
+
+// partitioner splits a network into groups of nodes by disconnecting every
+// link between nodes in different groups, then restores exactly those links
+// when the partition is healed
+//
+// Nodes are blocked from dialling nodes in other groups while partitioned
+// (see linkManager.SetGroups) so that Kademlia does not reconnect them, and
+// the disconnects and connects are emitted as control events on the
+// network's event feed.
+type partitioner struct {
+	net   *simulations.Network
+	links *linkManager
+
+	mtx    sync.Mutex
+	status *partitionStatus
+	conns  [][2]discover.NodeID
+}
+
+// partitionRequest is the body of POST /admin/partition, which partitions
+// the network either into explicit groups of node names, with nodes not in
+// any group forming another group, or by the first PrefixBits bits of the
+// nodes' overlay addresses
+type partitionRequest struct {
+	Groups     [][]string `json:"groups,omitempty"`
+	PrefixBits int        `json:"prefix_bits,omitempty"`
+}
+
+// partitionStatus is the state of the partition served at /admin/partition
+type partitionStatus struct {
+	Partitioned bool              `json:"partitioned"`
+	Groups      []*partitionGroup `json:"groups,omitempty"`
+	Links       []*partitionLink  `json:"links,omitempty"`
+}
+
+// partitionGroup is a group of nodes in a partitioned network, with Prefix
+// being the overlay address prefix of the group's nodes in binary when
+// partitioned by address
+type partitionGroup struct {
+	Prefix string   `json:"prefix,omitempty"`
+	Nodes  []string `json:"nodes"`
+}
+
+// partitionLink is a link disconnected by a partition
+type partitionLink struct {
+	One   string `json:"one"`
+	Other string `json:"other"`
+}
+
+// errPartitioned is returned when partitioning a network which is already
+// partitioned
+var errPartitioned = errors.New("the network is already partitioned")
+
+func newPartitioner(net *simulations.Network, links *linkManager) *partitioner {
+	return &partitioner{
+		net:    net,
+		links:  links,
+		status: &partitionStatus{},
+	}
+}
+
+// Status returns the groups and disconnected links of the partition
+func (p *partitioner) Status() *partitionStatus {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.status
+}
+
+// Partition splits the network into groups, disconnecting the links between
+// nodes in different groups
+func (p *partitioner) Partition(req *partitionRequest) (*partitionStatus, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.status.Partitioned {
+		return nil, errPartitioned
+	}
+	var groups []*partitionGroup
+	var err error
+	if req.PrefixBits > 0 {
+		groups, err = p.prefixGroups(req.PrefixBits)
+	} else {
+		groups, err = p.nodeGroups(req.Groups)
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[discover.NodeID]int)
+	for i, group := range groups {
+		for _, name := range group.Nodes {
+			index[p.net.GetNodeByName(name).ID()] = i
+		}
+	}
+
+	// block the links before disconnecting them so that they are not
+	// redialled
+	p.links.SetGroups(index)
+	status := &partitionStatus{Partitioned: true, Groups: groups, Links: []*partitionLink{}}
+	var conns [][2]discover.NodeID
+	nodes := p.net.GetNodes()
+	for i, node := range nodes {
+		for _, other := range nodes[i+1:] {
+			conn := p.net.GetConn(node.ID(), other.ID())
+			if conn == nil || !conn.Up || index[node.ID()] == index[other.ID()] {
+				continue
+			}
+			one, other := p.net.GetNode(conn.One), p.net.GetNode(conn.Other)
+			log.Info("partition: disconnecting link", "one", one.Config.Name, "other", other.Config.Name)
+			if err := p.net.Disconnect(conn.One, conn.Other); err != nil {
+				log.Error("partition: error disconnecting link", "one", one.Config.Name, "other", other.Config.Name, "err", err)
+				continue
+			}
+			conns = append(conns, [2]discover.NodeID{conn.One, conn.Other})
+			status.Links = append(status.Links, &partitionLink{One: one.Config.Name, Other: other.Config.Name})
+		}
+	}
+	p.status = status
+	p.conns = conns
+	return status, nil
+}
+
+// nodeGroups returns the groups of the given node names, along with a group
+// of the remaining nodes if there are any
+func (p *partitioner) nodeGroups(names [][]string) ([]*partitionGroup, error) {
+	seen := make(map[string]bool)
+	var groups []*partitionGroup
+	for _, group := range names {
+		if len(group) == 0 {
+			return nil, errors.New("groups must not be empty")
+		}
+		for _, name := range group {
+			if p.net.GetNodeByName(name) == nil {
+				return nil, fmt.Errorf("unknown node %q", name)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("node %q is in more than one group", name)
+			}
+			seen[name] = true
+		}
+		groups = append(groups, &partitionGroup{Nodes: group})
+	}
+	rest := &partitionGroup{}
+	for _, node := range p.net.GetNodes() {
+		if !seen[node.Config.Name] {
+			rest.Nodes = append(rest.Nodes, node.Config.Name)
+		}
+	}
+	if len(rest.Nodes) > 0 {
+		groups = append(groups, rest)
+	}
+	if len(groups) < 2 {
+		return nil, errors.New("at least two groups are required")
+	}
+	return groups, nil
+}
+
+// prefixGroups groups the running nodes by the first bits of their overlay
+// addresses, omitting empty groups
+func (p *partitioner) prefixGroups(bits int) ([]*partitionGroup, error) {
+	if bits > maxPartitionPrefixBits {
+		return nil, fmt.Errorf("prefix_bits must be at most %d, got %d", maxPartitionPrefixBits, bits)
+	}
+	byPrefix := make(map[string]*partitionGroup)
+	for _, node := range p.net.GetNodes() {
+		if !node.Up {
+			continue
+		}
+		client, err := node.Client()
+		if err != nil {
+			return nil, fmt.Errorf("error getting overlay address of %s: %s", node.Config.Name, err)
+		}
+		var addr pss.PssAddress
+		if err := client.Call(&addr, "pss_baseAddr"); err != nil {
+			return nil, fmt.Errorf("error getting overlay address of %s: %s", node.Config.Name, err)
+		}
+		prefix := addressPrefix(addr, bits)
+		group, ok := byPrefix[prefix]
+		if !ok {
+			group = &partitionGroup{Prefix: prefix}
+			byPrefix[prefix] = group
+		}
+		group.Nodes = append(group.Nodes, node.Config.Name)
+	}
+	if len(byPrefix) < 2 {
+		return nil, fmt.Errorf("all nodes have the same %d bit address prefix", bits)
+	}
+	groups := make([]*partitionGroup, 0, len(byPrefix))
+	for _, group := range byPrefix {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Prefix < groups[j].Prefix })
+	return groups, nil
+}
+
+// addressPrefix returns the first bits of an address in binary
+func addressPrefix(addr []byte, bits int) string {
+	var prefix bytes.Buffer
+	for i := 0; i < bits; i++ {
+		if i/8 < len(addr) && addr[i/8]&(0x80>>uint(i%8)) != 0 {
+			prefix.WriteByte('1')
+		} else {
+			prefix.WriteByte('0')
+		}
+	}
+	return prefix.String()
+}
+
+// Heal unblocks the links between the groups and reconnects the links which
+// were disconnected by the partition and whose nodes are still running
+func (p *partitioner) Heal() *partitionStatus {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if !p.status.Partitioned {
+		return p.status
+	}
+	p.links.SetGroups(nil)
+	for _, conn := range p.conns {
+		one, other := p.net.GetNode(conn[0]), p.net.GetNode(conn[1])
+		if one == nil || other == nil || !one.Up || !other.Up {
+			continue
+		}
+		if c := p.net.GetConn(conn[0], conn[1]); c != nil && c.Up {
+			continue
+		}
+		log.Info("partition: reconnecting link", "one", one.Config.Name, "other", other.Config.Name)
+		if err := p.net.Connect(conn[0], conn[1]); err != nil {
+			log.Error("partition: error reconnecting link", "one", one.Config.Name, "other", other.Config.Name, "err", err)
+		}
+	}
+	p.status = &partitionStatus{}
+	p.conns = nil
+	return p.status
+}
+
+// ServeHTTP serves the partition admin endpoints on the simulation API port:
+//
+//	GET  /admin/partition  the groups and disconnected links
+//	POST /admin/partition  partition the network (see partitionRequest)
+//	POST /admin/heal       heal the partition
+func (p *partitioner) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var status *partitionStatus
+	switch {
+	case req.URL.Path == "/admin/partition" && req.Method == "GET":
+		status = p.Status()
+	case req.URL.Path == "/admin/partition" && req.Method == "POST":
+		var partition partitionRequest
+		if err := json.NewDecoder(io.LimitReader(req.Body, 1024*1024)).Decode(&partition); err != nil {
+			http.Error(w, fmt.Sprintf("invalid partition: %s", err), http.StatusBadRequest)
+			return
+		}
+		var err error
+		status, err = p.Partition(&partition)
+		if err == errPartitioned {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info("partitioned network", "groups", len(status.Groups), "links", len(status.Links))
+	case req.URL.Path == "/admin/heal" && req.Method == "POST":
+		status = p.Heal()
+		log.Info("healed network partition")
+	case req.URL.Path == "/admin/partition" || req.URL.Path == "/admin/heal":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(status)
+}
+
+// runPartitionCommand runs the partition and heal subcommands by sending
+// the request to the admin endpoint of a running demo, printing the
+// resulting status
+func runPartitionCommand(v map[string]interface{}, port int) error {
+	url := fmt.Sprintf("http://localhost:%d", port)
+	if name, ok := v["--net"].(string); ok {
+		url += "/net/" + name
+	}
+	var res *http.Response
+	var err error
+	switch {
+	case v["heal"].(bool):
+		res, err = http.Post(url+"/admin/heal", "application/json", nil)
+	default:
+		req := &partitionRequest{}
+		if bits, ok := v["--prefix-bits"].(string); ok {
+			if _, err := fmt.Sscan(bits, &req.PrefixBits); err != nil || req.PrefixBits < 1 {
+				return fmt.Errorf("invalid --prefix-bits: %q is not a positive integer", bits)
+			}
+		}
+		for _, group := range v["<group>"].([]string) {
+			req.Groups = append(req.Groups, strings.Split(group, ","))
+		}
+		data, _ := json.Marshal(req)
+		res, err = http.Post(url+"/admin/partition", "application/json", bytes.NewReader(data))
+	}
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	var status partitionStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+	if !status.Partitioned {
+		fmt.Println("the network is not partitioned")
+		return nil
+	}
+	for i, group := range status.Groups {
+		fmt.Printf("group %d", i+1)
+		if group.Prefix != "" {
+			fmt.Printf(" (prefix %s)", group.Prefix)
+		}
+		fmt.Printf(": %s\n", strings.Join(group.Nodes, ", "))
+	}
+	fmt.Printf("%d links disconnected\n", len(status.Links))
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPartition tests partitioning and healing a network with the
+// /admin/partition and /admin/heal endpoints
+func TestPartition(t *testing.T) {
+	// the nodes are connected in a ring, node01 - node02 - node03 - node04
+	net := newTestNetwork(t, 4, false)
+	defer net.Close()
+	links := net.startLinks(&linkConfig{})
+	srv := httptest.NewServer(newPartitioner(net.Network, links))
+	defer srv.Close()
+
+	request := func(method, path, body string, status int) *partitionStatus {
+		s := &partitionStatus{}
+		testRequest(t, srv, method, path, body, status, s)
+		return s
+	}
+	cross := [][2]string{{"node02", "node03"}, {"node04", "node01"}}
+	waitConnsUp(t, net.Network, append(cross, [2]string{"node01", "node02"}, [2]string{"node03", "node04"})...)
+
+	request("POST", "/admin/partition", `{"groups":[["node01","node05"]]}`, http.StatusBadRequest)
+	request("POST", "/admin/partition", `{"groups":[["node01"],["node01","node02"]]}`, http.StatusBadRequest)
+	request("POST", "/admin/partition", `{"groups":[["node01","node02","node03","node04"]]}`, http.StatusBadRequest)
+
+	s := request("POST", "/admin/partition", `{"groups":[["node01","node02"]]}`, http.StatusOK)
+	if !s.Partitioned || len(s.Groups) != 2 || strings.Join(s.Groups[1].Nodes, ",") != "node03,node04" {
+		t.Fatalf("expected node03 and node04 to form the second group, got %+v", s)
+	}
+	if len(s.Links) != len(cross) {
+		t.Fatalf("expected %d links to be disconnected, got %d", len(cross), len(s.Links))
+	}
+	for _, link := range cross {
+		if connUp(net.Network, link[0], link[1]) {
+			t.Fatalf("expected %s - %s to be disconnected", link[0], link[1])
+		}
+	}
+	if !connUp(net.Network, "node01", "node02") || !connUp(net.Network, "node03", "node04") {
+		t.Fatal("expected the links within the groups to remain connected")
+	}
+	client, err := net.GetNodeByName("node01").Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var impairments LinkImpairments
+	if err := client.Call(&impairments, "link_impairments"); err != nil {
+		t.Fatal(err)
+	}
+	if len(impairments.Blocked) != 2 {
+		t.Fatalf("expected node01 to be blocked from dialling 2 nodes, got %v", impairments.Blocked)
+	}
+	request("POST", "/admin/partition", `{"prefix_bits":1}`, http.StatusConflict)
+	if s := request("GET", "/admin/partition", "", http.StatusOK); !s.Partitioned {
+		t.Fatal("expected the network to be partitioned")
+	}
+
+	if s := request("POST", "/admin/heal", "", http.StatusOK); s.Partitioned {
+		t.Fatal("expected the network not to be partitioned after healing")
+	}
+	waitConnsUp(t, net.Network, cross...)
+	impairments = LinkImpairments{}
+	if err := client.Call(&impairments, "link_impairments"); err != nil {
+		t.Fatal(err)
+	}
+	if len(impairments.Blocked) != 0 {
+		t.Fatalf("expected node01 not to be blocked after healing, got %v", impairments.Blocked)
+	}
+}
+
+// TestAddressPrefix tests formatting overlay address prefixes in binary
+func TestAddressPrefix(t *testing.T) {
+	for _, test := range []struct {
+		addr   []byte
+		bits   int
+		prefix string
+	}{
+		{[]byte{0x80}, 1, "1"},
+		{[]byte{0x5f}, 3, "010"},
+		{[]byte{0xff, 0x00}, 8, "11111111"},
+		{nil, 2, "00"},
+	} {
+		if prefix := addressPrefix(test.addr, test.bits); prefix != test.prefix {
+			t.Fatalf("expected prefix of %x to %d bits to be %s, got %s", test.addr, test.bits, test.prefix, prefix)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+// pingTimeout is how long to wait for a pong reply to a pss ping
+const pingTimeout = 10 * time.Second
+
+// PssPing runs the pss ping protocol on a node and exposes an API to ping
+// other nodes over pss and measure the round trip time
+type PssPing struct {
+	pss   *pss.Pss
+	proto *pss.Protocol
+	quit  chan struct{}
+
+	mtx   sync.Mutex
+	peers map[string]*pingPeer
+}
+
+// pingPeer is a node which has been added as a ping peer, with pong replies
+// being sent to pongC
+type pingPeer struct {
+	sync.Mutex
+	ping  *pss.Ping
+	pongC chan struct{}
+}
+
+func newPssPing(ps *pss.Pss) (*PssPing, error) {
+	p := &PssPing{
+		pss:   ps,
+		quit:  make(chan struct{}),
+		peers: make(map[string]*pingPeer),
+	}
+
+	// reply to pings from nodes which were not explicitly added as ping
+	// peers, using a Ping per peer so that pongs are sent to the right peer
+	respond := &p2p.Protocol{
+		Name:    pss.PingProtocol.Name,
+		Version: pss.PingProtocol.Version,
+		Length:  uint64(pss.PingProtocol.MaxMsgSize),
+		Run: func(peer *p2p.Peer, rw p2p.MsgReadWriter) error {
+			ping := &pss.Ping{Pong: true, OutC: make(chan bool)}
+			return pss.NewPingProtocol(ping).Run(peer, rw)
+		},
+	}
+	proto, err := pss.RegisterProtocol(ps, &pss.PingTopic, pss.PingProtocol, respond, &pss.ProtocolParams{Asymmetric: true})
+	if err != nil {
+		return nil, err
+	}
+	ps.Register(&pss.PingTopic, proto.Handle)
+	p.proto = proto
+	return p, nil
+}
+
+// AddPeer adds the node with the given pss public key and overlay address
+// as a ping peer, so that it can be pinged and its pings replied to
+func (p *PssPing) AddPeer(pubkey []byte, addr pss.PssAddress) error {
+	key := crypto.ToECDSAPub(pubkey)
+	if key == nil {
+		return errors.New("invalid public key")
+	}
+	id := common.ToHex(pubkey)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if _, ok := p.peers[id]; ok {
+		return nil
+	}
+	if err := p.pss.SetPeerPublicKey(key, pss.PingTopic, &addr); err != nil {
+		return err
+	}
+	peer := &pingPeer{
+		ping: &pss.Ping{
+			Pong: true,
+			OutC: make(chan bool),
+			InC:  make(chan bool),
+		},
+		pongC: make(chan struct{}, 1),
+	}
+	p2pPeer := p2p.NewPeer(discover.NodeID{}, fmt.Sprintf("%x", addr), nil)
+	if _, err := p.proto.AddPeer(p2pPeer, pss.NewPingProtocol(peer.ping).Run, pss.PingTopic, true, id); err != nil {
+		return err
+	}
+	go p.readPongs(peer)
+	p.peers[id] = peer
+	return nil
+}
+
+// readPongs reads received ping messages from the peer, passing pongs to
+// the peer's pongC so they can be read by Ping
+func (p *PssPing) readPongs(peer *pingPeer) {
+	for {
+		select {
+		case pong := <-peer.ping.InC:
+			if !pong {
+				continue
+			}
+			select {
+			case peer.pongC <- struct{}{}:
+			default:
+			}
+		case <-p.quit:
+			p.drainPings(peer)
+			return
+		}
+	}
+}
+
+// drainPings discards pings received from the peer for pingTimeout after
+// stopping, as pss delivers them from the node's peer connections, which
+// would otherwise block and stop the node's p2p server from shutting down
+// (the node stops its services before its p2p server)
+func (p *PssPing) drainPings(peer *pingPeer) {
+	timeout := time.After(pingTimeout)
+	for {
+		select {
+		case <-peer.ping.InC:
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// Ping sends a ping to the ping peer with the given pss public key and
+// returns the time taken to receive a pong
+func (p *PssPing) Ping(pubkey []byte) (time.Duration, error) {
+	p.mtx.Lock()
+	peer, ok := p.peers[common.ToHex(pubkey)]
+	p.mtx.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("unknown ping peer: %x", pubkey)
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	// discard any late pong from a previous ping
+	select {
+	case <-peer.pongC:
+	default:
+	}
+
+	timeout := time.After(pingTimeout)
+	start := time.Now()
+	select {
+	case peer.ping.OutC <- false:
+	case <-timeout:
+		return 0, errors.New("timed out sending ping")
+	}
+	select {
+	case <-peer.pongC:
+		return time.Since(start), nil
+	case <-timeout:
+		return 0, errors.New("timed out waiting for pong")
+	}
+}
+
+func (p *PssPing) stop() {
+	close(p.quit)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+)
+
+// pssProber periodically pings between pairs of nodes in a simulation
+// network over pss, keeping the results of the last probe in a
+// reachability matrix which is served as JSON at /health/pss and as
+// Prometheus metrics at /metrics
+type pssProber struct {
+	net      *simulations.Network
+	interval time.Duration
+	sample   int
+	quit     chan struct{}
+
+	mtx     sync.RWMutex
+	results map[pingPair]*pingResult
+	updated time.Time
+}
+
+// pingPair is an ordered pair of nodes, pinging from One to Other
+type pingPair struct {
+	One   discover.NodeID
+	Other discover.NodeID
+}
+
+// pingResult is the result of a pss ping between two nodes
+type pingResult struct {
+	Reachable bool      `json:"reachable"`
+	RTT       float64   `json:"rtt_ms,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// pingMatrix is the reachability matrix served at /health/pss, with
+// Matrix[i][j] being the result of pinging Nodes[j] from Nodes[i] (or null
+// if the pair was not pinged in the last probe)
+type pingMatrix struct {
+	Updated   time.Time       `json:"updated"`
+	Nodes     []string        `json:"nodes"`
+	Reachable int             `json:"reachable"`
+	Total     int             `json:"total"`
+	Matrix    [][]*pingResult `json:"matrix"`
+}
+
+// newPssProber returns a prober which pings sample random pairs of nodes
+// (or all pairs if sample is zero) every interval
+func newPssProber(net *simulations.Network, interval time.Duration, sample int) *pssProber {
+	return &pssProber{
+		net:      net,
+		interval: interval,
+		sample:   sample,
+		quit:     make(chan struct{}),
+		results:  make(map[pingPair]*pingResult),
+	}
+}
+
+func (p *pssProber) Run() {
+	for {
+		p.probe()
+		select {
+		case <-time.After(p.interval):
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *pssProber) Stop() {
+	close(p.quit)
+}
+
+// pingNode is a running node along with its pss public key and overlay
+// address
+type pingNode struct {
+	*simulations.Node
+	pubkey []byte
+	addr   []byte
+}
+
+// probe pings the configured pairs of up nodes, with each node sending its
+// pings sequentially, then replaces the results of the previous probe
+func (p *pssProber) probe() {
+	var nodes []*pingNode
+	for _, node := range p.net.GetNodes() {
+		if !node.Up {
+			continue
+		}
+		client, err := node.Client()
+		if err != nil || client == nil {
+			continue
+		}
+		n := &pingNode{Node: node}
+		if err := client.Call(&n.pubkey, "pss_getPublicKey"); err != nil {
+			log.Warn("error getting pss public key", "node_id", node.ID(), "err", err)
+			continue
+		}
+		if err := client.Call(&n.addr, "pss_baseAddr"); err != nil {
+			log.Warn("error getting pss base address", "node_id", node.ID(), "err", err)
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+
+	var all [][2]*pingNode
+	for _, one := range nodes {
+		for _, other := range nodes {
+			if one != other {
+				all = append(all, [2]*pingNode{one, other})
+			}
+		}
+	}
+	if p.sample > 0 && p.sample < len(all) {
+		sampled := make([][2]*pingNode, p.sample)
+		for i, j := range rand.Perm(len(all))[:p.sample] {
+			sampled[i] = all[j]
+		}
+		all = sampled
+	}
+	pairs := make(map[*pingNode][]*pingNode)
+	for _, pair := range all {
+		pairs[pair[0]] = append(pairs[pair[0]], pair[1])
+	}
+
+	var (
+		wg         sync.WaitGroup
+		resultsMtx sync.Mutex
+	)
+	results := make(map[pingPair]*pingResult, len(all))
+	for one, others := range pairs {
+		wg.Add(1)
+		go func(one *pingNode, others []*pingNode) {
+			defer wg.Done()
+			for _, other := range others {
+				rtt, err := p.ping(one, other)
+				result := newPingResult(one, other, rtt, err)
+				resultsMtx.Lock()
+				results[pingPair{one.ID(), other.ID()}] = result
+				resultsMtx.Unlock()
+			}
+		}(one, others)
+	}
+	wg.Wait()
+
+	p.mtx.Lock()
+	p.results = results
+	p.updated = time.Now()
+	p.mtx.Unlock()
+}
+
+// ping adds the two nodes as ping peers of each other then pings other
+// from one, returning the round trip time
+func (p *pssProber) ping(one, other *pingNode) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*pingTimeout)
+	defer cancel()
+	oneClient, err := one.Client()
+	if err != nil {
+		return 0, err
+	}
+	otherClient, err := other.Client()
+	if err != nil {
+		return 0, err
+	}
+	if err := oneClient.CallContext(ctx, nil, "pssping_addPeer", other.pubkey, other.addr); err != nil {
+		return 0, fmt.Errorf("error adding ping peer: %s", err)
+	}
+	if err := otherClient.CallContext(ctx, nil, "pssping_addPeer", one.pubkey, one.addr); err != nil {
+		return 0, fmt.Errorf("error adding ping peer: %s", err)
+	}
+	var rtt time.Duration
+	return rtt, oneClient.CallContext(ctx, &rtt, "pssping_ping", other.pubkey)
+}
+
+func newPingResult(one, other *pingNode, rtt time.Duration, err error) *pingResult {
+	result := &pingResult{Time: time.Now()}
+	if err != nil {
+		log.Warn("pss ping failed", "from", one.ID(), "to", other.ID(), "err", err)
+		result.Error = err.Error()
+	} else {
+		result.Reachable = true
+		result.RTT = float64(rtt) / float64(time.Millisecond)
+	}
+	return result
+}
+
+// Matrix returns the reachability matrix of the last probe
+func (p *pssProber) Matrix() *pingMatrix {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	nodes := p.net.GetNodes()
+	m := &pingMatrix{
+		Updated: p.updated,
+		Nodes:   make([]string, len(nodes)),
+		Matrix:  make([][]*pingResult, len(nodes)),
+	}
+	for i, one := range nodes {
+		m.Nodes[i] = one.Config.Name
+		m.Matrix[i] = make([]*pingResult, len(nodes))
+		for j, other := range nodes {
+			result, ok := p.results[pingPair{one.ID(), other.ID()}]
+			if !ok {
+				continue
+			}
+			m.Matrix[i][j] = result
+			m.Total++
+			if result.Reachable {
+				m.Reachable++
+			}
+		}
+	}
+	return m
+}
+
+func (p *pssProber) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/health/pss":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(p.Matrix())
+	case "/metrics":
+		p.serveMetrics(w)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// serveMetrics writes the reachability matrix in the Prometheus text
+// exposition format
+func (p *pssProber) serveMetrics(w http.ResponseWriter) {
+	m := p.Matrix()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP pss_ping_reachable Whether the last pss ping between two nodes received a pong.")
+	fmt.Fprintln(w, "# TYPE pss_ping_reachable gauge")
+	for i, row := range m.Matrix {
+		for j, result := range row {
+			if result == nil {
+				continue
+			}
+			reachable := 0
+			if result.Reachable {
+				reachable = 1
+			}
+			fmt.Fprintf(w, "pss_ping_reachable{from=%q,to=%q} %d\n", m.Nodes[i], m.Nodes[j], reachable)
+		}
+	}
+	fmt.Fprintln(w, "# HELP pss_ping_rtt_seconds Round trip time of the last successful pss ping between two nodes.")
+	fmt.Fprintln(w, "# TYPE pss_ping_rtt_seconds gauge")
+	for i, row := range m.Matrix {
+		for j, result := range row {
+			if result == nil || !result.Reachable {
+				continue
+			}
+			fmt.Fprintf(w, "pss_ping_rtt_seconds{from=%q,to=%q} %g\n", m.Nodes[i], m.Nodes[j], result.RTT/1000)
+		}
+	}
+	fmt.Fprintln(w, "# HELP pss_ping_reachable_pairs Number of node pairs reachable over pss in the last probe.")
+	fmt.Fprintln(w, "# TYPE pss_ping_reachable_pairs gauge")
+	fmt.Fprintf(w, "pss_ping_reachable_pairs %d\n", m.Reachable)
+	fmt.Fprintln(w, "# HELP pss_ping_pairs Number of node pairs pinged over pss in the last probe.")
+	fmt.Fprintln(w, "# TYPE pss_ping_pairs gauge")
+	fmt.Fprintf(w, "pss_ping_pairs %d\n", m.Total)
+}
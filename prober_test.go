@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+)
+
+// TestPssProber tests probing every pair of nodes in a network with
+// pssping_ping, and serving the results at /health/pss and /metrics
+func TestPssProber(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "pss-demo-prober")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	net, err := NewPssSimulation(adapters.NewSimAdapter(services), 3, logDir, &keyStore{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer net.Shutdown()
+	waitForPeers(t, net.GetNodes(), 2, kademliaPeers)
+
+	// probe until every pair is reachable, as the first pings may be sent
+	// before pss can route between all of the nodes
+	prober := newPssProber(net, time.Second, 0)
+	const pairs = 6
+	for start := time.Now(); ; {
+		prober.probe()
+		m := prober.Matrix()
+		if m.Total != pairs {
+			t.Fatalf("expected %d pairs to be pinged, got %d", pairs, m.Total)
+		}
+		if m.Reachable == pairs {
+			break
+		}
+		if time.Since(start) > 20*time.Second {
+			t.Fatalf("timed out waiting for all pairs to be reachable, %d of %d reachable", m.Reachable, pairs)
+		}
+	}
+
+	srv := httptest.NewServer(prober)
+	defer srv.Close()
+	get := func(path string) *http.Response {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected GET %s to return 200, got %s", path, res.Status)
+		}
+		return res
+	}
+
+	res := get("/health/pss")
+	var m pingMatrix
+	err = json.NewDecoder(res.Body).Decode(&m)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Reachable != pairs || m.Total != pairs || len(m.Matrix) != 3 {
+		t.Fatalf("unexpected matrix: %+v", m)
+	}
+	for i, row := range m.Matrix {
+		for j, result := range row {
+			if i == j {
+				if result != nil {
+					t.Fatalf("expected %s not to ping itself", m.Nodes[i])
+				}
+				continue
+			}
+			if result == nil || !result.Reachable || result.RTT <= 0 {
+				t.Fatalf("expected %s to reach %s with an RTT, got %+v", m.Nodes[i], m.Nodes[j], result)
+			}
+		}
+	}
+
+	res = get("/metrics")
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i == -1 {
+			t.Fatalf("invalid metrics line: %q", line)
+		}
+		metrics[line[:i]] = line[i+1:]
+	}
+	for _, name := range []string{"pss_ping_reachable_pairs", "pss_ping_pairs"} {
+		if v := metrics[name]; v != strconv.Itoa(pairs) {
+			t.Fatalf("expected %s to be %d, got %q", name, pairs, v)
+		}
+	}
+	for _, one := range m.Nodes {
+		for _, other := range m.Nodes {
+			if one == other {
+				continue
+			}
+			labels := fmt.Sprintf("{from=%q,to=%q}", one, other)
+			if v := metrics["pss_ping_reachable"+labels]; v != "1" {
+				t.Fatalf("expected pss_ping_reachable%s to be 1, got %q", labels, v)
+			}
+			rtt, err := strconv.ParseFloat(metrics["pss_ping_rtt_seconds"+labels], 64)
+			if err != nil || rtt <= 0 {
+				t.Fatalf("expected pss_ping_rtt_seconds%s to be positive, got %q", labels, metrics["pss_ping_rtt_seconds"+labels])
+			}
+		}
+	}
+
+	// check the pairs of a stopped node are dropped by the next probe
+	stopped := net.GetNodeByName("node03")
+	if err := net.Stop(stopped.ID()); err != nil {
+		t.Fatal(err)
+	}
+	prober.probe()
+	m = *prober.Matrix()
+	if m.Total != 2 {
+		t.Fatalf("expected 2 pairs to be pinged without node03, got %d", m.Total)
+	}
+	for i, row := range m.Matrix {
+		for j, result := range row {
+			if (m.Nodes[i] == "node03" || m.Nodes[j] == "node03") && result != nil {
+				t.Fatalf("expected no result for %s - %s after node03 stopped, got %+v", m.Nodes[i], m.Nodes[j], result)
+			}
+		}
+	}
+}
@@ -1,29 +1,42 @@
 package main
 
 import (
-	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"time"
 
 	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/p2p/simulations"
 	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/ethereum/go-ethereum/swarm/network"
 	"github.com/ethereum/go-ethereum/swarm/pss"
 	"github.com/ethereum/go-ethereum/swarm/storage"
-	whisper "github.com/ethereum/go-ethereum/whisper/whisperv5"
 )
 
-func NewPssSimulation(adapter adapters.NodeAdapter, nodeCount int, logDir string) (net *simulations.Network, err error) {
+func NewPssSimulation(adapter adapters.NodeAdapter, nodeCount int, logDir string, keys *keyStore, swarm bool) (*simulations.Network, error) {
+	return newPssNetwork(adapter, "", nodeCount, topologyRing, logDir, keys, swarm)
+}
+
+// newPssNetwork starts a network of pss nodes connected in the given
+// topology, with the node names prefixed with the network name if set
+func newPssNetwork(adapter adapters.NodeAdapter, name string, nodeCount int, topology topology, logDir string, keys *keyStore, swarm bool) (_ *simulations.Network, err error) {
 	if nodeCount < 2 {
 		return nil, fmt.Errorf("Minimum two nodes in network")
 	}
 	nodes := make([]*simulations.Node, nodeCount)
-	net = simulations.NewNetwork(adapter, &simulations.NetworkConfig{
-		ID: "pss-demo",
+	id := "pss-demo"
+	if name != "" {
+		id += "-" + name
+	}
+	net := simulations.NewNetwork(adapter, &simulations.NetworkConfig{
+		ID: id,
 	})
 	defer func() {
 		if err != nil {
@@ -31,75 +44,340 @@ func NewPssSimulation(adapter adapters.NodeAdapter, nodeCount int, logDir string
 		}
 	}()
 	for i := 0; i < nodeCount; i++ {
-		node, err := net.NewNodeWithConfig(&adapters.NodeConfig{
-			Services: []string{"bzz", "pss"},
-		})
+		node, err := newPssNode(net, pssNodeName(name, i), logDir, keys, swarm)
 		if err != nil {
 			return nil, err
 		}
-		node.Config.LogFile = filepath.Join(logDir, fmt.Sprintf("%s.log", node.ID().TerminalString()))
 		if err := net.Start(node.ID()); err != nil {
 			return nil, err
 		}
-		if i > 0 {
-			if err := net.Connect(node.ID(), nodes[i-1].ID()); err != nil {
-				return nil, err
-			}
-		}
 		nodes[i] = node
 	}
-	if nodeCount > 2 {
-		if err := net.Connect(nodes[0].ID(), nodes[len(nodes)-1].ID()); err != nil {
-			return nil, fmt.Errorf("error connecting first and last nodes")
+	for _, conn := range topology.conns(nodeCount) {
+		if err := net.Connect(nodes[conn[0]].ID(), nodes[conn[1]].ID()); err != nil {
+			return nil, fmt.Errorf("error connecting %s to %s: %s", nodes[conn[0]].Config.Name, nodes[conn[1]].Config.Name, err)
 		}
 	}
-	return
+	return net, nil
+}
+
+// pssNodeName returns the name of the node with the given index in the
+// network with the given name ("" for the default network)
+func pssNodeName(network string, i int) string {
+	if network == "" {
+		return fmt.Sprintf("node%02d", i+1)
+	}
+	return fmt.Sprintf("%s-node%02d", network, i+1)
+}
+
+// newPssNode creates a node in the network running the bzz and pss
+// services, and the swarm service if swarm is set, with its node ID derived
+// from the "p2p" key in keys and logs written to logDir
+func newPssNode(net *simulations.Network, name, logDir string, keys *keyStore, swarm bool) (*simulations.Node, error) {
+	key, err := keys.key(name, "p2p")
+	if err != nil {
+		return nil, err
+	}
+	services := []string{"bzz", "pss"}
+	if swarm {
+		services = append(services, "swarm")
+	}
+	node, err := net.NewNodeWithConfig(&adapters.NodeConfig{
+		ID:         discover.PubkeyID(&key.PublicKey),
+		PrivateKey: key,
+		Name:       name,
+		Services:   services,
+	})
+	if err != nil {
+		return nil, err
+	}
+	node.Config.LogFile = filepath.Join(logDir, fmt.Sprintf("%s.log", node.ID().TerminalString()))
+	return node, nil
+}
+
+// pssService wraps a pss node, exposing the demo APIs alongside the pss
+// APIs
+type pssService struct {
+	*pss.Pss
+	ping *PssPing
+	chat *PssChat
+
+	// logLevel is the log level of exec nodes, which is exposed by the
+	// debug API (nil for sim nodes)
+	logLevel *logLevel
+
+	// links are the impairments of the links the node dials, which are
+	// set by the demo using the link API
+	links *nodeLinks
+
+	// tmpDir is the temporary pss cache directory which is removed when
+	// the service stops
+	tmpDir string
+}
+
+func (s *pssService) APIs() []rpc.API {
+	apis := append(s.Pss.APIs(), rpc.API{
+		Namespace: "pssping",
+		Version:   "1.0",
+		Service:   s.ping,
+		Public:    true,
+	}, rpc.API{
+		Namespace: "chat",
+		Version:   "1.0",
+		Service:   s.chat,
+		Public:    true,
+	})
+	apis = append(apis, rpc.API{
+		Namespace: "link",
+		Version:   "1.0",
+		Service:   &LinkAPI{links: s.links},
+	})
+	if s.logLevel != nil {
+		apis = append(apis, rpc.API{
+			Namespace: "debug",
+			Version:   "1.0",
+			Service:   &NodeDebugAPI{level: s.logLevel},
+		})
+	}
+	return apis
+}
+
+// Start enables p2p message events before starting pss, so that pss message
+// hops are included in the simulation API's event stream (the exec adapter
+// disables them, unlike the sim adapter)
+//
+// Services are started before the node is connected to any peers, which
+// read the setting when they are added.
+//
+// Connections dialled by any node are impaired according to the node's link
+// settings (see impairedConn), which also buffers them in both directions, as
+// pss forwards messages from the read loop of the peer which sent them, so
+// sim nodes forwarding to each other over unbuffered net.Pipe connections
+// would otherwise deadlock.
+func (s *pssService) Start(srv *p2p.Server) error {
+	srv.EnableMsgEvents = true
+	if srv.Dialer != nil {
+		srv.Dialer = &impairedDialer{NodeDialer: srv.Dialer, links: s.links}
+	}
+	return s.Pss.Start(srv)
+}
+
+// Stop stops the ping and chat protocols and pss, then removes the
+// temporary pss cache directory
+func (s *pssService) Stop() error {
+	s.ping.stop()
+	s.chat.stop()
+	err := s.Pss.Stop()
+	if s.tmpDir != "" {
+		os.RemoveAll(s.tmpDir)
+	}
+	return err
+}
+
+// serviceConfigEnv is the environment variable used to pass the service
+// configuration from the demo process to the simulation nodes (exec nodes
+// inherit the environment of the demo process)
+const serviceConfigEnv = "PSS_DEMO_SERVICE_CONFIG"
+
+// serviceConfig is the configuration of the services run by the simulation
+// nodes
+type serviceConfig struct {
+	// Keys is used to load the pss private keys of nodes
+	Keys keyStore `json:"keys"`
+
+	// Kademlia is the Kademlia configuration of the nodes
+	Kademlia kademliaConfig `json:"kademlia"`
+
+	// MsgTTL is the time to live of pss messages
+	MsgTTL duration `json:"msg_ttl"`
+
+	// NodeMsgTTL overrides MsgTTL on individual nodes, keyed by node name
+	NodeMsgTTL map[string]duration `json:"node_msg_ttl,omitempty"`
+
+	// DataDir, if set, is the directory containing the persistent data
+	// directory of each node as <DataDir>/<name> (otherwise temporary
+	// directories are used)
+	DataDir string `json:"data_dir,omitempty"`
+
+	// Handshake, if set, enables the pss handshake controller on all nodes
+	// using the given params
+	Handshake *handshakeConfig `json:"handshake,omitempty"`
+
+	// NodeHandshake enables the pss handshake controller on individual
+	// nodes, keyed by node name (e.g. "node01"), overriding Handshake
+	NodeHandshake map[string]*handshakeConfig `json:"node_handshake,omitempty"`
+
+	// Log is the log format and initial log level of exec nodes
+	Log nodeLogConfig `json:"log"`
+}
+
+// handshakeParams returns the handshake params for the node with the given
+// name, or nil if the handshake controller should not be enabled
+func (c *serviceConfig) handshakeParams(name string) *pss.HandshakeParams {
+	if config, ok := c.NodeHandshake[name]; ok {
+		return config.params()
+	}
+	if c.Handshake != nil {
+		return c.Handshake.params()
+	}
+	return nil
+}
+
+// handshakeConfig is the pss handshake params of a node, with the timeouts
+// encoded as durations (e.g. "30s") rather than nanoseconds
+type handshakeConfig struct {
+	SymKeyRequestTimeout duration
+	SymKeyExpiryTimeout  duration
+	SymKeySendLimit      uint16
+	SymKeyCapacity       uint8
+}
+
+// newHandshakeConfig returns the default pss handshake params
+func newHandshakeConfig() *handshakeConfig {
+	params := pss.NewHandshakeParams()
+	return &handshakeConfig{
+		SymKeyRequestTimeout: duration(params.SymKeyRequestTimeout),
+		SymKeyExpiryTimeout:  duration(params.SymKeyExpiryTimeout),
+		SymKeySendLimit:      params.SymKeySendLimit,
+		SymKeyCapacity:       params.SymKeyCapacity,
+	}
+}
+
+// params returns the config as pss handshake params
+func (c *handshakeConfig) params() *pss.HandshakeParams {
+	return &pss.HandshakeParams{
+		SymKeyRequestTimeout: time.Duration(c.SymKeyRequestTimeout),
+		SymKeyExpiryTimeout:  time.Duration(c.SymKeyExpiryTimeout),
+		SymKeySendLimit:      c.SymKeySendLimit,
+		SymKeyCapacity:       c.SymKeyCapacity,
+	}
+}
+
+// setServiceConfig sets the service configuration for nodes started by the
+// current process
+func setServiceConfig(config *serviceConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return os.Setenv(serviceConfigEnv, string(data))
+}
+
+// loadServiceConfig loads the service configuration set by the demo process,
+// using the default Kademlia and pss configuration if not set
+func loadServiceConfig() (*serviceConfig, error) {
+	defaults := defaultConfig()
+	config := &serviceConfig{
+		Kademlia: defaults.Kademlia,
+		MsgTTL:   defaults.Pss.MsgTTL,
+		Log:      defaults.Log.Node,
+	}
+	data := os.Getenv(serviceConfigEnv)
+	if data == "" {
+		return config, nil
+	}
+	if err := json.Unmarshal([]byte(data), config); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %s", serviceConfigEnv, err)
+	}
+	return config, nil
 }
 
 func init() {
 	adapters.RegisterServices(services)
 }
 
+// ignoreInterrupt ignores SIGINT when running as an exec node
+//
+// Exec nodes run in the demo's process group so also receive the SIGINT sent
+// by Ctrl-C, which would stop them while the demo is still draining clients
+// (the demo stops them with SIGTERM once drained). This is called when
+// starting services rather than in init so that it overrides the signal
+// handler installed by the shutdown package.
+func ignoreInterrupt() {
+	if os.Args[0] == "p2p-node" {
+		signal.Ignore(os.Interrupt)
+	}
+}
+
 var services = func() adapters.Services {
 	kademlias := make(map[discover.NodeID]*network.Kademlia)
-	kademlia := func(id discover.NodeID) *network.Kademlia {
+	kademlia := func(id discover.NodeID, config *kademliaConfig) *network.Kademlia {
 		if k, ok := kademlias[id]; ok {
 			return k
 		}
 		addr := network.NewAddrFromNodeID(id)
 		params := network.NewKadParams()
-		params.MinProxBinSize = 2
-		params.MaxBinSize = 3
-		params.MinBinSize = 1
-		params.MaxRetries = 1000
-		params.RetryExponent = 2
-		params.RetryInterval = 1000000
+		params.MinProxBinSize = config.MinProxBinSize
+		params.MaxBinSize = config.MaxBinSize
+		params.MinBinSize = config.MinBinSize
+		params.MaxRetries = config.MaxRetries
+		params.RetryExponent = config.RetryExponent
+		params.RetryInterval = config.RetryInterval
 		kademlias[id] = network.NewKademlia(addr.Over(), params)
 		return kademlias[id]
 	}
 	return adapters.Services{
 		"pss": func(ctx *adapters.ServiceContext) (node.Service, error) {
-			cachedir, err := ioutil.TempDir("", "pss-cache")
+			ignoreInterrupt()
+			config, err := loadServiceConfig()
 			if err != nil {
-				return nil, fmt.Errorf("create pss cache tmpdir failed", "error", err)
+				return nil, err
+			}
+			logLevel, err := setupNodeLogging(&config.Log, ctx.Config.ID, ctx.Config.Name)
+			if err != nil {
+				return nil, err
+			}
+			privkey, err := config.Keys.key(ctx.Config.Name, "pss")
+			if err != nil {
+				return nil, err
+			}
+			var cachedir, tmpdir string
+			if config.DataDir != "" {
+				cachedir = filepath.Join(config.DataDir, ctx.Config.Name, "pss-cache")
+				if err := os.MkdirAll(cachedir, 0755); err != nil {
+					return nil, fmt.Errorf("create pss cache dir failed: %s", err)
+				}
+			} else {
+				tmpdir, err = ioutil.TempDir("", "pss-cache")
+				if err != nil {
+					return nil, fmt.Errorf("create pss cache tmpdir failed: %s", err)
+				}
+				cachedir = tmpdir
 			}
 			dpa, err := storage.NewLocalDPA(cachedir, "")
 			if err != nil {
-				return nil, fmt.Errorf("local dpa creation failed", "error", err)
+				os.RemoveAll(tmpdir)
+				return nil, fmt.Errorf("local dpa creation failed: %s", err)
 			}
-
-			ctxlocal, _ := context.WithTimeout(context.Background(), time.Second)
-			w := whisper.New(&whisper.DefaultConfig)
-			wapi := whisper.NewPublicWhisperAPI(w)
-			keys, err := wapi.NewKeyPair(ctxlocal)
-			privkey, err := w.GetPrivateKey(keys)
 			pssp := pss.NewPssParams(privkey)
-			pssp.MsgTTL = time.Second * 30
-			pskad := kademlia(ctx.Config.ID)
+			pssp.MsgTTL = time.Duration(config.MsgTTL)
+			if ttl, ok := config.NodeMsgTTL[ctx.Config.Name]; ok {
+				pssp.MsgTTL = time.Duration(ttl)
+			}
+			pskad := kademlia(ctx.Config.ID, &config.Kademlia)
 			ps := pss.NewPss(pskad, dpa, pssp)
-			return ps, nil
+			if params := config.handshakeParams(ctx.Config.Name); params != nil {
+				if err := pss.SetHandshakeController(ps, params); err != nil {
+					os.RemoveAll(tmpdir)
+					return nil, fmt.Errorf("error setting pss handshake controller: %s", err)
+				}
+			}
+			ping, err := newPssPing(ps)
+			if err != nil {
+				os.RemoveAll(tmpdir)
+				return nil, fmt.Errorf("error registering pss ping protocol: %s", err)
+			}
+			return &pssService{Pss: ps, ping: ping, chat: newPssChat(ps), logLevel: logLevel, links: &nodeLinks{}, tmpDir: tmpdir}, nil
 		},
 		"bzz": func(ctx *adapters.ServiceContext) (node.Service, error) {
+			serviceConfig, err := loadServiceConfig()
+			if err != nil {
+				return nil, err
+			}
+			var store network.StateStore
+			if serviceConfig.DataDir != "" {
+				store = &fileStateStore{dir: filepath.Join(serviceConfig.DataDir, ctx.Config.Name, "state")}
+			}
 			addr := network.NewAddrFromNodeID(ctx.Config.ID)
 			hp := network.NewHiveParams()
 			config := &network.BzzConfig{
@@ -107,7 +385,18 @@ var services = func() adapters.Services {
 				UnderlayAddr: addr.Under(),
 				HiveParams:   hp,
 			}
-			return network.NewBzz(config, kademlia(ctx.Config.ID), nil), nil
+			return network.NewBzz(config, kademlia(ctx.Config.ID, &serviceConfig.Kademlia), store), nil
+		},
+		"swarm": func(ctx *adapters.ServiceContext) (node.Service, error) {
+			config, err := loadServiceConfig()
+			if err != nil {
+				return nil, err
+			}
+			var dir string
+			if config.DataDir != "" {
+				dir = filepath.Join(config.DataDir, ctx.Config.Name, "swarm")
+			}
+			return newSwarmService(kademlia(ctx.Config.ID, &config.Kademlia), dir)
 		},
 	}
 }()
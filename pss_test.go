@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+	"github.com/ethereum/go-ethereum/swarm/pss"
+)
+
+// TestPssServiceStop tests that stopping a node removes its temporary pss
+// cache directory
+func TestPssServiceStop(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "pss-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	net, err := NewPssSimulation(adapters.NewSimAdapter(services), 2, logDir, &keyStore{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer net.Shutdown()
+	node := net.GetNodes()[0]
+
+	var tmpDir string
+	for _, service := range node.Node.(*adapters.SimNode).Services() {
+		if s, ok := service.(*pssService); ok {
+			tmpDir = s.tmpDir
+		}
+	}
+	if tmpDir == "" {
+		t.Fatal("expected the pss service to have a temporary cache directory")
+	}
+	if _, err := os.Stat(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := net.Stop(node.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed when the node stopped, got %v", tmpDir, err)
+	}
+}
+
+// TestHandshakeConfig tests that per-node handshake params loaded from a
+// --handshake-config file reach the nodes through the service config
+func TestHandshakeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pss-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handshake.json")
+	if err := ioutil.WriteFile(path, []byte(`{"node01": {"SymKeyExpiryTimeout": "1m", "SymKeyCapacity": 2}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodeHandshake, err := loadHandshakeConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setServiceConfig(&serviceConfig{NodeHandshake: nodeHandshake}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(serviceConfigEnv)
+
+	config, err := loadServiceConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := pss.NewHandshakeParams()
+	expected.SymKeyExpiryTimeout = time.Minute
+	expected.SymKeyCapacity = 2
+	if params := config.handshakeParams("node01"); params == nil || *params != *expected {
+		t.Fatalf("expected node01 to have handshake params %+v, got %+v", expected, params)
+	}
+	if params := config.handshakeParams("node02"); params != nil {
+		t.Fatalf("expected node02 not to have handshake params, got %+v", params)
+	}
+
+	// only node01 should serve the handshake API
+	net, err := NewPssSimulation(adapters.NewSimAdapter(services), 2, dir, &keyStore{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer net.Shutdown()
+	for _, node := range net.GetNodes() {
+		client, err := node.Client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.Call(nil, "pss_addHandshake", pss.Topic{0x6a, 0x8b, 0x3c, 0x1d})
+		if node.Config.Name == "node01" && err != nil {
+			t.Fatalf("expected node01 to serve pss_addHandshake, got %s", err)
+		} else if node.Config.Name != "node01" && (err == nil || !strings.Contains(err.Error(), "does not exist")) {
+			t.Fatalf("expected %s not to serve pss_addHandshake, got %v", node.Config.Name, err)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/protocols"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/swarm/network"
+	"github.com/ethereum/go-ethereum/swarm/storage"
+)
+
+// chunkRetrieveTimeout is how long to wait for a peer to deliver a chunk
+const chunkRetrieveTimeout = 5 * time.Second
+
+var errChunkNotFound = errors.New("chunk not found")
+
+// chunkSpec is the protocol used to forward chunks and retrieve requests
+// between the Swarm chunk stores of nodes
+var chunkSpec = &protocols.Spec{
+	Name:       "chunks",
+	Version:    1,
+	MaxMsgSize: 16 * 1024,
+	Messages: []interface{}{
+		chunkStoreMsg{},
+		chunkRetrieveMsg{},
+		chunkDeliveryMsg{},
+	},
+}
+
+// chunkStoreMsg asks a peer to store a chunk
+type chunkStoreMsg struct {
+	Key  []byte
+	Data []byte
+}
+
+// chunkRetrieveMsg asks a peer to retrieve a chunk, with the chunk being
+// sent back in a chunkDeliveryMsg with the same ID
+type chunkRetrieveMsg struct {
+	ID  uint64
+	Key []byte
+}
+
+// chunkDeliveryMsg is the response to a chunkRetrieveMsg, with empty Data
+// if the chunk was not found
+type chunkDeliveryMsg struct {
+	ID   uint64
+	Data []byte
+}
+
+// swarmService runs a Swarm chunk store on a node
+//
+// Chunks are stored by the node closest to their key in the Kademlia
+// overlay, with store and retrieve requests being forwarded to the connected
+// peer closest to the key until they reach a node which has no closer peers.
+type swarmService struct {
+	kad    *network.Kademlia
+	store  *storage.LocalStore
+	hasher storage.SwarmHasher
+
+	// tmpDir is the temporary store directory which is removed when the
+	// service stops
+	tmpDir string
+
+	mtx     sync.Mutex
+	peers   map[discover.NodeID]*protocols.Peer
+	pending map[uint64]chan []byte
+	nextID  uint64
+}
+
+// newSwarmService returns a Swarm chunk store service which stores chunks
+// in dir, or in a temporary directory if dir is empty
+func newSwarmService(kad *network.Kademlia, dir string) (*swarmService, error) {
+	var tmpDir string
+	if dir == "" {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "pss-demo-swarm")
+		if err != nil {
+			return nil, fmt.Errorf("create swarm tmpdir failed: %s", err)
+		}
+		dir = tmpDir
+	}
+	hasher := storage.MakeHashFunc("SHA3")
+	store, err := storage.NewLocalStore(hasher, storage.NewStoreParams(dir))
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, fmt.Errorf("local store creation failed: %s", err)
+	}
+	return &swarmService{
+		kad:     kad,
+		store:   store,
+		hasher:  hasher,
+		tmpDir:  tmpDir,
+		peers:   make(map[discover.NodeID]*protocols.Peer),
+		pending: make(map[uint64]chan []byte),
+	}, nil
+}
+
+func (s *swarmService) Protocols() []p2p.Protocol {
+	return []p2p.Protocol{{
+		Name:    chunkSpec.Name,
+		Version: chunkSpec.Version,
+		Length:  chunkSpec.Length(),
+		Run:     s.run,
+	}}
+}
+
+func (s *swarmService) APIs() []rpc.API {
+	return []rpc.API{{
+		Namespace: "swarm",
+		Version:   "1.0",
+		Service:   &SwarmAPI{s},
+		Public:    true,
+	}}
+}
+
+func (s *swarmService) Start(*p2p.Server) error {
+	return nil
+}
+
+func (s *swarmService) Stop() error {
+	s.store.Close()
+	if s.tmpDir != "" {
+		os.RemoveAll(s.tmpDir)
+	}
+	return nil
+}
+
+func (s *swarmService) run(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+	peer := protocols.NewPeer(p, rw, chunkSpec)
+	s.mtx.Lock()
+	s.peers[p.ID()] = peer
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.peers, p.ID())
+		s.mtx.Unlock()
+	}()
+	return peer.Run(func(msg interface{}) error {
+		return s.handleMsg(peer, msg)
+	})
+}
+
+// handleMsg handles a message from a peer, forwarding requests in separate
+// goroutines so that peers sending to each other do not block
+func (s *swarmService) handleMsg(peer *protocols.Peer, msg interface{}) error {
+	switch msg := msg.(type) {
+	case *chunkStoreMsg:
+		go func() {
+			if err := s.storeChunk(msg.Key, msg.Data); err != nil {
+				log.Warn("error storing chunk", "key", storage.Key(msg.Key).Log(), "peer", peer.ID(), "err", err)
+			}
+		}()
+	case *chunkRetrieveMsg:
+		go func() {
+			data, _ := s.retrieveChunk(msg.Key)
+			peer.Send(&chunkDeliveryMsg{ID: msg.ID, Data: data})
+		}()
+	case *chunkDeliveryMsg:
+		s.mtx.Lock()
+		ch, ok := s.pending[msg.ID]
+		s.mtx.Unlock()
+		if ok {
+			select {
+			case ch <- msg.Data:
+			default:
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected message type %T", msg)
+	}
+	return nil
+}
+
+// storeChunk stores the chunk locally if there are no connected peers closer
+// to its key, otherwise forwards it to the closest peer
+func (s *swarmService) storeChunk(key, data []byte) error {
+	if err := s.validateChunk(key, data); err != nil {
+		return err
+	}
+	if peer := s.closestPeer(key); peer != nil {
+		return peer.Send(&chunkStoreMsg{Key: key, Data: data})
+	}
+	chunk := storage.NewChunk(storage.Key(key), nil)
+	chunk.SData = data
+	chunk.Size = int64(binary.LittleEndian.Uint64(data[:8]))
+	s.store.Put(chunk)
+	return nil
+}
+
+// validateChunk checks the key is the hash of the chunk data
+func (s *swarmService) validateChunk(key, data []byte) error {
+	if len(data) < 8 {
+		return errors.New("chunk too short")
+	}
+	hasher := s.hasher()
+	hasher.ResetWithLength(data[:8])
+	hasher.Write(data[8:])
+	if !bytes.Equal(hasher.Sum(nil), key) {
+		return errors.New("chunk key does not match its data")
+	}
+	return nil
+}
+
+// retrieveChunk returns the chunk from the local store if it is stored
+// locally, otherwise requests it from the connected peer closest to its key
+func (s *swarmService) retrieveChunk(key []byte) ([]byte, error) {
+	if chunk, err := s.store.Get(storage.Key(key)); err == nil {
+		return chunk.SData, nil
+	}
+	peer := s.closestPeer(key)
+	if peer == nil {
+		return nil, errChunkNotFound
+	}
+
+	ch := make(chan []byte, 1)
+	s.mtx.Lock()
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = ch
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.pending, id)
+		s.mtx.Unlock()
+	}()
+
+	if err := peer.Send(&chunkRetrieveMsg{ID: id, Key: key}); err != nil {
+		return nil, err
+	}
+	select {
+	case data := <-ch:
+		if len(data) == 0 {
+			return nil, errChunkNotFound
+		}
+		return data, nil
+	case <-time.After(chunkRetrieveTimeout):
+		return nil, fmt.Errorf("timed out retrieving chunk from %s", peer.ID().TerminalString())
+	}
+}
+
+// closestPeer returns the connected peer closest to the key if it is closer
+// than this node, or nil if this node is the closest
+//
+// Kademlia iterates connections by proximity order, which does not order
+// peers in the same bin, so all connections are compared by XOR distance.
+func (s *swarmService) closestPeer(key []byte) *protocols.Peer {
+	closest := s.kad.BaseAddr()
+	var peer *protocols.Peer
+	s.kad.EachConn(key, 255, func(conn network.OverlayConn, _ int, _ bool) bool {
+		if !closer(key, conn.Address(), closest) {
+			return true
+		}
+		if p := s.peer(conn); p != nil {
+			closest, peer = conn.Address(), p
+		}
+		return true
+	})
+	return peer
+}
+
+// peer returns the chunk protocol peer of the Kademlia connection, or nil if
+// the peer is not running the chunk protocol
+func (s *swarmService) peer(conn network.OverlayConn) *protocols.Peer {
+	p, ok := conn.(interface {
+		ID() discover.NodeID
+	})
+	if !ok {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.peers[p.ID()]
+}
+
+// closer returns whether a is closer to the key than b by XOR distance
+func closer(key, a, b []byte) bool {
+	for i := range key {
+		if i >= len(a) || i >= len(b) {
+			break
+		}
+		if da, db := key[i]^a[i], key[i]^b[i]; da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// chunks returns the keys of the chunks in the local store
+func (s *swarmService) chunks() ([]storage.Key, error) {
+	db, ok := s.store.DbStore.(*storage.DbStore)
+	if !ok {
+		return nil, fmt.Errorf("unexpected store type %T", s.store.DbStore)
+	}
+	it, err := db.NewSyncIterator(storage.DbSyncState{
+		Stop: bytes.Repeat([]byte{0xff}, 32),
+		Last: math.MaxUint64,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var keys []storage.Key
+	for key := it.Next(); key != nil; key = it.Next() {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// SwarmAPI is the RPC API of the Swarm chunk store of a node
+type SwarmAPI struct {
+	s *swarmService
+}
+
+// StoreChunk stores a chunk in the network
+func (api *SwarmAPI) StoreChunk(key, data hexutil.Bytes) error {
+	return api.s.storeChunk(key, data)
+}
+
+// RetrieveChunk retrieves a chunk from the network
+func (api *SwarmAPI) RetrieveChunk(key hexutil.Bytes) (hexutil.Bytes, error) {
+	return api.s.retrieveChunk(key)
+}
+
+// Chunks returns the keys of the chunks stored by the node
+func (api *SwarmAPI) Chunks() ([]hexutil.Bytes, error) {
+	keys, err := api.s.chunks()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]hexutil.Bytes, len(keys))
+	for i, key := range keys {
+		res[i] = hexutil.Bytes(key)
+	}
+	return res, nil
+}
+
+// Peers returns the IDs of the Kademlia peers chunks can be forwarded to
+func (api *SwarmAPI) Peers() []discover.NodeID {
+	var ids []discover.NodeID
+	api.s.kad.EachConn(nil, 255, func(conn network.OverlayConn, _ int, _ bool) bool {
+		if p, ok := conn.(interface {
+			ID() discover.NodeID
+		}); ok && api.s.peer(conn) != nil {
+			ids = append(ids, p.ID())
+		}
+		return true
+	})
+	return ids
+}
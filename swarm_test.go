@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+	"github.com/ethereum/go-ethereum/swarm/network"
+	"github.com/ethereum/go-ethereum/swarm/storage"
+)
+
+// recordingStore is a chunk store which records the keys of stored chunks
+type recordingStore struct {
+	storage.ChunkStore
+	mtx  sync.Mutex
+	keys []storage.Key
+}
+
+func (r *recordingStore) Put(chunk *storage.Chunk) {
+	r.mtx.Lock()
+	r.keys = append(r.keys, chunk.Key)
+	r.mtx.Unlock()
+	r.ChunkStore.Put(chunk)
+}
+
+// waitForPeers waits for each node to have at least count peers, as
+// returned by peers
+func waitForPeers(t *testing.T, nodes []*simulations.Node, count int, peers func(*simulations.Node) (int, error)) {
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		connected := true
+		for _, node := range nodes {
+			n, err := peers(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			connected = connected && n >= count
+		}
+		if connected {
+			return
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for peers")
+		}
+	}
+}
+
+// kademliaPeers returns the number of Kademlia peers of a sim node, which
+// are those it has completed the bzz handshake with and so can forward pss
+// messages to
+func kademliaPeers(node *simulations.Node) (int, error) {
+	for _, service := range node.Node.(*adapters.SimNode).Services() {
+		if bzz, ok := service.(*network.Bzz); ok {
+			var count int
+			bzz.EachConn(nil, 255, func(network.OverlayConn, int, bool) bool {
+				count++
+				return true
+			})
+			return count, nil
+		}
+	}
+	return 0, fmt.Errorf("node %s is not running the bzz service", node.Config.Name)
+}
+
+// swarmPeers returns the number of peers a node can forward chunks to
+func swarmPeers(node *simulations.Node) (int, error) {
+	client, err := node.Client()
+	if err != nil {
+		return 0, err
+	}
+	var peers []discover.NodeID
+	if err := client.Call(&peers, "swarm_peers"); err != nil {
+		return 0, err
+	}
+	return len(peers), nil
+}
+
+// TestSwarmGateway tests that content uploaded through a gateway attached to
+// one node is stored by the nodes closest to its chunks and can be retrieved
+// through another node
+func TestSwarmGateway(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "pss-demo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	net, err := NewPssSimulation(adapters.NewSimAdapter(services), 3, logDir, &keyStore{}, true)
+	if err != nil {
+		t.Fatalf("error creating pss simulation: %s", err)
+	}
+	defer net.Shutdown()
+	nodes := net.GetNodes()
+
+	// wait for the nodes to be able to forward chunks to each other
+	waitForPeers(t, nodes, len(nodes)-1, swarmPeers)
+
+	// upload content through the first node
+	gateway, err := newSwarmGateway(net, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &recordingStore{ChunkStore: gateway}
+	dpa := storage.NewDPA(store, storage.NewChunkerParams())
+	dpa.Start()
+	defer dpa.Stop()
+	data := make([]byte, 20000)
+	rand.Read(data)
+	swg := &sync.WaitGroup{}
+	key, err := dpa.Store(bytes.NewReader(data), int64(len(data)), swg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swg.Wait()
+
+	// check each chunk is held by the node closest to it
+	var report *chunkReport
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		report = gateway.Report()
+		if len(report.Chunks) == len(store.keys) {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("expected %d chunks to be stored, got %d", len(store.keys), len(report.Chunks))
+		}
+	}
+	for _, key := range store.keys {
+		var closest string
+		var closestAddr []byte
+		for _, node := range nodes {
+			addr := network.NewAddrFromNodeID(node.ID()).Over()
+			if closestAddr == nil || closer(key, addr, closestAddr) {
+				closest, closestAddr = node.Config.Name, addr
+			}
+		}
+		names := report.Chunks[key.Hex()]
+		if len(names) != 1 || names[0] != closest {
+			t.Fatalf("expected chunk %s to be held by %s, got %v", key.Log(), closest, names)
+		}
+	}
+
+	// check the content can be retrieved through the last node
+	other := &swarmGateway{net: net, nodes: []discover.NodeID{nodes[2].ID()}}
+	otherDPA := storage.NewDPA(other, storage.NewChunkerParams())
+	otherDPA.Start()
+	defer otherDPA.Stop()
+	reader := otherDPA.Retrieve(key)
+	size, err := reader.Size(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reader does not support reading past the end of the content
+	retrieved := make([]byte, size)
+	if _, err := reader.ReadAt(retrieved, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Fatal("retrieved content does not match uploaded content")
+	}
+}
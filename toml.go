@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// decodeTOML decodes the subset of TOML used by config files into a map
+// which can be re-encoded as JSON, supporting tables, dotted keys, strings,
+// integers, floats, booleans and single line arrays of those values (but not
+// inline tables, arrays of tables or dates)
+func decodeTOML(data []byte) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	table := root
+	// defined are the tables with headers, which may not be redefined
+	defined := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		var err error
+		if strings.HasPrefix(line, "[") {
+			table, err = decodeTOMLTable(root, defined, line)
+		} else {
+			err = decodeTOMLKeyValue(table, line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+	}
+	return root, scanner.Err()
+}
+
+// stripTOMLComment removes any comment from the line, ignoring '#'
+// characters in strings
+func stripTOMLComment(line string) string {
+	if i := indexTOML(line, '#'); i != -1 {
+		return line[:i]
+	}
+	return line
+}
+
+// decodeTOMLTable decodes a [table] header, returning the table and adding
+// it to the defined tables
+func decodeTOMLTable(root map[string]interface{}, defined map[string]bool, line string) (map[string]interface{}, error) {
+	if strings.HasPrefix(line, "[[") {
+		return nil, fmt.Errorf("arrays of tables are not supported")
+	}
+	if !strings.HasSuffix(line, "]") {
+		return nil, fmt.Errorf("invalid table header %s", line)
+	}
+	keys, err := splitTOMLKey(line[1 : len(line)-1])
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%q", keys)
+	if defined[name] {
+		return nil, fmt.Errorf("duplicate table %s", line)
+	}
+	defined[name] = true
+	return tomlTable(root, keys)
+}
+
+// decodeTOMLKeyValue decodes a key = value line into the table
+func decodeTOMLKeyValue(table map[string]interface{}, line string) error {
+	i := indexTOML(line, '=')
+	if i == -1 {
+		return fmt.Errorf("expected key = value, got %s", line)
+	}
+	keys, err := splitTOMLKey(line[:i])
+	if err != nil {
+		return err
+	}
+	table, err = tomlTable(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	key := keys[len(keys)-1]
+	if _, ok := table[key]; ok {
+		return fmt.Errorf("duplicate key %q", key)
+	}
+	value, err := decodeTOMLValue(strings.TrimSpace(line[i+1:]))
+	if err != nil {
+		return fmt.Errorf("invalid value for %q: %s", key, err)
+	}
+	table[key] = value
+	return nil
+}
+
+// tomlTable returns the nested table with the given keys, creating it if it
+// does not exist
+func tomlTable(table map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, key := range keys {
+		v, ok := table[key]
+		if !ok {
+			v = make(map[string]interface{})
+			table[key] = v
+		}
+		table, ok = v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%q is not a table", key)
+		}
+	}
+	return table, nil
+}
+
+// splitTOMLKey splits a dotted key into its bare or quoted parts, with dots
+// in quoted parts being part of the key
+func splitTOMLKey(s string) ([]string, error) {
+	invalid := fmt.Errorf("invalid key %q", strings.TrimSpace(s))
+	var keys []string
+	rest := strings.TrimSpace(s)
+	for {
+		var key string
+		switch {
+		case rest == "":
+			return nil, invalid
+		case rest[0] == '"' || rest[0] == '\'':
+			end := tomlStringEnd(rest)
+			if end == -1 {
+				return nil, invalid
+			}
+			key = rest[1:end]
+			if rest[0] == '"' {
+				var err error
+				if key, err = strconv.Unquote(rest[:end+1]); err != nil {
+					return nil, invalid
+				}
+			}
+			rest = rest[end+1:]
+		default:
+			end := strings.IndexFunc(rest, func(r rune) bool {
+				return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+			})
+			if end == 0 {
+				return nil, invalid
+			} else if end == -1 {
+				end = len(rest)
+			}
+			key, rest = rest[:end], rest[end:]
+		}
+		keys = append(keys, key)
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			return keys, nil
+		}
+		if rest[0] != '.' {
+			return nil, invalid
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+}
+
+// tomlStringEnd returns the index of the quote which ends the string at the
+// start of s, or -1 if the string is not terminated
+func tomlStringEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[0] == '"' && s[i] == '\\':
+			i++
+		case s[i] == s[0]:
+			return i
+		}
+	}
+	return -1
+}
+
+// indexTOML returns the index of the first c in s which is not in a string,
+// or -1 if there is none
+func indexTOML(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case c:
+			return i
+		case '"', '\'':
+			end := tomlStringEnd(s[i:])
+			if end == -1 {
+				return -1
+			}
+			i += end
+		}
+	}
+	return -1
+}
+
+// decodeTOMLValue decodes a string, integer, float, boolean or array
+func decodeTOMLValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' || strings.Contains(s[1:len(s)-1], "'") {
+			return nil, fmt.Errorf("invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		return decodeTOMLArray(s)
+	case s[0] == '{':
+		return nil, fmt.Errorf("inline tables are not supported")
+	}
+	num := strings.Replace(s, "_", "", -1)
+	if tomlDecimal(s) {
+		return strconv.ParseInt(num, 10, 64)
+	}
+	if i := strings.IndexAny(s, ".eE"); i > 0 && tomlDecimal(s[:i]) && strings.Trim(s[i:], "0123456789_.eE+-") == "" {
+		if f, err := strconv.ParseFloat(num, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported value %s", s)
+}
+
+// tomlDecimal reports whether s is a base 10 integer with an optional sign,
+// no leading zeros and underscores only between digits
+func tomlDecimal(s string) bool {
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	if s == "" || len(s) > 1 && s[0] == '0' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] >= '0' && s[i] <= '9':
+		case s[i] == '_' && i > 0 && i < len(s)-1 && s[i-1] != '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decodeTOMLArray decodes a single line array
+func decodeTOMLArray(s string) ([]interface{}, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("arrays must be on a single line")
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	values := []interface{}{}
+	for s != "" {
+		// find the end of the element, skipping over strings
+		end := indexTOML(s, ',')
+		if end == -1 {
+			end = len(s)
+		}
+		value, err := decodeTOMLValue(strings.TrimSpace(s[:end]))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if end == len(s) {
+			break
+		}
+		s = strings.TrimSpace(s[end+1:])
+	}
+	return values, nil
+}